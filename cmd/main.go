@@ -2,14 +2,18 @@ package main
 
 import (
 	"context"
+	stdjson "encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/BLAZED-sh/rpc-rproxy/pkg/json"
 	"github.com/BLAZED-sh/rpc-rproxy/pkg/proxy"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -19,19 +23,59 @@ func main() {
 	// CLI flag definitions
 	// Basic options
 	listenSocket := flag.String("listen", "/tmp/rpc-proxy.sock", "Unix socket path to listen on")
-	upstreamSocket := flag.String("upstream", "", "Unix socket path for upstream connection")
+	upstreamSocket := flag.String("upstream", "", "Unix socket paths of upstream nodes, comma separated and tried in order")
 	socketPerms := flag.String("socket-perms", "0666", "Unix socket permissions in octal (e.g. 0666)")
 
 	// Feature options
 	asyncCallbacks := flag.Bool("async", false, "Enable asynchronous callbacks")
-	multiplexing := flag.Bool("multiplex", false, "Enable message multiplexing for the upstream")
-	
+	multiplexing := flag.Bool("multiplex", false, "Replace request ids with ids unique across all connections to the upstream")
+	notificationQueue := flag.Int("notification-queue", 0, "Notifications buffered per client before -queue-policy applies (0 writes them directly)")
+	queuePolicy := flag.String("queue-policy", "backpressure", "What to do when a client's notification queue is full (backpressure, drop-oldest, drop-client)")
+	hedgeDelay := flag.Duration("hedge-delay", 0, "Send idempotent requests to a second upstream if the first one didn't answer after this long (0 disables)")
+	hedgePercentile := flag.Float64("hedge-percentile", 0, "Derive the hedge delay from this latency percentile of recent requests, e.g. 0.95 (0 disables)")
+	retries := flag.Int("retries", 0, "Resend failed idempotent requests this often and reconnect broken upstreams (0 disables)")
+	retryBackoff := flag.Duration("retry-backoff", 100*time.Millisecond, "Wait before the first retry, doubled for every further one")
+	retryCodes := flag.String("retry-codes", "", "Comma separated JSON-RPC error codes of upstream responses that are retried, e.g. -32000")
+	breakerFailures := flag.Int("breaker-failures", 0, "Open an upstream's circuit breaker after this many failures in a row (0 disables)")
+	breakerErrorRate := flag.Float64("breaker-error-rate", 0, "Open an upstream's circuit breaker when this share of the last -breaker-window requests failed, e.g. 0.5 (0 disables)")
+	breakerWindow := flag.Int("breaker-window", 100, "Requests considered for -breaker-error-rate")
+	breakerOpen := flag.Duration("breaker-open", 10*time.Second, "Time an open circuit breaker routes around its upstream before probing it")
+	breakerProbes := flag.Int("breaker-probes", 3, "Successful probe requests needed to close a half-open circuit breaker")
+	breakerCodes := flag.String("breaker-codes", "", "Comma separated JSON-RPC error codes of upstream responses that count as failures, e.g. -32000")
+	idempotentMethods := flag.String("idempotent-methods", strings.Join(proxy.DefaultIdempotentMethods, ","), "Comma separated methods that may be sent to an upstream more than once")
+	sharedSubscriptions := flag.Bool("shared-subscriptions", false, "Serve identical subscriptions of all clients with one upstream subscription")
+
+	// Timeout options
+	idleTimeout := flag.Duration("idle-timeout", 0, "Close connections without messages in either direction for this long (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 0, "Deadline for writes to the client and upstream (0 disables)")
+	requestTimeout := flag.Duration("request-timeout", 0, "Time the upstream has to answer a request (0 disables)")
+	methodTimeouts := flag.String("method-timeouts", "", "Per method request timeouts, e.g. debug_traceTransaction=5m,eth_blockNumber=2s")
+
+	// Connection limit options
+	maxConnections := flag.Int("max-connections", 0, "Maximum number of client connections (0 is unlimited)")
+	maxConnectionsPerPeer := flag.Int("max-connections-per-peer", 0, "Maximum number of client connections per peer uid (0 is unlimited)")
+	limitPolicy := flag.String("limit-policy", "queue", "What to do when a connection limit is reached (queue, reject, evict-idle)")
+
 	// Debug options
 	debugSignal := flag.Int("debug-signal", int(syscall.SIGUSR1), "Signal number to use for dumping debug info (default: SIGUSR1)")
 
+	// Upgrade options
+	upgradeSignal := flag.Int("upgrade-signal", int(syscall.SIGUSR2), "Signal number to use for a zero-downtime binary upgrade (default: SIGUSR2)")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "Time to wait for active connections to finish after an upgrade")
+
 	// Performance options
 	bufferSize := flag.Int("buffer", 16384, "Buffer size for JSON stream lexer")
 	maxRead := flag.Int("max-read", 4096, "Maximum read size per operation")
+	passthroughThreshold := flag.Int("passthrough-threshold", proxy.DefaultPassthroughThreshold, "Stream upstream messages bigger than this many bytes to the client without buffering them (0 disables)")
+
+	// Framing options
+	var clientFraming, upstreamFraming json.Framing
+	flag.TextVar(&clientFraming, "client-framing", json.FramingJSON, "Message framing of clients (json, content-length, length-prefix)")
+	flag.TextVar(&upstreamFraming, "upstream-framing", json.FramingJSON, "Message framing of the upstream (json, content-length, length-prefix)")
+
+	// Lexer limits, responses like full blocks are legitimately bigger than requests
+	clientPolicy := lexerPolicyFlags("client", json.DefaultLexerPolicy())
+	upstreamPolicy := lexerPolicyFlags("upstream", proxy.DefaultUpstreamLexerPolicy)
 
 	// Logging options
 	logLevel := flag.String("log-level", "info", "Log level (trace, debug, info, warn, error, fatal)")
@@ -39,6 +83,8 @@ func main() {
 
 	// Other options
 	showVersion := flag.Bool("version", false, "Show version and exit")
+	configFile := flag.String("config", "", "Load the proxy configuration from a JSON file instead of the proxy flags")
+	printConfig := flag.Bool("print-config", false, "Print the proxy configuration as JSON and exit")
 
 	flag.Parse()
 
@@ -52,7 +98,7 @@ func main() {
 	}
 
 	// Validate required flags
-	if *upstreamSocket == "" {
+	if *upstreamSocket == "" && *configFile == "" {
 		fmt.Println("Error: --upstream flag is required")
 		flag.Usage()
 		os.Exit(1)
@@ -62,31 +108,129 @@ func main() {
 	setupLogging(*logLevel, *prettyLogs)
 
 	// Create proxy
-	rpcProxy := proxy.NewUnixUpstreamJsonRpcProxy(*upstreamSocket, *asyncCallbacks, *multiplexing, *bufferSize, *maxRead)
+	config := proxy.DefaultConfig()
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to read --config")
+		}
+		if err := stdjson.Unmarshal(data, &config); err != nil {
+			log.Fatal().Err(err).Str("config", *configFile).Msg("Invalid --config")
+		}
+	} else {
+		methods, err := parseMethodTimeouts(*methodTimeouts)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --method-timeouts")
+		}
+		policy, err := proxy.ParseLimitPolicy(*limitPolicy)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --limit-policy")
+		}
+		notificationPolicy, err := proxy.ParseQueuePolicy(*queuePolicy)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --queue-policy")
+		}
+		codes, err := parseCodes(*retryCodes)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --retry-codes")
+		}
+		failureCodes, err := parseCodes(*breakerCodes)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid --breaker-codes")
+		}
 
-	// Remove socket file if it exists
-	if _, err := os.Stat(*listenSocket); err == nil {
-		if err := os.Remove(*listenSocket); err != nil {
-			log.Fatal().Err(err).Str("socket", *listenSocket).Msg("Failed to remove existing socket file")
+		config.Upstreams = nil
+		for _, path := range splitList(*upstreamSocket) {
+			config.Upstreams = append(config.Upstreams, proxy.UpstreamConfig{
+				Network:   "unix",
+				Address:   path,
+				Framing:   upstreamFraming,
+				Multiplex: *multiplexing,
+			})
+		}
+		config.AsyncCallbacks = *asyncCallbacks
+		config.BufferSize = *bufferSize
+		config.MaxRead = *maxRead
+		config.ClientPolicy = *clientPolicy
+		config.UpstreamPolicy = *upstreamPolicy
+		config.ClientFraming = clientFraming
+		config.Limits = proxy.ConnectionLimits{
+			Max:        *maxConnections,
+			MaxPerPeer: *maxConnectionsPerPeer,
+			Policy:     policy,
+		}
+		config.Timeouts = proxy.Timeouts{
+			Idle:    proxy.Duration(*idleTimeout),
+			Write:   proxy.Duration(*writeTimeout),
+			Request: proxy.Duration(*requestTimeout),
+			Methods: methods,
 		}
-		log.Debug().Str("socket", *listenSocket).Msg("Removed existing socket file")
+		config.PassthroughThreshold = *passthroughThreshold
+		config.SharedSubscriptions = *sharedSubscriptions
+		config.IdempotentMethods = splitList(*idempotentMethods)
+		config.Hedging = proxy.Hedging{Delay: proxy.Duration(*hedgeDelay), Percentile: *hedgePercentile}
+		config.Retry = proxy.Retry{Attempts: *retries, Backoff: proxy.Duration(*retryBackoff), ErrorCodes: codes}
+		config.NotificationQueue = proxy.NotificationQueue{Size: *notificationQueue, Policy: notificationPolicy}
+		config.CircuitBreaker = proxy.CircuitBreaker{
+			ConsecutiveFailures: *breakerFailures,
+			ErrorRate:           *breakerErrorRate,
+			Window:              *breakerWindow,
+			OpenDuration:        proxy.Duration(*breakerOpen),
+			HalfOpenProbes:      *breakerProbes,
+			ErrorCodes:          failureCodes,
+		}
+	}
+
+	if *printConfig {
+		out, err := stdjson.MarshalIndent(config, "", "  ")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to encode config")
+		}
+		fmt.Println(string(out))
+		os.Exit(0)
 	}
 
-	// Add listener
-	err := rpcProxy.AddUnixSocketListener(context.Background(), *listenSocket)
+	rpcProxy, err := proxy.New(proxy.WithConfig(config), proxy.WithLogger(log.Logger))
 	if err != nil {
-		log.Fatal().Err(err).Str("socket", *listenSocket).Msg("Failed to add Unix socket listener")
+		log.Fatal().Err(err).Msg("Failed to create proxy")
 	}
 
-	// Set socket permissions
-	socketMode, err := strconv.ParseUint(*socketPerms, 8, 32)
+	// Use listeners handed to us by systemd or a parent process doing an upgrade
+	inherited, err := proxy.InheritedListeners()
 	if err != nil {
-		log.Warn().Err(err).Str("perms", *socketPerms).Msg("Invalid socket permissions format, using default 0666")
-		socketMode = 0666
+		log.Fatal().Err(err).Msg("Failed to use inherited listeners")
 	}
 
-	if err := os.Chmod(*listenSocket, os.FileMode(socketMode)); err != nil {
-		log.Warn().Err(err).Str("socket", *listenSocket).Uint64("mode", socketMode).Msg("Failed to set socket permissions")
+	if len(inherited) > 0 {
+		for _, listener := range inherited {
+			rpcProxy.AddListener(listener)
+			log.Info().Str("socket", listener.Addr().String()).Msg("Using inherited listener")
+		}
+	} else {
+		// Remove socket file if it exists
+		if _, err := os.Stat(*listenSocket); err == nil {
+			if err := os.Remove(*listenSocket); err != nil {
+				log.Fatal().Err(err).Str("socket", *listenSocket).Msg("Failed to remove existing socket file")
+			}
+			log.Debug().Str("socket", *listenSocket).Msg("Removed existing socket file")
+		}
+
+		// Add listener
+		err := rpcProxy.AddUnixSocketListener(context.Background(), *listenSocket)
+		if err != nil {
+			log.Fatal().Err(err).Str("socket", *listenSocket).Msg("Failed to add Unix socket listener")
+		}
+
+		// Set socket permissions
+		socketMode, err := strconv.ParseUint(*socketPerms, 8, 32)
+		if err != nil {
+			log.Warn().Err(err).Str("perms", *socketPerms).Msg("Invalid socket permissions format, using default 0666")
+			socketMode = 0666
+		}
+
+		if err := os.Chmod(*listenSocket, os.FileMode(socketMode)); err != nil {
+			log.Warn().Err(err).Str("socket", *listenSocket).Uint64("mode", socketMode).Msg("Failed to set socket permissions")
+		}
 	}
 
 	// Start listening
@@ -98,21 +242,33 @@ func main() {
 		Bool("multiplexing", *multiplexing).
 		Int("buffer_size", *bufferSize).
 		Int("max_read", *maxRead).
+		Dur("idle_timeout", *idleTimeout).
+		Dur("request_timeout", *requestTimeout).
 		Str("version", version).
 		Msg("JSON-RPC proxy started")
 
+	// Tell the old process it can stop accepting if we were started by an upgrade
+	if err := proxy.NotifyReady(); err != nil {
+		log.Error().Err(err).Msg("Failed to notify parent process")
+	}
+
 	// Setup signal handlers
 	sigChan := make(chan os.Signal, 1)
 	debugSigChan := make(chan os.Signal, 1)
-	
-	// Register for debug signal 
+	upgradeSigChan := make(chan os.Signal, 1)
+
+	// Register for debug signal
 	debugSig := syscall.Signal(*debugSignal)
 	signal.Notify(debugSigChan, debugSig)
 	log.Info().Int("signal", *debugSignal).Msg("Debug signal registered - send this signal to dump debug info")
-	
+
+	// Register for upgrade signal
+	signal.Notify(upgradeSigChan, syscall.Signal(*upgradeSignal))
+	log.Info().Int("signal", *upgradeSignal).Msg("Upgrade signal registered - send this signal to hand off to a new binary")
+
 	// Register for termination signals
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	
+
 	// Handle signals
 	go func() {
 		for {
@@ -120,7 +276,7 @@ func main() {
 			case <-debugSigChan:
 				log.Info().Int("signal", *debugSignal).Msg("Received debug signal - dumping debug information")
 				rpcProxy.DumpDebugInfo()
-				
+
 				// Additional debug: print goroutine stacks to stderr
 				buf := make([]byte, 1<<20) // 1MB buffer
 				stackLen := runtime.Stack(buf, true)
@@ -128,15 +284,46 @@ func main() {
 			}
 		}
 	}()
-	
-	// Wait for termination signal
-	<-sigChan
+
+	// Wait for termination or upgrade signal, a failed upgrade can be retried
+wait:
+	for {
+		select {
+		case <-sigChan:
+			break wait
+		case <-upgradeSigChan:
+		}
+
+		log.Info().Msg("Upgrading - starting new process")
+		readyCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		process, err := rpcProxy.Upgrade(readyCtx)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Msg("Upgrade failed, continuing with the current process")
+			continue
+		}
+
+		// The new process owns the sockets now, stop accepting and let our connections finish
+		rpcProxy.StopAccepting()
+		log.Info().Int("pid", process.Pid).Dur("timeout", *drainTimeout).Msg("Draining connections")
+
+		drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		if err := rpcProxy.Drain(drainCtx); err != nil {
+			log.Warn().Err(err).Int64("active_connections_count", rpcProxy.ActiveConnectionsCount).Msg("Drain timed out, closing remaining connections")
+		}
+		cancel()
+		rpcProxy.Shutdown()
+		return
+	}
 	log.Info().Msg("Shutting down...")
 
 	// Shutdown proxy
 	rpcProxy.Shutdown()
 
-	// Remove the socket file
+	// Remove the socket file, unless it belongs to systemd
+	if len(inherited) > 0 && proxy.SystemdSockets() {
+		return
+	}
 	if err := os.Remove(*listenSocket); err != nil {
 		log.Warn().Err(err).Str("socket", *listenSocket).Msg("Failed to remove socket file on shutdown")
 	} else {
@@ -144,6 +331,39 @@ func main() {
 	}
 }
 
+// lexerPolicyFlags registers the lexer policy flags for one side of the proxy
+func lexerPolicyFlags(side string, defaults json.LexerPolicy) *json.LexerPolicy {
+	policy := defaults
+	flag.IntVar(&policy.MaxDepth, side+"-max-depth", defaults.MaxDepth, "Maximum nesting depth of "+side+" messages (0 is unlimited)")
+	flag.IntVar(&policy.MaxStringLength, side+"-max-string-length", defaults.MaxStringLength, "Maximum string length in "+side+" messages (0 is unlimited)")
+	flag.IntVar(&policy.MaxArrayLength, side+"-max-array-length", defaults.MaxArrayLength, "Maximum array length in "+side+" messages (0 is unlimited)")
+	flag.IntVar(&policy.MaxObjectLength, side+"-max-object-length", defaults.MaxObjectLength, "Maximum number of object members in "+side+" messages (0 is unlimited)")
+	flag.IntVar(&policy.MaxMessageSize, side+"-max-message-size", defaults.MaxMessageSize, "Maximum size of "+side+" messages in bytes (0 is unlimited)")
+	flag.BoolVar(&policy.Strict, side+"-strict", defaults.Strict, "Fully validate the JSON grammar of "+side+" messages")
+	return &policy
+}
+
+// parseMethodTimeouts parses a comma separated list of method=duration pairs
+func parseMethodTimeouts(s string) (map[string]proxy.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	timeouts := map[string]proxy.Duration{}
+	for _, pair := range strings.Split(s, ",") {
+		method, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("expected method=duration, got %q", pair)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %w", method, err)
+		}
+		timeouts[method] = proxy.Duration(d)
+	}
+	return timeouts, nil
+}
+
 func setupLogging(level string, pretty bool) {
 	// Set log level
 	var logLevel zerolog.Level
@@ -172,3 +392,21 @@ func setupLogging(level string, pretty bool) {
 		log.Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
 	}
 }
+
+// splitList splits a comma separated flag value, empty elements are dropped
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' })
+}
+
+// parseCodes parses a comma separated list of JSON-RPC error codes
+func parseCodes(s string) ([]int, error) {
+	var codes []int
+	for _, code := range splitList(s) {
+		n, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, n)
+	}
+	return codes, nil
+}
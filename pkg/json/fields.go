@@ -0,0 +1,328 @@
+package json
+
+import (
+	"bytes"
+	stdJson "encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The field scanner works on complete messages as returned by DecodeAll and returns views
+// into the message instead of decoding it. Nested values are skipped, not validated.
+
+var (
+	// ErrFieldNotFound is returned if the object has no member with the requested key
+	ErrFieldNotFound = errors.New("field not found")
+	// ErrNotObject is returned if the message isn't a JSON object
+	ErrNotObject = errors.New("not a JSON object")
+)
+
+// Field returns the raw value of the top-level member key of the JSON object obj.
+// Strings are returned with their quotes. Like encoding/json the last member wins if a key is repeated.
+// The returned slice points into obj and is only valid as long as obj is.
+func Field(obj []byte, key string) ([]byte, error) {
+	start, end, err := FieldRange(obj, key)
+	if err != nil {
+		return nil, err
+	}
+	return obj[start:end], nil
+}
+
+// FieldRange is like Field but returns the position of the value in obj
+func FieldRange(obj []byte, key string) (start, end int, err error) {
+	start, end = -1, -1
+	it := objectIter{data: obj}
+	if err := it.init(); err != nil {
+		return -1, -1, err
+	}
+
+	for {
+		k, escaped, vStart, vEnd, ok := it.next()
+		if !ok {
+			break
+		}
+		if keyEqual(k, escaped, key) {
+			start, end = vStart, vEnd
+		}
+	}
+	if it.err != nil {
+		return -1, -1, it.err
+	}
+	if start == -1 {
+		return -1, -1, ErrFieldNotFound
+	}
+	return start, end, nil
+}
+
+// Fields looks up several top-level members in a single pass. values must have the same
+// length as keys, values[i] is set to the raw value of keys[i] or nil if it doesn't exist.
+func Fields(obj []byte, keys []string, values [][]byte) error {
+	if len(values) < len(keys) {
+		return fmt.Errorf("values has room for %d of %d keys", len(values), len(keys))
+	}
+	for i := range keys {
+		values[i] = nil
+	}
+
+	it := objectIter{data: obj}
+	if err := it.init(); err != nil {
+		return err
+	}
+
+	for {
+		k, escaped, vStart, vEnd, ok := it.next()
+		if !ok {
+			break
+		}
+		for i, key := range keys {
+			if keyEqual(k, escaped, key) {
+				values[i] = obj[vStart:vEnd]
+			}
+		}
+	}
+	return it.err
+}
+
+// Unquote returns the content of a raw JSON string value. Strings without escape
+// sequences are returned as a view into value, only escaped strings are decoded into a copy.
+func Unquote(value []byte) ([]byte, error) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return nil, fmt.Errorf("not a JSON string: %.20q", value)
+	}
+	inner := value[1 : len(value)-1]
+	if bytes.IndexByte(inner, '\\') == -1 {
+		return inner, nil
+	}
+
+	var s string
+	if err := stdJson.Unmarshal(value, &s); err != nil {
+		return nil, err
+	}
+	return []byte(s), nil
+}
+
+// objectIter walks the members of a JSON object
+type objectIter struct {
+	data  []byte
+	pos   int
+	first bool
+	err   error
+}
+
+func (it *objectIter) init() error {
+	it.pos = skipWhitespace(it.data, 0)
+	if it.pos >= len(it.data) || it.data[it.pos] != '{' {
+		return ErrNotObject
+	}
+	it.pos++
+	it.first = true
+	return nil
+}
+
+// next returns the raw key (without quotes) and the value range of the next member
+func (it *objectIter) next() (key []byte, escaped bool, vStart, vEnd int, ok bool) {
+	data := it.data
+	i := skipWhitespace(data, it.pos)
+	if i >= len(data) {
+		it.fail(i, "unexpected end of object")
+		return
+	}
+
+	if data[i] == '}' {
+		it.pos = i + 1
+		return
+	}
+	if !it.first {
+		if data[i] != ',' {
+			it.fail(i, "expected ',' or '}'")
+			return
+		}
+		i = skipWhitespace(data, i+1)
+	}
+	it.first = false
+
+	// Key
+	if i >= len(data) || data[i] != '"' {
+		it.fail(i, "expected string key")
+		return
+	}
+	keyEnd, keyEscaped := scanString(data, i)
+	if keyEnd == -1 {
+		it.fail(i, "unterminated string")
+		return
+	}
+	key = data[i+1 : keyEnd]
+
+	// Colon
+	i = skipWhitespace(data, keyEnd+1)
+	if i >= len(data) || data[i] != ':' {
+		it.fail(i, "expected ':'")
+		return
+	}
+
+	// Value
+	vStart = skipWhitespace(data, i+1)
+	vEnd = skipValue(data, vStart)
+	if vEnd == -1 {
+		it.fail(vStart, "invalid value")
+		return
+	}
+
+	it.pos = vEnd
+	return key, keyEscaped, vStart, vEnd, true
+}
+
+func (it *objectIter) fail(pos int, msg string) {
+	it.err = fmt.Errorf("invalid JSON object: %s at position %d", msg, pos)
+}
+
+func skipWhitespace(data []byte, i int) int {
+	for i < len(data) && isWhitespace[data[i]] {
+		i++
+	}
+	return i
+}
+
+// scanString returns the index of the closing quote of the string starting at data[i]
+// and whether the string contains escape sequences, -1 if it isn't terminated
+func scanString(data []byte, i int) (end int, escaped bool) {
+	for j := i + 1; j < len(data); j++ {
+		switch data[j] {
+		case '\\':
+			escaped = true
+			j++
+		case '"':
+			return j, escaped
+		}
+	}
+	return -1, escaped
+}
+
+// skipValue returns the index after the value starting at data[i], -1 if it is incomplete
+func skipValue(data []byte, i int) int {
+	if i >= len(data) {
+		return -1
+	}
+
+	switch data[i] {
+	case '"':
+		end, _ := scanString(data, i)
+		if end == -1 {
+			return -1
+		}
+		return end + 1
+	case '{', '[':
+		var s scanState
+		end := s.scan(data[i:])
+		if end == -1 {
+			return -1
+		}
+		return i + end + 1
+	case ',', '}', ']', ':':
+		return -1
+	}
+
+	// Number or literal, ends at the next delimiter
+	j := i
+	for j < len(data) && !isWhitespace[data[j]] && data[j] != ',' && data[j] != '}' && data[j] != ']' {
+		j++
+	}
+	return j
+}
+
+// keyEqual compares a raw key from the message with key
+func keyEqual(raw []byte, escaped bool, key string) bool {
+	if !escaped {
+		return string(raw) == key
+	}
+	return escapedEqual(raw, key)
+}
+
+// escapedEqual compares a raw key containing escape sequences with key without allocating
+func escapedEqual(raw []byte, key string) bool {
+	var buf [utf8.UTFMax]byte
+	k := 0
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c != '\\' {
+			if k >= len(key) || key[k] != c {
+				return false
+			}
+			k++
+			continue
+		}
+
+		i++
+		if i >= len(raw) {
+			return false
+		}
+		var r rune
+		switch raw[i] {
+		case '"', '\\', '/':
+			r = rune(raw[i])
+		case 'b':
+			r = '\b'
+		case 'f':
+			r = '\f'
+		case 'n':
+			r = '\n'
+		case 'r':
+			r = '\r'
+		case 't':
+			r = '\t'
+		case 'u':
+			var ok bool
+			r, ok = hexRune(raw, i+1)
+			if !ok {
+				return false
+			}
+			i += 4
+			if utf16.IsSurrogate(r) {
+				// Surrogate pairs are two \u escapes
+				r2, ok := rune(-1), false
+				if i+2 < len(raw) && raw[i+1] == '\\' && raw[i+2] == 'u' {
+					r2, ok = hexRune(raw, i+3)
+				}
+				if decoded := utf16.DecodeRune(r, r2); ok && decoded != utf8.RuneError {
+					r = decoded
+					i += 6
+				} else {
+					r = utf8.RuneError
+				}
+			}
+		default:
+			return false
+		}
+
+		n := utf8.EncodeRune(buf[:], r)
+		if k+n > len(key) || key[k:k+n] != string(buf[:n]) {
+			return false
+		}
+		k += n
+	}
+	return k == len(key)
+}
+
+// hexRune parses the four hex digits at raw[i:]
+func hexRune(raw []byte, i int) (rune, bool) {
+	if i+4 > len(raw) {
+		return 0, false
+	}
+	var r rune
+	for _, c := range raw[i : i+4] {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c = c - 'a' + 10
+		case 'A' <= c && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	return r, true
+}
@@ -0,0 +1,140 @@
+package json
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestField(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		key     string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "number",
+			input: `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`,
+			key:   "id",
+			want:  `1`,
+		},
+		{
+			name:  "string with quotes",
+			input: `{"jsonrpc":"2.0","method":"eth_call","id":"a\"b"}`,
+			key:   "id",
+			want:  `"a\"b"`,
+		},
+		{
+			name:  "whitespace",
+			input: "{ \"id\" \t:\n null , \"method\" : \"x\" }",
+			key:   "id",
+			want:  `null`,
+		},
+		{
+			name:  "skips nested id",
+			input: `{"params":[{"id":2,"s":"}]\"{"}],"result":{"id":3},"id":4}`,
+			key:   "id",
+			want:  `4`,
+		},
+		{
+			name:  "object value",
+			input: `{"result":{"hash":"0x1","txs":[1,2,{"a":"]"}]},"id":1}`,
+			key:   "result",
+			want:  `{"hash":"0x1","txs":[1,2,{"a":"]"}]}`,
+		},
+		{
+			name:  "escaped key",
+			input: `{"\u0069d":5,"method":"x"}`,
+			key:   "id",
+			want:  `5`,
+		},
+		{
+			name:  "escaped key surrogate pair",
+			input: `{"\ud83d\ude00":true}`,
+			key:   "😀",
+			want:  `true`,
+		},
+		{
+			name:  "last duplicate wins",
+			input: `{"id":1,"id":2}`,
+			key:   "id",
+			want:  `2`,
+		},
+		{
+			name:    "missing",
+			input:   `{"method":"eth_subscription","params":{}}`,
+			key:     "id",
+			wantErr: ErrFieldNotFound,
+		},
+		{
+			name:    "array",
+			input:   `[{"id":1}]`,
+			key:     "id",
+			wantErr: ErrNotObject,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := Field([]byte(tc.input), tc.key)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(value) != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, value)
+			}
+		})
+	}
+}
+
+func TestFieldMalformed(t *testing.T) {
+	inputs := []string{
+		`{"id"`,
+		`{"id":}`,
+		`{"id" 1}`,
+		`{"id":1 "method":"x"}`,
+		`{id:1}`,
+		`{"id":[1,2}`,
+		`{"id":"1`,
+	}
+	for _, input := range inputs {
+		if _, err := Field([]byte(input), "method"); err == nil || errors.Is(err, ErrFieldNotFound) {
+			t.Errorf("%s: expected syntax error, got %v", input, err)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	msg := []byte(`{"jsonrpc":"2.0","id":"abc","method":"eth_getBalance","params":["0x1", "latest"]}`)
+	keys := []string{"method", "id", "params", "result"}
+	values := make([][]byte, len(keys))
+
+	if err := Fields(msg, keys, values); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{`"eth_getBalance"`, `"abc"`, `["0x1", "latest"]`, ``}
+	for i := range keys {
+		if string(values[i]) != want[i] {
+			t.Errorf("%s: expected %s, got %s", keys[i], want[i], values[i])
+		}
+	}
+	if values[3] != nil {
+		t.Errorf("expected nil for missing key")
+	}
+
+	method, err := Unquote(values[0])
+	if err != nil || string(method) != "eth_getBalance" {
+		t.Errorf("unexpected unquoted method %q, %v", method, err)
+	}
+	escaped, err := Unquote([]byte(`"a\nb"`))
+	if err != nil || string(escaped) != "a\nb" {
+		t.Errorf("unexpected unquoted escaped string %q, %v", escaped, err)
+	}
+}
@@ -0,0 +1,244 @@
+package json
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Framing selects how messages are delimited in a stream, see SetFraming
+type Framing uint8
+
+const (
+	// FramingJSON separates back-to-back JSON values by balancing brackets, written messages end with a newline
+	FramingJSON Framing = iota
+	// FramingContentLength prefixes every message with LSP style headers like "Content-Length: 42\r\n\r\n"
+	FramingContentLength
+	// FramingLengthPrefix prefixes every message with its length as 4 byte big endian integer
+	FramingLengthPrefix
+)
+
+var framingNames = [...]string{
+	FramingJSON:          "json",
+	FramingContentLength: "content-length",
+	FramingLengthPrefix:  "length-prefix",
+}
+
+func (f Framing) String() string {
+	if int(f) < len(framingNames) {
+		return framingNames[f]
+	}
+	return fmt.Sprintf("Framing(%d)", int(f))
+}
+
+func (f Framing) MarshalText() ([]byte, error) {
+	if int(f) >= len(framingNames) {
+		return nil, fmt.Errorf("unknown framing %d", int(f))
+	}
+	return []byte(framingNames[f]), nil
+}
+
+func (f *Framing) UnmarshalText(text []byte) error {
+	for i, name := range framingNames {
+		if string(text) == name {
+			*f = Framing(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown framing %q, expected json, content-length or length-prefix", text)
+}
+
+// AppendFrame appends msg framed with f to dst
+func (f Framing) AppendFrame(dst, msg []byte) []byte {
+	switch f {
+	case FramingContentLength:
+		dst = append(dst, "Content-Length: "...)
+		dst = strconv.AppendInt(dst, int64(len(msg)), 10)
+		dst = append(dst, "\r\n\r\n"...)
+	case FramingLengthPrefix:
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(msg)))
+	}
+	dst = append(dst, msg...)
+	if f == FramingJSON {
+		dst = append(dst, '\n')
+	}
+	return dst
+}
+
+// FrameError is returned for a frame header that can't be parsed. There is no way to find
+// the next frame after it, so it is final even in recovery mode.
+type FrameError struct {
+	Framing Framing
+	Offset  int64 // Stream offset of the frame
+	Err     error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("invalid %s frame at offset %d: %v", e.Framing, e.Offset, e.Err)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// Headers longer than this are rejected before the terminating empty line is found
+const maxFrameHeader = 1 << 10
+
+var (
+	errFrameHeaderTooLong   = fmt.Errorf("header exceeds %d bytes", maxFrameHeader)
+	errMissingContentLength = errors.New("missing Content-Length header")
+	errInvalidContentLength = errors.New("invalid Content-Length header")
+	errInvalidFrameHeader   = errors.New("malformed header line")
+)
+
+// parseHeader parses the frame header at the start of buf and returns its length and the size of
+// the payload following it. header is -1 if buf doesn't hold the whole header yet.
+func (f Framing) parseHeader(buf []byte) (header, size int, err error) {
+	switch f {
+	case FramingContentLength:
+		return parseContentLength(buf)
+	case FramingLengthPrefix:
+		if len(buf) < 4 {
+			return -1, 0, nil
+		}
+		return 4, int(binary.BigEndian.Uint32(buf)), nil
+	}
+	return 0, 0, fmt.Errorf("%s has no frame header", f)
+}
+
+// parseContentLength parses LSP style headers, every line is terminated by CRLF and
+// an empty line ends the header. Headers other than Content-Length are ignored.
+func parseContentLength(buf []byte) (header, size int, err error) {
+	end := bytes.Index(buf[:min(len(buf), maxFrameHeader)], []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(buf) >= maxFrameHeader {
+			return 0, 0, errFrameHeaderTooLong
+		}
+		return -1, 0, nil
+	}
+
+	size = -1
+	lines := buf[:end+2]
+	for len(lines) > 0 {
+		line, rest, _ := bytes.Cut(lines, []byte("\r\n"))
+		lines = rest
+
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			return 0, 0, errInvalidFrameHeader
+		}
+		if !bytes.EqualFold(bytes.TrimSpace(name), []byte("Content-Length")) {
+			continue
+		}
+
+		value = bytes.TrimSpace(value)
+		if len(value) == 0 || len(value) > 10 {
+			return 0, 0, errInvalidContentLength
+		}
+		n := 0
+		for _, c := range value {
+			if c < '0' || c > '9' {
+				return 0, 0, errInvalidContentLength
+			}
+			n = n*10 + int(c-'0')
+		}
+		if n > math.MaxInt32 {
+			return 0, 0, errInvalidContentLength
+		}
+		size = n
+	}
+	if size == -1 {
+		return 0, 0, errMissingContentLength
+	}
+	return end + 4, size, nil
+}
+
+// SetFraming selects how the lexer finds messages in the stream, FramingJSON by default.
+// Framed payloads are checked against the policy like any other message and must hold exactly one
+// JSON object or array. In recovery mode invalid payloads are skipped frame by frame.
+// Passthrough streaming only applies to FramingJSON.
+func (l *JsonStreamLexer) SetFraming(f Framing) {
+	l.framing = f
+}
+
+// Framing returns how the lexer finds messages in the stream
+func (l *JsonStreamLexer) Framing() Framing {
+	return l.framing
+}
+
+// nextFrame finds the next complete frame at the cursor and checks its payload. The returned
+// positions span the whole payload, which ends with the frame. end is -1 if more data is needed.
+func (l *JsonStreamLexer) nextFrame() (start, end int, err error) {
+	header, size, err := l.framing.parseHeader(l.buffer[l.cursor:l.length])
+	if err != nil {
+		return 0, 0, &FrameError{Framing: l.framing, Offset: l.offset + int64(l.cursor), Err: err}
+	}
+	if header == -1 {
+		return l.cursor, -1, nil
+	}
+	l.frameLength = header + size
+
+	start = l.cursor + header
+	if size > l.limits.maxMessageSize {
+		// Don't wait for a payload we won't accept anyway
+		return 0, 0, &LimitError{
+			Limit:  LimitMessageSize,
+			Max:    l.limits.maxMessageSize,
+			Offset: l.offset + int64(start+l.limits.maxMessageSize),
+		}
+	}
+	if l.length-l.cursor < l.frameLength {
+		return l.cursor, -1, nil
+	}
+	end = start + size - 1
+
+	// Scan the payload like a message of its own
+	cursor, length := l.cursor, l.length
+	l.cursor, l.length = start, end+1
+	_, objEnd, err := l.NextObject()
+	l.cursor, l.length = cursor, length
+	l.partial = partialScan{}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case size == 0:
+		return 0, 0, fmt.Errorf("invalid JSON: empty frame at position %d", start)
+	case objEnd == -1:
+		return 0, 0, fmt.Errorf("invalid JSON: incomplete message in frame at position %d", start)
+	}
+	for i := objEnd + 1; i <= end; i++ {
+		if !isWhitespace[l.buffer[i]] {
+			return 0, 0, fmt.Errorf("invalid JSON: unexpected data after message at position %d", i)
+		}
+	}
+	return start, end, nil
+}
+
+// skipFrame starts skipping the frame at the cursor after err, the frame may continue after the next read
+func (l *JsonStreamLexer) skipFrame(err error) error {
+	l.skipping = true
+	l.skipStart = l.offset + int64(l.cursor)
+	l.skipErr = err
+	l.skipRemaining = l.frameLength
+	return l.skipFrameBytes()
+}
+
+// skipFrameBytes discards the rest of the skipped frame as far as it is buffered
+func (l *JsonStreamLexer) skipFrameBytes() error {
+	n := min(l.skipRemaining, l.length-l.cursor)
+	l.skipRemaining -= n
+	if l.skipRemaining == 0 {
+		return l.finishSkip(l.cursor + n)
+	}
+
+	// The frame continues after the next read
+	l.offset += int64(l.length)
+	l.cursor = 0
+	l.length = 0
+	return nil
+}
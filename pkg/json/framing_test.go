@@ -0,0 +1,150 @@
+package json
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFramingText(t *testing.T) {
+	for _, f := range []Framing{FramingJSON, FramingContentLength, FramingLengthPrefix} {
+		text, err := f.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed Framing
+		if err := parsed.UnmarshalText(text); err != nil || parsed != f {
+			t.Errorf("%s: round trip gave %v, %v", f, parsed, err)
+		}
+	}
+
+	var f Framing
+	if err := f.UnmarshalText([]byte("lines")); err == nil {
+		t.Error("expected an error for an unknown framing")
+	}
+}
+
+func TestDecodeAllFraming(t *testing.T) {
+	messages := []string{`{"a":1}`, ` [1,{"b":"}"}] `, `{"c":"` + strings.Repeat("x", 100) + `"}`}
+
+	for _, framing := range []Framing{FramingJSON, FramingContentLength, FramingLengthPrefix} {
+		var input []byte
+		for _, msg := range messages {
+			input = framing.AppendFrame(input, []byte(msg))
+		}
+
+		for _, maxRead := range []int{1, 7, 4096} {
+			t.Run(fmt.Sprintf("%s/%d", framing, maxRead), func(t *testing.T) {
+				lexer := NewJsonStreamLexer(bytes.NewReader(input), 16, maxRead, false)
+				lexer.SetFraming(framing)
+
+				var got []string
+				lexer.DecodeAll(context.Background(), func(b []byte) {
+					got = append(got, strings.TrimSpace(string(b)))
+				}, func(err error) {
+					t.Errorf("unexpected error: %v", err)
+				})
+
+				if len(got) != len(messages) {
+					t.Fatalf("expected %d messages, got %q", len(messages), got)
+				}
+				for i, msg := range messages {
+					if got[i] != strings.TrimSpace(msg) {
+						t.Errorf("message %d: expected %q, got %q", i, msg, got[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestContentLengthHeaders(t *testing.T) {
+	input := "content-length:7\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n{\"a\":1}"
+	lexer := NewJsonStreamLexer(strings.NewReader(input), 16, 16, false)
+	lexer.SetFraming(FramingContentLength)
+
+	msg, err := lexer.Next(context.Background())
+	if err != nil || string(msg) != `{"a":1}` {
+		t.Fatalf("unexpected message %q, %v", msg, err)
+	}
+
+	invalid := []string{
+		"Content-Type: x\r\n\r\n{}",
+		"Content-Length: -1\r\n\r\n{}",
+		"Content-Length: 99999999999\r\n\r\n{}",
+		"Content-Length 2\r\n\r\n{}",
+		"Content-Length: " + strings.Repeat(" ", maxFrameHeader),
+	}
+	for _, input := range invalid {
+		lexer := NewJsonStreamLexer(strings.NewReader(input), 16, 16, false)
+		lexer.SetFraming(FramingContentLength)
+		lexer.SetRecovery(true)
+
+		// Broken headers are final even in recovery mode
+		var frameErr *FrameError
+		if _, err := lexer.Next(context.Background()); !errors.As(err, &frameErr) {
+			t.Errorf("%q: expected a *FrameError, got %v", input, err)
+		}
+	}
+}
+
+func TestDecodeAllFramingRecovery(t *testing.T) {
+	policy := LexerPolicy{MaxDepth: 2, MaxMessageSize: 32, Strict: true}
+	payloads := []string{
+		`{"a":1}`,
+		`{"a":{"b":{}}}`,                         // Too deep
+		`{"a":1} {"b":2}`,                        // Two messages in one frame
+		`{"a":` + strings.Repeat(" ", 40) + `1}`, // Too big
+		`{"a":tru}`,                              // Invalid JSON
+		`{"a":`,                                  // Incomplete
+		``,                                       // Empty
+		`{"b":2}`,
+	}
+
+	for _, framing := range []Framing{FramingContentLength, FramingLengthPrefix} {
+		var input []byte
+		var offsets []int64
+		for _, p := range payloads {
+			offsets = append(offsets, int64(len(input)))
+			input = framing.AppendFrame(input, []byte(p))
+		}
+		offsets = append(offsets, int64(len(input)))
+
+		t.Run(framing.String(), func(t *testing.T) {
+			lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader(input), 16, 5, false, policy)
+			lexer.SetFraming(framing)
+			lexer.SetRecovery(true)
+
+			var objects []string
+			var skipped []*SkippedError
+			lexer.DecodeAll(context.Background(), func(b []byte) {
+				objects = append(objects, string(b))
+			}, func(err error) {
+				var s *SkippedError
+				if !errors.As(err, &s) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				skipped = append(skipped, s)
+			})
+
+			if len(objects) != 2 || objects[0] != payloads[0] || objects[1] != payloads[len(payloads)-1] {
+				t.Errorf("unexpected objects %q", objects)
+			}
+			if len(skipped) != len(payloads)-2 {
+				t.Fatalf("expected %d skipped frames, got %d", len(payloads)-2, len(skipped))
+			}
+			for i, s := range skipped {
+				frame := i + 1
+				if s.Offset != offsets[frame] || s.Length != offsets[frame+1]-offsets[frame] {
+					t.Errorf("frame %d: unexpected skip %+v", frame, s)
+				}
+			}
+			if !errors.Is(skipped[2].Err, ErrLimitExceeded) {
+				t.Errorf("expected a limit error for the oversized frame, got %v", skipped[2].Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package json
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidID is returned for JSON-RPC ids that aren't a number, string or null
+var ErrInvalidID = errors.New("JSON-RPC id must be a number, string or null")
+
+// ID returns the raw top-level id of a JSON-RPC message. It returns ErrFieldNotFound for
+// notifications and ErrInvalidID if the id isn't a number, string or null.
+func ID(msg []byte) ([]byte, error) {
+	start, end, err := FieldRange(msg, "id")
+	if err != nil {
+		return nil, err
+	}
+	id := msg[start:end]
+	if !validID(id) {
+		return nil, ErrInvalidID
+	}
+	return id, nil
+}
+
+// ReplaceID appends msg to dst with the value of its top-level id member replaced by newID,
+// which has to be a raw JSON number, string or null. Only the id bytes are touched, the rest
+// of the message is copied as is. The old id is returned as a view into msg, so dst must not
+// overlap msg. Swapping the old id back in restores the original message.
+func ReplaceID(dst, msg, newID []byte) (out, oldID []byte, err error) {
+	if !validID(newID) {
+		return nil, nil, fmt.Errorf("invalid new id %q: %w", newID, ErrInvalidID)
+	}
+
+	start, end, err := FieldRange(msg, "id")
+	if err != nil {
+		return nil, nil, err
+	}
+	oldID = msg[start:end]
+	if !validID(oldID) {
+		return nil, nil, ErrInvalidID
+	}
+
+	dst = append(dst, msg[:start]...)
+	dst = append(dst, newID...)
+	dst = append(dst, msg[end:]...)
+	return dst, oldID, nil
+}
+
+// validID checks that id is a single JSON number, string or null
+func validID(id []byte) bool {
+	if len(id) == 0 {
+		return false
+	}
+	switch c := id[0]; {
+	case c == '"':
+		end, _ := scanString(id, 0)
+		return end == len(id)-1
+	case c == '-' || ('0' <= c && c <= '9'):
+		return validNumber(id)
+	case c == 'n':
+		return string(id) == "null"
+	}
+	return false
+}
+
+// validNumber checks the JSON number grammar: -?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?
+func validNumber(n []byte) bool {
+	i := 0
+	if i < len(n) && n[i] == '-' {
+		i++
+	}
+	switch {
+	case i < len(n) && n[i] == '0':
+		i++
+	case i < len(n) && '1' <= n[i] && n[i] <= '9':
+		i = skipDigits(n, i)
+	default:
+		return false
+	}
+
+	if i < len(n) && n[i] == '.' {
+		j := skipDigits(n, i+1)
+		if j == i+1 {
+			return false
+		}
+		i = j
+	}
+
+	if i < len(n) && (n[i] == 'e' || n[i] == 'E') {
+		i++
+		if i < len(n) && (n[i] == '+' || n[i] == '-') {
+			i++
+		}
+		j := skipDigits(n, i)
+		if j == i {
+			return false
+		}
+		i = j
+	}
+	return i == len(n)
+}
+
+func skipDigits(n []byte, i int) int {
+	for i < len(n) && '0' <= n[i] && n[i] <= '9' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,162 @@
+package json
+
+import (
+	"bytes"
+	stdJson "encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestReplaceID(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		newID   string
+		want    string
+		wantOld string
+		wantErr error
+	}{
+		{
+			name:    "number",
+			input:   `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`,
+			newID:   `42`,
+			want:    `{"jsonrpc":"2.0","id":42,"method":"eth_blockNumber"}`,
+			wantOld: `1`,
+		},
+		{
+			name:    "string to number",
+			input:   `{"id" : "abc" ,"method":"x"}`,
+			newID:   `7`,
+			want:    `{"id" : 7 ,"method":"x"}`,
+			wantOld: `"abc"`,
+		},
+		{
+			name:    "escaped string",
+			input:   `{"method":"x","id":"a\"}\\"}`,
+			newID:   `"b"`,
+			want:    `{"method":"x","id":"b"}`,
+			wantOld: `"a\"}\\"`,
+		},
+		{
+			name:    "null",
+			input:   `{"id":null}`,
+			newID:   `-1.5e3`,
+			want:    `{"id":-1.5e3}`,
+			wantOld: `null`,
+		},
+		{
+			name:    "ignores nested ids",
+			input:   `{"params":[{"id":1}],"id":2,"x":{"id":3}}`,
+			newID:   `9`,
+			want:    `{"params":[{"id":1}],"id":9,"x":{"id":3}}`,
+			wantOld: `2`,
+		},
+		{
+			name:    "notification",
+			input:   `{"method":"eth_subscription","params":{"id":1}}`,
+			newID:   `1`,
+			wantErr: ErrFieldNotFound,
+		},
+		{
+			name:    "object id",
+			input:   `{"id":{"a":1}}`,
+			newID:   `1`,
+			wantErr: ErrInvalidID,
+		},
+		{
+			name:    "invalid new id",
+			input:   `{"id":1}`,
+			newID:   `01`,
+			wantErr: ErrInvalidID,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			out, oldID, err := ReplaceID(nil, []byte(tc.input), []byte(tc.newID))
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(out) != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, out)
+			}
+			if string(oldID) != tc.wantOld {
+				t.Errorf("expected old id %s, got %s", tc.wantOld, oldID)
+			}
+
+			// Swapping back restores the original message
+			restored, _, err := ReplaceID(nil, out, oldID)
+			if err != nil || string(restored) != tc.input {
+				t.Errorf("expected restored %s, got %s (%v)", tc.input, restored, err)
+			}
+		})
+	}
+}
+
+// FuzzReplaceID uses encoding/json as oracle for locating the top-level id
+func FuzzReplaceID(f *testing.F) {
+	seeds := []string{
+		`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+		`{"id" : "a\"b" , "params":[{"id":2}]}`,
+		`{"params":{"id":"x"},"id":null}`,
+		`{"id":1,"id":"dup"}`,
+		`{"method":"eth_subscription","params":{"result":"0x1"}}`,
+		` { "result" : [1, {"id": [2]}], "id" : -0.5E+2 } `,
+		`[{"id":1}]`,
+		`{"id":true}`,
+	}
+	for i, seed := range seeds {
+		f.Add(seed, uint64(i))
+	}
+
+	f.Fuzz(func(t *testing.T, msg string, n uint64) {
+		newID := strconv.AppendUint(nil, n, 10)
+		out, oldID, err := ReplaceID(nil, []byte(msg), newID)
+
+		var oracle map[string]stdJson.RawMessage
+		if stdJson.Unmarshal([]byte(msg), &oracle) != nil || oracle == nil {
+			t.Skip() // Invalid JSON or not an object, anything but a panic is fine
+		}
+
+		oracleID, hasID := oracle["id"]
+		if !hasID {
+			if !errors.Is(err, ErrFieldNotFound) {
+				t.Fatalf("%s: expected ErrFieldNotFound, got %v", msg, err)
+			}
+			return
+		}
+		if !validID(oracleID) {
+			if !errors.Is(err, ErrInvalidID) {
+				t.Fatalf("%s: expected ErrInvalidID for %s, got %v", msg, oracleID, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", msg, err)
+		}
+		if !bytes.Equal(oldID, oracleID) {
+			t.Fatalf("%s: expected old id %s, got %s", msg, oracleID, oldID)
+		}
+
+		// Only the id changed
+		var replaced map[string]stdJson.RawMessage
+		if err := stdJson.Unmarshal(out, &replaced); err != nil {
+			t.Fatalf("%s: result %s isn't valid JSON: %v", msg, out, err)
+		}
+		if !bytes.Equal(replaced["id"], newID) {
+			t.Fatalf("%s: expected id %s in %s", msg, newID, out)
+		}
+		for key, value := range oracle {
+			if key != "id" && !bytes.Equal(replaced[key], value) {
+				t.Fatalf("%s: member %q changed to %s", msg, key, replaced[key])
+			}
+		}
+	})
+}
@@ -2,8 +2,10 @@ package json
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 // JsonStreamLexer is a streaming JSON lexer/seperator that reads JSON objects and arrays from an io.Reader.
@@ -15,57 +17,146 @@ type JsonStreamLexer struct {
 	reader  io.Reader
 	maxRead int
 
-	buffer []byte
-	cursor int // Points to beginning of next json object
-	length int // Number of bytes used in buffer
+	buffer     []byte
+	bufferSize int         // Initial buffer size, the buffer is allocated on the first read
+	pool       *BufferPool // Optional source of buffers, see SetBufferPool
+
+	cursor int   // Points to beginning of next json object
+	length int   // Number of bytes used in buffer
+	offset int64 // Stream offset of the start of the buffer
 
 	asyncCallbacks bool
 
+	// Error recovery, see SetRecovery
+	recovery  bool
+	failStart int   // Buffer position of the message NextObject failed on
+	failPos   int   // Buffer position where NextObject failed
+	skipping  bool  // Skipping invalid input until the next message boundary
+	skipStart int64 // Stream offset where skipping started
+	skipErr   error // Error that started the skip
+
+	// Skipping a structurally valid message that violated the policy
+	skipValue bool
+	skipScan  scanState
+
+	// Framing of the stream, see SetFraming
+	framing       Framing
+	frameLength   int // Length of the frame at the cursor including its header, once the header is parsed
+	skipRemaining int // Bytes left of a skipped frame
+
+	// Streaming of oversized messages, see SetPassthrough
+	passthrough          PassthroughWriter
+	passthroughThreshold int
+	streaming            bool // Forwarding the rest of a message to passthrough
+	streamScan           scanState
+
+	// Final error of the pull API, see Next
+	pullErr error
+
 	// Parsing policy
-	maxDepth        uint8
-	maxStringLength uint32
-	maxArrayLength  uint16
-	maxObjectLength uint16
+	policy      LexerPolicy
+	limits      limits
+	containers  []uint32 // Element count << 1 | isObject for every open container, if counted
+	sparseJumps int      // Jumps left in a sparse message, see longRun
+	partial     partialScan
+	validator   validator // Only used for framed messages in strict mode
 }
 
-// Create a new JsonStreamLexer with the given reader and buffer size.
+// Create a new JsonStreamLexer with the given reader and buffer size and the DefaultLexerPolicy.
 func NewJsonStreamLexer(
 	reader io.Reader,
 	bufferSize int,
 	maxRead int,
 	asyncCallbacks bool,
 ) *JsonStreamLexer {
-	buffer := make([]byte, bufferSize)
+	return NewJsonStreamLexerWithPolicy(reader, bufferSize, maxRead, asyncCallbacks, DefaultLexerPolicy())
+}
 
+// Create a new JsonStreamLexer that enforces the given policy.
+func NewJsonStreamLexerWithPolicy(
+	reader io.Reader,
+	bufferSize int,
+	maxRead int,
+	asyncCallbacks bool,
+	policy LexerPolicy,
+) *JsonStreamLexer {
 	return &JsonStreamLexer{
-		reader:  reader,
-		buffer:  buffer,
-		maxRead: maxRead,
+		reader:     reader,
+		bufferSize: bufferSize,
+		maxRead:    maxRead,
 
 		asyncCallbacks: asyncCallbacks,
 
-		maxDepth:        20,
-		maxStringLength: 999999,
-		maxArrayLength:  9999,
-		maxObjectLength: 9999,
+		policy: policy,
+		limits: newLimits(policy),
+	}
+}
+
+// Policy returns the limits enforced by the lexer
+func (l *JsonStreamLexer) Policy() LexerPolicy {
+	return l.policy
+}
+
+// SetBufferPool makes the lexer take its buffer and the copies for async callbacks from pool.
+// It has to be called before decoding starts, call Release to return the buffer when done.
+func (l *JsonStreamLexer) SetBufferPool(pool *BufferPool) {
+	l.pool = pool
+}
+
+// Release returns the buffer to the pool. The lexer must not be used afterwards.
+func (l *JsonStreamLexer) Release() {
+	l.putBuffer(l.buffer)
+	l.buffer = nil
+	l.cursor = 0
+	l.length = 0
+	l.partial = partialScan{}
+}
+
+func (l *JsonStreamLexer) getBuffer(size int) []byte {
+	if l.pool == nil {
+		return make([]byte, size)
+	}
+	return l.pool.Get(size)
+}
+
+func (l *JsonStreamLexer) putBuffer(buf []byte) {
+	if l.pool != nil {
+		l.pool.Put(buf)
 	}
 }
 
+// shrinkFactor is how much bigger than needed the buffer may stay after a large message
+const shrinkFactor = 4
+
+// shrink swaps a buffer that grew for a large message for a smaller one once the message is done
+func (l *JsonStreamLexer) shrink() {
+	size := max(l.bufferSize, l.length+l.maxRead)
+	if cap(l.buffer) < shrinkFactor*size {
+		return
+	}
+
+	buf := l.getBuffer(size)
+	copy(buf, l.buffer[l.cursor:l.length])
+	l.putBuffer(l.buffer)
+	l.length -= l.cursor
+	l.offset += int64(l.cursor)
+	l.cursor = 0
+	l.buffer = buf[:l.length]
+}
+
 func (l *JsonStreamLexer) Read() (int, error) {
-	// Ensure we have room for at least maxRead more data
-	bCap := cap(l.buffer)
-	remainingCap := bCap - l.length
-	minCap := l.length + l.maxRead
-	if remainingCap < minCap {
-		var newCap int
-		if bCap < minCap {
-			newCap = minCap
-		} else {
-			newCap = bCap * 2
-		}
-		newBuffer := make([]byte, newCap)
+	if l.buffer == nil {
+		l.buffer = l.getBuffer(l.bufferSize)[:0]
+	}
+
+	// Ensure we have room for at least maxRead more data. Growing by doubling keeps
+	// copying linear for messages that arrive in many reads.
+	if cap(l.buffer)-l.length < l.maxRead {
+		newCap := max(cap(l.buffer)*2, l.length+l.maxRead)
+		newBuffer := l.getBuffer(newCap)
 		copy(newBuffer, l.buffer)
-		l.buffer = newBuffer
+		l.putBuffer(l.buffer)
+		l.buffer = newBuffer[:l.length]
 	}
 
 	// Read into buffer
@@ -80,104 +171,213 @@ func (l *JsonStreamLexer) Read() (int, error) {
 	return n, nil
 }
 
-// Try to read the stream object by object till we hit EOF
-func (l *JsonStreamLexer) DecodeAll(context context.Context, cb func([]byte), errCb func(error)) {
+// SetRecovery enables error recovery. Instead of stopping at invalid input the lexer skips
+// to the next plausible message boundary (a newline or an opening brace), reports the skipped
+// range as *SkippedError through the error callback and continues decoding.
+func (l *JsonStreamLexer) SetRecovery(enabled bool) {
+	l.recovery = enabled
+}
+
+// SkippedError is passed to the error callback when invalid input was skipped in recovery mode
+type SkippedError struct {
+	Offset int64 // Stream offset of the first skipped byte
+	Length int64 // Number of skipped bytes
+	Err    error // Error that caused the skip
+}
+
+func (e *SkippedError) Error() string {
+	return fmt.Sprintf("skipped %d bytes of invalid input at offset %d: %v", e.Length, e.Offset, e.Err)
+}
+
+func (e *SkippedError) Unwrap() error {
+	return e.Err
+}
+
+// Try to read the stream object by object till we hit EOF or ctx is done.
+// Cancelling ctx interrupts a blocked read, see interrupt, and reports context.Cause(ctx) through errCb.
+func (l *JsonStreamLexer) DecodeAll(ctx context.Context, cb func([]byte), errCb func(error)) {
+	stop := context.AfterFunc(ctx, l.interrupt)
+	defer stop()
+
 	lastObjComplete := true
-	done := context.Done()
 	for {
-		select {
-		case <-done:
-			break
-		default:
-			if l.length > 0 && lastObjComplete {
-				lastObjComplete = l.processBuffer(cb, errCb)
-			}
+		if ctx.Err() != nil {
+			cause := context.Cause(ctx)
+			l.abortStreaming(cause)
+			errCb(cause)
+			return
+		}
 
-			n, err := l.Read()
-			if n == 0 && err == nil {
-				continue // No new data, read again
+		if l.length > 0 && lastObjComplete {
+			var ok bool
+			lastObjComplete, ok = l.processBuffer(cb, errCb)
+			if !ok {
+				return // Invalid input and recovery is disabled
 			}
+		}
 
-			if err == io.EOF {
-				l.processBuffer(cb, errCb)
-				return
-			}
+		n, err := l.Read()
+		if n == 0 && err == nil {
+			continue // No new data, read again
+		}
+
+		if err != nil && ctx.Err() != nil {
+			continue // Interrupted, report the cause instead
+		}
 
-			// Exit on real errors
-			if err != nil {
-				errCb(err)
+		if err == io.EOF {
+			if _, ok := l.processBuffer(cb, errCb); !ok {
 				return
 			}
-
-			// Reset lastObjComplete if we read new data successfully
-			if !lastObjComplete {
-				lastObjComplete = true
+			if l.skipping {
+				errCb(l.finishSkip(l.length))
+			}
+			if l.streaming {
+				l.abortStreaming(io.ErrUnexpectedEOF)
+				errCb(io.ErrUnexpectedEOF)
 			}
+			return
+		}
+
+		// Exit on real errors
+		if err != nil {
+			l.abortStreaming(err)
+			errCb(err)
+			return
 		}
+
+		// Reset lastObjComplete if we read new data successfully
+		if !lastObjComplete {
+			lastObjComplete = true
+		}
+	}
+}
+
+// interrupt unblocks a pending read when the context is done. Readers with read deadlines
+// like net.Conn get a deadline in the past, other readers are closed if they implement io.Closer.
+// The reader can't be used for decoding afterwards.
+func (l *JsonStreamLexer) interrupt() {
+	switch r := l.reader.(type) {
+	case interface{ SetReadDeadline(time.Time) error }:
+		r.SetReadDeadline(time.Unix(1, 0))
+	case io.Closer:
+		r.Close()
 	}
 }
 
 // Pre-computed lookup tables for character classification
 var (
-	isWhitespace [256]bool
-	isStructural [256]bool
+	isWhitespace         [256]bool
+	isStructural         [256]bool
+	isStructuralCounting [256]bool // Includes commas to count elements
 )
 
 func init() {
 	// Initialize lookup tables
 	isWhitespace[' '], isWhitespace['\n'], isWhitespace['\r'], isWhitespace['\t'] = true, true, true, true
 	isStructural['{'], isStructural['}'], isStructural['['], isStructural[']'], isStructural['"'] = true, true, true, true, true
+	isStructuralCounting = isStructural
+	isStructuralCounting[','] = true
+}
+
+const containerObject = 1
+
+// partialScan is the NextObject state of an incomplete message. The next call resumes
+// from it, so a message arriving in many reads is scanned once instead of after every read.
+type partialScan struct {
+	active       bool
+	start        int // Message start relative to the cursor, compacting the buffer keeps it valid
+	pos          int // Number of message bytes already scanned
+	state        uint8
+	objectDepth  int
+	arrayDepth   int
+	stringLength int
+	expect       uint8
+	hexLeft      int
+}
+
+// Strings longer than this are scanned with SIMD, short ones aren't worth the call
+const longString = 16
+
+// Runs of bytes between structural characters outside of strings that are worth a SIMD jump.
+// Measuring every run would slow down dense messages, so runs are only jumped over once a
+// closing bracket looks like it ended a long one. Every jump of at least longRun bytes allows
+// sparseRuns more.
+const (
+	longRun    = 16
+	sparseRuns = 4
+)
+
+// sparseBefore reports whether the bytes before buf[i] look like a long run without structural
+// characters. Only some of them are sampled, a wrong guess costs a few jumps.
+func sparseBefore(structural *[256]bool, buf []byte, i int) bool {
+	return i >= longRun && !structural[buf[i-1]] && !structural[buf[i-longRun/2]] && !structural[buf[i-longRun]]
 }
 
 func (l *JsonStreamLexer) NextObject() (start, end int, err error) {
+	if l.policy.Strict {
+		return l.nextStrictObject()
+	}
+
 	const (
 		stateInString = 1 << iota
 		stateEscaped
+		stateSparse // Jumping over runs between structural characters, see longRun
 	)
 	var state uint8
 
-	// Use uint8 for depths since JSON rarely nests deeply
 	var (
-		objectDepth  uint8
-		arrayDepth   uint8
-		stringLength uint32
-		arrayLength  uint16
-		objectLength uint16
+		objectDepth  int
+		arrayDepth   int
+		stringLength int
 	)
+	limits := &l.limits
+	structural := &isStructural
+	if limits.countLengths {
+		structural = &isStructuralCounting
+	}
 
-	// Find start of object/array
-	buf := l.buffer[l.cursor:l.length]
-	for i := 0; i < len(buf); i++ {
-		c := buf[i]
-		if c == '{' || c == '[' {
-			start = l.cursor + i
-			goto parseLoop
-		}
-		if c == '}' || c == ']' {
-			return 0, 0, fmt.Errorf(
-				"invalid JSON: unmatched closing bracket at position %d",
-				l.cursor+i,
-			)
-		}
-		if !isWhitespace[c] {
-			return 0, 0, fmt.Errorf(
-				"invalid JSON: unexpected character '%c' at position %d",
-				c,
-				l.cursor+i,
-			)
-		}
+	var buf []byte
+	var resume int
+	if p := &l.partial; p.active {
+		// Continue the incomplete message from the last call
+		start = l.cursor + p.start
+		state, objectDepth, arrayDepth, stringLength = p.state, p.objectDepth, p.arrayDepth, p.stringLength
+		resume = p.pos
+		p.active = false
+		goto parseLoop
+	}
+
+	if start, end, err = l.messageStart(); end != 0 || err != nil {
+		return start, end, err
 	}
-	return l.cursor, -1, nil
 
 parseLoop:
 	buf = l.buffer[start:l.length]
-	for i := 0; i < len(buf); i++ {
+	// Don't look further than the maximum message size
+	truncated := len(buf) > limits.maxMessageSize
+	if truncated {
+		buf = buf[:limits.maxMessageSize]
+	}
+	containers := l.containers[:0]
+	if resume > 0 {
+		containers = l.containers
+	}
+	jumpStrings := useSIMD
+
+	i := resume
+scanLoop:
+	for ; i < len(buf); i++ {
 		c := buf[i]
 
 		if state&stateInString != 0 {
+			if jumpStrings && stringLength >= longString && state&stateEscaped == 0 && c != '"' && c != '\\' {
+				break // Long string, see below
+			}
+
 			stringLength++
-			if stringLength > l.maxStringLength {
-				return 0, 0, fmt.Errorf("string exceeds maximum length of %d", l.maxStringLength)
+			if stringLength > limits.maxStringLength {
+				return l.limitError(start, start+i, LimitStringLength, limits.maxStringLength)
 			}
 
 			if state&stateEscaped != 0 {
@@ -197,80 +397,624 @@ parseLoop:
 		}
 
 		// Fast path for non-structural characters
-		if !isStructural[c] {
+		if !structural[c] {
+			if state&stateSparse != 0 {
+				break // Sparse message, see below
+			}
 			continue
 		}
 
 		switch c {
 		case '"':
 			state |= stateInString
+		case ',':
+			if len(containers) == 0 {
+				continue
+			}
+			top := containers[len(containers)-1] + 2
+			containers[len(containers)-1] = top
+			// A comma starts element count+1
+			if top&containerObject != 0 {
+				if int(top>>1) >= limits.maxObjectLength {
+					return l.limitError(start, start+i, LimitObjectLength, limits.maxObjectLength)
+				}
+			} else if int(top>>1) >= limits.maxArrayLength {
+				return l.limitError(start, start+i, LimitArrayLength, limits.maxArrayLength)
+			}
 		case '{':
 			objectDepth++
-			if objectDepth > l.maxDepth {
-				return 0, 0, fmt.Errorf("object exceeds maximum depth of %d", l.maxDepth)
+			if objectDepth > limits.maxDepth {
+				return l.limitError(start, start+i, LimitObjectDepth, limits.maxDepth)
+			}
+			if limits.countLengths {
+				containers = append(containers, containerObject)
+			}
+		case '[':
+			arrayDepth++
+			if arrayDepth > limits.maxDepth {
+				return l.limitError(start, start+i, LimitArrayDepth, limits.maxDepth)
+			}
+			if limits.countLengths {
+				containers = append(containers, 0)
+			}
+		case '}':
+			if objectDepth == 0 {
+				return l.fail(start, start+i, fmt.Errorf(
+					"invalid JSON: unmatched closing bracket at position %d",
+					start+i,
+				))
+			}
+			objectDepth--
+			if len(containers) > 0 {
+				containers = containers[:len(containers)-1]
+			}
+			if objectDepth == 0 && arrayDepth == 0 {
+				l.containers = containers
+				return start, start + i, nil
+			}
+			if jumpStrings && sparseBefore(structural, buf, i) {
+				state |= stateSparse
+				l.sparseJumps = sparseRuns
+			}
+		case ']':
+			if arrayDepth == 0 {
+				return l.fail(start, start+i, fmt.Errorf(
+					"invalid JSON: unmatched closing bracket at position %d",
+					start+i,
+				))
+			}
+			arrayDepth--
+			if len(containers) > 0 {
+				containers = containers[:len(containers)-1]
+			}
+			if objectDepth == 0 && arrayDepth == 0 {
+				l.containers = containers
+				return start, start + i, nil
+			}
+			if jumpStrings && sparseBefore(structural, buf, i) {
+				state |= stateSparse
+				l.sparseJumps = sparseRuns
+			}
+		}
+	}
+	if i < len(buf) {
+		// Jump to the next quote or backslash of a long string like hex data, or to the next
+		// structural character of a sparse message like number arrays. The jumps are kept out of
+		// the loop, the calls would make the compiler spill the loop state.
+		set := stringSet
+		if state&stateInString == 0 {
+			set = structuralSet
+			if limits.countLengths {
+				set = structuralCountingSet
+			}
+		}
+		j := i + indexAny(buf[i:], set)
+		if state&stateInString != 0 {
+			if stringLength+(j-i) > limits.maxStringLength {
+				return l.limitError(start, start+i+limits.maxStringLength-stringLength, LimitStringLength, limits.maxStringLength)
+			}
+			stringLength += j - i
+		} else if j-i >= longRun {
+			l.sparseJumps = sparseRuns
+		} else if l.sparseJumps--; l.sparseJumps <= 0 {
+			state &^= stateSparse
+		}
+		i = j
+		goto scanLoop
+	}
+	l.containers = containers
+
+	if truncated {
+		return l.limitError(start, start+len(buf), LimitMessageSize, limits.maxMessageSize)
+	}
+	l.partial = partialScan{
+		active:       true,
+		start:        start - l.cursor,
+		pos:          i,
+		state:        state,
+		objectDepth:  objectDepth,
+		arrayDepth:   arrayDepth,
+		stringLength: stringLength,
+	}
+	return start, -1, nil
+}
+
+// What may follow at the current position of a message in strict mode
+const (
+	expectValue uint8 = 1 << iota
+	expectKey
+	expectColon
+	expectComma
+	expectClose
+)
+
+// nextStrictObject is NextObject in strict mode. It checks the grammar of the message in the same
+// pass, so every byte outside of long strings is looked at and containers are always tracked.
+func (l *JsonStreamLexer) nextStrictObject() (start, end int, err error) {
+	const (
+		stateInString = 1 << iota
+		stateEscaped
+		stateKey // The string is an object key
+	)
+	var state uint8
+
+	var (
+		objectDepth  int
+		arrayDepth   int
+		stringLength int
+		expect       = expectValue
+		hexLeft      int // Digits left of a \u escape in strict mode
+	)
+	limits := &l.limits
+
+	var buf []byte
+	var resume int
+	if p := &l.partial; p.active {
+		// Continue the incomplete message from the last call
+		start = l.cursor + p.start
+		state, objectDepth, arrayDepth, stringLength = p.state, p.objectDepth, p.arrayDepth, p.stringLength
+		expect, hexLeft = p.expect, p.hexLeft
+		resume = p.pos
+		p.active = false
+		goto parseLoop
+	}
+
+	if start, end, err = l.messageStart(); end != 0 || err != nil {
+		return start, end, err
+	}
+
+parseLoop:
+	buf = l.buffer[start:l.length]
+	// Don't look further than the maximum message size
+	truncated := len(buf) > limits.maxMessageSize
+	if truncated {
+		buf = buf[:limits.maxMessageSize]
+	}
+	containers := l.containers[:0]
+	if resume > 0 {
+		containers = l.containers
+	}
+	i := resume
+scanLoop:
+	for ; i < len(buf); i++ {
+		c := buf[i]
+
+		if state&stateInString != 0 {
+			if stringLength >= longString && state&stateEscaped == 0 && !stringSpecialStrict[c] {
+				break // Long string, see below
+			}
+
+			stringLength++
+			if stringLength > limits.maxStringLength {
+				return l.limitError(start, start+i, LimitStringLength, limits.maxStringLength)
+			}
+
+			if state&stateEscaped != 0 {
+				left, msg := checkEscape(c, hexLeft)
+				if msg != "" {
+					return l.syntaxError(start, start+i-escapeLength(hexLeft), msg, true)
+				}
+				if hexLeft = left; hexLeft > 0 {
+					continue
+				}
+				state &^= stateEscaped
+				continue
 			}
+			if !stringSpecialStrict[c] {
+				continue
+			}
+
+			switch {
+			case c == '\\':
+				state |= stateEscaped
+			case c == '"':
+				state &^= stateInString
+				stringLength = 0
+				if state&stateKey != 0 {
+					state &^= stateKey
+					expect = expectColon
+				} else {
+					expect = expectComma | expectClose
+				}
+			default:
+				// Control characters and multibyte UTF-8 sequences
+				size, msg := stringRune(buf[i:])
+				if msg != "" {
+					return l.syntaxError(start, start+i, msg, true)
+				}
+				if size == 0 {
+					stringLength--
+					goto incomplete // The rest of the sequence comes with the next read
+				}
+				i += size - 1
+				stringLength += size - 1
+			}
+			continue
+		}
+
+		if !isSignificant[c] {
+			continue
+		}
 
-			if objectDepth == 1 && arrayDepth == 0 {
-				objectLength++
-				if objectLength > l.maxObjectLength {
-					return 0, 0, fmt.Errorf("object count exceeds maximum of %d", l.maxObjectLength)
+		switch c {
+		case '"':
+			if expect&(expectValue|expectKey) == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
+			}
+			if expect&expectKey != 0 {
+				state |= stateKey
+			}
+			state |= stateInString
+		case ',':
+			if expect&expectComma == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
+			}
+			top := containers[len(containers)-1] + 2
+			containers[len(containers)-1] = top
+			// A comma starts element count+1
+			if top&containerObject != 0 {
+				if int(top>>1) >= limits.maxObjectLength {
+					return l.limitError(start, start+i, LimitObjectLength, limits.maxObjectLength)
+				}
+				expect = expectKey
+			} else {
+				if int(top>>1) >= limits.maxArrayLength {
+					return l.limitError(start, start+i, LimitArrayLength, limits.maxArrayLength)
 				}
+				expect = expectValue
+			}
+		case '{':
+			if expect&expectValue == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
 			}
+			objectDepth++
+			if objectDepth > limits.maxDepth {
+				return l.limitError(start, start+i, LimitObjectDepth, limits.maxDepth)
+			}
+			containers = append(containers, containerObject)
+			expect = expectKey | expectClose
 		case '[':
-			arrayDepth++
-			if arrayDepth > l.maxDepth {
-				return 0, 0, fmt.Errorf("array exceeds maximum depth of %d", l.maxDepth)
+			if expect&expectValue == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
 			}
-			arrayLength++
-			if arrayLength > l.maxArrayLength {
-				return 0, 0, fmt.Errorf("array length exceeds maximum of %d", l.maxArrayLength)
+			arrayDepth++
+			if arrayDepth > limits.maxDepth {
+				return l.limitError(start, start+i, LimitArrayDepth, limits.maxDepth)
 			}
+			containers = append(containers, 0)
+			expect = expectValue | expectClose
 		case '}':
 			if objectDepth == 0 {
-				return 0, 0, fmt.Errorf(
+				return l.fail(start, start+i, fmt.Errorf(
 					"invalid JSON: unmatched closing bracket at position %d",
 					start+i,
-				)
+				))
+			}
+			if containers[len(containers)-1]&containerObject == 0 {
+				// The brackets don't match, recovery can't follow the structure
+				return l.syntaxError(start, start+i, unexpectedChar(c)+" after element", false)
+			}
+			if expect&expectClose == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
 			}
 			objectDepth--
+			containers = containers[:len(containers)-1]
 			if objectDepth == 0 && arrayDepth == 0 {
+				l.containers = containers
 				return start, start + i, nil
 			}
+			expect = expectComma | expectClose
 		case ']':
 			if arrayDepth == 0 {
-				return 0, 0, fmt.Errorf(
+				return l.fail(start, start+i, fmt.Errorf(
 					"invalid JSON: unmatched closing bracket at position %d",
 					start+i,
-				)
+				))
+			}
+			if containers[len(containers)-1]&containerObject != 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c)+" after element", false)
+			}
+			if expect&expectClose == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
 			}
 			arrayDepth--
+			containers = containers[:len(containers)-1]
 			if objectDepth == 0 && arrayDepth == 0 {
+				l.containers = containers
 				return start, start + i, nil
 			}
+			expect = expectComma | expectClose
+		case ':':
+			if expect&expectColon == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
+			}
+			expect = expectValue
+		default:
+			// Numbers and literals
+			if expect&expectValue == 0 {
+				return l.syntaxError(start, start+i, unexpectedChar(c), true)
+			}
+			size, msg := tokenLength(buf[i:])
+			if msg != "" {
+				return l.syntaxError(start, start+i, msg, true)
+			}
+			if size == 0 {
+				goto incomplete // The token may continue with the next read
+			}
+			i += size - 1
+			expect = expectComma | expectClose
+		}
+	}
+	if i < len(buf) {
+		// Jump over the plain bytes of a long string, see NextObject
+		j := i + plainStringLength(buf[i:])
+		if stringLength+(j-i) > limits.maxStringLength {
+			return l.limitError(start, start+i+limits.maxStringLength-stringLength, LimitStringLength, limits.maxStringLength)
 		}
+		stringLength += j - i
+		i = j
+		goto scanLoop
 	}
 
+incomplete:
+	l.containers = containers
+
+	if truncated {
+		return l.limitError(start, start+len(buf), LimitMessageSize, limits.maxMessageSize)
+	}
+	l.partial = partialScan{
+		active:       true,
+		start:        start - l.cursor,
+		pos:          i,
+		state:        state,
+		objectDepth:  objectDepth,
+		arrayDepth:   arrayDepth,
+		stringLength: stringLength,
+		expect:       expect,
+		hexLeft:      hexLeft,
+	}
 	return start, -1, nil
 }
 
-// processBuffer processes complete objects in the buffer and calls the callback for each
-func (l *JsonStreamLexer) processBuffer(cb func([]byte), errCb func(err error)) (complete bool) {
-	for l.length > 0 {
+// messageStart skips whitespace up to the opening bracket of the next message and returns its
+// position. end is -1 if more data is needed, 0 otherwise.
+func (l *JsonStreamLexer) messageStart() (start, end int, err error) {
+	buf := l.buffer[l.cursor:l.length]
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		if c == '{' || c == '[' {
+			return l.cursor + i, 0, nil
+		}
+		if c == '}' || c == ']' {
+			return l.fail(l.cursor+i, l.cursor+i, fmt.Errorf(
+				"invalid JSON: unmatched closing bracket at position %d",
+				l.cursor+i,
+			))
+		}
+		if !isWhitespace[c] {
+			return l.fail(l.cursor+i, l.cursor+i, fmt.Errorf(
+				"invalid JSON: unexpected character '%c' at position %d",
+				c,
+				l.cursor+i,
+			))
+		}
+	}
+	return l.cursor, -1, nil
+}
+
+// fail records the buffer positions of the invalid message and the error, recovery resumes behind it
+func (l *JsonStreamLexer) fail(msgStart, pos int, err error) (start, end int, _ error) {
+	l.failStart = msgStart
+	l.failPos = pos
+	l.skipValue = false
+	return 0, 0, err
+}
+
+// limitError fails with a *LimitError. The message is still well-formed, so recovery can skip exactly it.
+func (l *JsonStreamLexer) limitError(msgStart, pos int, kind LimitKind, max int) (start, end int, _ error) {
+	l.fail(msgStart, pos, nil)
+	l.skipValue = true
+	return 0, 0, &LimitError{Limit: kind, Max: max, Offset: l.offset + int64(pos)}
+}
+
+// syntaxError fails with a *SyntaxError in strict mode. If the brackets are balanced so far,
+// recovery can skip exactly the message by following its structure.
+func (l *JsonStreamLexer) syntaxError(msgStart, pos int, msg string, balanced bool) (start, end int, _ error) {
+	l.fail(msgStart, pos, nil)
+	l.skipValue = balanced
+	return 0, 0, &SyntaxError{Offset: l.offset + int64(pos), msg: msg}
+}
+
+// validate checks the grammar of the framed message at start:end in strict mode, messages
+// without framing are checked by NextObject while they are separated.
+// An invalid message is well-formed enough for recovery to skip exactly it.
+func (l *JsonStreamLexer) validate(start, end int) error {
+	err := l.validator.validate(l.buffer[start : end+1])
+	if err == nil {
+		return nil
+	}
+
+	syntaxErr := err.(*SyntaxError)
+	syntaxErr.Offset += l.offset + int64(start)
+	l.fail(start, end, nil)
+	l.skipValue = true
+	return syntaxErr
+}
+
+// resync skips invalid input after a failed NextObject up to the next message boundary.
+// If no boundary is buffered yet, the lexer keeps skipping after the next read and nil is returned.
+func (l *JsonStreamLexer) resync(err error) error {
+	if !l.skipping {
+		// Whitespace before the invalid input isn't part of the skipped range
+		begin := l.cursor
+		for begin < l.failPos && isWhitespace[l.buffer[begin]] {
+			begin++
+		}
+
+		l.skipping = true
+		l.skipStart = l.offset + int64(begin)
+		l.skipErr = err
+	}
+
+	if l.skipValue {
+		// Skip exactly the offending message by following its structure
+		l.skipScan = scanState{}
+		return l.skipMessage(l.failStart)
+	}
+	return l.skipToBoundary(l.failPos + 1)
+}
+
+// skipMessage discards input from the cursor up to the end of the message scanned from from
+func (l *JsonStreamLexer) skipMessage(from int) error {
+	if end := l.skipScan.scan(l.buffer[from:l.length]); end != -1 {
+		return l.finishSkip(from + end + 1)
+	}
+
+	// The message continues after the next read
+	l.offset += int64(l.length)
+	l.cursor = 0
+	l.length = 0
+	return nil
+}
+
+// skipToBoundary discards input from the cursor up to the next newline or opening brace at or after from
+func (l *JsonStreamLexer) skipToBoundary(from int) error {
+	for i := from; i < l.length; i++ {
+		switch l.buffer[i] {
+		case '\n':
+			return l.finishSkip(i + 1)
+		case '{':
+			return l.finishSkip(i)
+		}
+	}
+
+	// No boundary yet, drop everything we have
+	l.offset += int64(l.length)
+	l.cursor = 0
+	l.length = 0
+	return nil
+}
+
+// finishSkip moves the cursor to pos and returns the skipped range
+func (l *JsonStreamLexer) finishSkip(pos int) *SkippedError {
+	end := l.offset + int64(pos)
+	skipped := &SkippedError{Offset: l.skipStart, Length: end - l.skipStart, Err: l.skipErr}
+	l.skipping = false
+	l.skipValue = false
+	l.skipErr = nil
+	l.cursor = pos
+	l.compact()
+	return skipped
+}
+
+// compact moves unprocessed data to the beginning of the buffer
+func (l *JsonStreamLexer) compact() {
+	if l.cursor > 0 {
+		copy(l.buffer, l.buffer[l.cursor:l.length])
+		l.length -= l.cursor
+		l.offset += int64(l.cursor)
+		l.cursor = 0
+	}
+	l.shrink()
+}
+
+// nextMessage finds the next complete message in the buffer, end is -1 if more data is needed.
+// A *SkippedError means invalid input was skipped and decoding can continue, other errors are final.
+func (l *JsonStreamLexer) nextMessage() (start, end int, err error) {
+	// Continue what the last buffer ended in
+	switch {
+	case l.streaming:
+		err = l.streamMessage()
+	case l.skipping && l.framing != FramingJSON:
+		err = l.skipFrameBytes()
+	case l.skipping && l.skipValue:
+		err = l.skipMessage(l.cursor)
+	case l.skipping:
+		err = l.skipToBoundary(l.cursor)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if l.framing != FramingJSON {
+		return l.nextFramedMessage()
+	}
+
+	for l.cursor < l.length {
 		start, end, err := l.NextObject()
+		if err != nil {
+			if !l.recovery {
+				return 0, 0, err
+			}
+			if err := l.resync(err); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+
+		if end == -1 {
+			if l.passthrough != nil && l.length-start > l.passthroughThreshold {
+				if err := l.startStreaming(start); err != nil {
+					return 0, 0, err
+				}
+				continue
+			}
+			return start, -1, nil // Need more data
+		}
+
+		return start, end, nil
+	}
+	return l.cursor, -1, nil
+}
+
+// nextFramedMessage is nextMessage for framings other than FramingJSON
+func (l *JsonStreamLexer) nextFramedMessage() (start, end int, err error) {
+	if l.cursor == l.length {
+		return l.cursor, -1, nil
+	}
+
+	start, end, err = l.nextFrame()
+	if err == nil && end != -1 && l.policy.Strict {
+		err = l.validate(start, end)
+	}
+	if err != nil {
+		var frameErr *FrameError
+		if !l.recovery || errors.As(err, &frameErr) {
+			return 0, 0, err
+		}
+		if err := l.skipFrame(err); err != nil {
+			return 0, 0, err
+		}
+		return l.cursor, -1, nil // The skipped frame continues after the next read
+	}
+	return start, end, nil
+}
+
+// processBuffer processes complete objects in the buffer and calls the callback for each.
+// It returns ok == false if invalid input was found and recovery is disabled.
+func (l *JsonStreamLexer) processBuffer(cb func([]byte), errCb func(err error)) (complete bool, ok bool) {
+	for {
+		start, end, err := l.nextMessage()
 		if err != nil {
 			errCb(err)
-			// TODO: on parsing errors we need to try to skip the invalid part and continue parsing
-			return true // Exit on parsing errors
+			var skipped *SkippedError
+			if !errors.As(err, &skipped) {
+				return true, false
+			}
+			continue
 		}
 		if end == -1 {
-			return false // Need more data
+			return false, true // Need more data
 		}
 
 		if l.asyncCallbacks {
-			// TODO: check if this is smart
-			data := make([]byte, end-start+1)
+			// The copy goes back to the pool once the callback returns
+			data := l.getBuffer(end - start + 1)
 			copy(data, l.buffer[start:end+1])
-			go cb(data)
+			go func() {
+				cb(data)
+				l.putBuffer(data)
+			}()
 		} else {
 			cb(l.buffer[start : end+1])
 		}
@@ -279,13 +1023,8 @@ func (l *JsonStreamLexer) processBuffer(cb func([]byte), errCb func(err error))
 		l.cursor = end + 1
 
 		// Compact buffer after each object
-		if l.cursor > 0 {
-			copy(l.buffer, l.buffer[l.cursor:l.length])
-			l.length -= l.cursor
-			l.cursor = 0
-		}
+		l.compact()
 	}
-	return true
 }
 
 // The following methods are used for debugging
@@ -3,9 +3,13 @@ package json
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNextObject(t *testing.T) {
@@ -80,7 +84,7 @@ func TestNextObjectErrors(t *testing.T) {
 	testCases := []struct {
 		name     string
 		input    string
-		maxDepth uint8
+		maxDepth int
 		wantErr  string
 	}{
 		{
@@ -118,8 +122,9 @@ func TestNextObjectErrors(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			reader := bytes.NewReader([]byte(tc.input))
-			lexer := NewJsonStreamLexer(reader, 16384, 4096, false)
-			lexer.maxDepth = tc.maxDepth
+			policy := DefaultLexerPolicy()
+			policy.MaxDepth = tc.maxDepth
+			lexer := NewJsonStreamLexerWithPolicy(reader, 16384, 4096, false, policy)
 			_, _ = lexer.Read()
 
 			_, _, err := lexer.NextObject()
@@ -192,55 +197,172 @@ func TestDecodeAllBig(t *testing.T) {
 	})
 }
 
-func BenchmarkDecodeAll(b *testing.B) {
-	benchmarks := []struct {
-		name      string
-		generator func() string
-		size      int
-	}{
-		{
-			name: "small objects",
-			generator: func() string {
-				return `{"id": 1, "name": "test", "value": 123.45}`
-			},
-			size: 700,
-		},
-		{
-			name: "medium array",
-			generator: func() string {
-				var b strings.Builder
-				b.WriteString("[")
-				for i := 0; i < 1000; i++ {
-					if i > 0 {
-						b.WriteString(",")
+func TestDecodeAllSparse(t *testing.T) {
+	// Long runs without structural characters are jumped over, also across reads
+	spaces := strings.Repeat(" ", 40)
+	expected := []string{
+		`[` + strings.Repeat(`1234567890123456789,`, 30) + `0]`,
+		`{"a":[` + spaces + `1` + spaces + `],"b":{` + spaces + `"c"` + spaces + `:` + spaces + `{}}}`,
+		`[[` + strings.Repeat(`12345678901234567890 `, 10) + `],[` + strings.Repeat("9", 100) + `],"x",[]]`,
+	}
+	input := strings.Join(expected, "\n")
+
+	policies := map[string]LexerPolicy{"default": DefaultLexerPolicy(), "uncounted": {MaxDepth: 64}}
+	for name, policy := range policies {
+		for _, maxRead := range []int{7, 4096} {
+			t.Run(fmt.Sprintf("%s/%d", name, maxRead), func(t *testing.T) {
+				lexer := NewJsonStreamLexerWithPolicy(strings.NewReader(input), 64, maxRead, false, policy)
+				var got []string
+				lexer.DecodeAll(context.Background(), func(b []byte) {
+					got = append(got, string(b))
+				}, func(err error) {
+					t.Fatalf("unexpected error: %v", err)
+				})
+				if len(got) != len(expected) {
+					t.Fatalf("expected %d objects, got %d", len(expected), len(got))
+				}
+				for i := range expected {
+					if got[i] != expected[i] {
+						t.Errorf("object %d: expected %q, got %q", i+1, expected[i], got[i])
 					}
-					fmt.Fprintf(&b, `{"id":%d,"value":"test-%d"}`, i, i)
 				}
-				b.WriteString("]")
-				return b.String()
-			},
-			size: 1,
+			})
+		}
+	}
+
+	// Brackets after a jump are still checked
+	lexer := NewJsonStreamLexerWithPolicy(strings.NewReader(`[[`+spaces+`1]`+spaces+`]]`), 4096, 4096, false, LexerPolicy{MaxDepth: 64})
+	var lexErr error
+	lexer.DecodeAll(context.Background(), func([]byte) {}, func(err error) { lexErr = err })
+	if lexErr == nil || !strings.Contains(lexErr.Error(), "unmatched closing bracket") {
+		t.Fatalf("expected unmatched bracket error, got %v", lexErr)
+	}
+}
+
+var decodeBenchmarks = []struct {
+	name      string
+	generator func() string
+	size      int
+}{
+	{
+		name: "small objects",
+		generator: func() string {
+			return `{"id": 1, "name": "test", "value": 123.45}`
 		},
-		{
-			name: "large nested objects",
-			generator: func() string {
-				var b strings.Builder
-				b.WriteString(`{"root":{"items":[`)
-				for i := 0; i < 500; i++ {
-					if i > 0 {
+		size: 700,
+	},
+	{
+		name: "medium array",
+		generator: func() string {
+			var b strings.Builder
+			b.WriteString("[")
+			for i := 0; i < 1000; i++ {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				fmt.Fprintf(&b, `{"id":%d,"value":"test-%d"}`, i, i)
+			}
+			b.WriteString("]")
+			return b.String()
+		},
+		size: 1,
+	},
+	{
+		name: "hex strings",
+		generator: func() string {
+			// Shaped like a block with transaction input data
+			var b strings.Builder
+			b.WriteString(`{"jsonrpc":"2.0","id":1,"result":{"transactions":[`)
+			for i := 0; i < 20; i++ {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				fmt.Fprintf(&b, `{"hash":"0x%064x","input":"0x%s"}`, i, strings.Repeat("a9059cbb", 256))
+			}
+			b.WriteString(`]}}`)
+			return b.String()
+		},
+		size: 1,
+	},
+	{
+		name: "large nested objects",
+		generator: func() string {
+			var b strings.Builder
+			b.WriteString(`{"root":{"items":[`)
+			for i := 0; i < 500; i++ {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				fmt.Fprintf(&b, `{"id":%d,"data":{"name":"item-%d","values":[%d,%d,%d]}}`,
+					i, i, i*2, i*3, i*4)
+			}
+			b.WriteString(`]}}`)
+			return b.String()
+		},
+		size: 1,
+	},
+	{
+		name: "pretty printed",
+		generator: func() string {
+			// Indented like the output of a node with pretty printing enabled
+			var b strings.Builder
+			b.WriteString("{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": {\n    \"transactions\": [\n")
+			for i := 0; i < 200; i++ {
+				if i > 0 {
+					b.WriteString(",\n")
+				}
+				fmt.Fprintf(&b, "      {\n        \"blockNumber\": %d,\n        \"gas\": %d,\n        \"nonce\": %d,\n"+
+					"        \"logs\": [\n          {\n            \"logIndex\": %d,\n            \"removed\": false\n          }\n        ]\n      }",
+					19000000+i, 21000*i, i, i)
+			}
+			b.WriteString("\n    ]\n  }\n}")
+			return b.String()
+		},
+		size: 1,
+	},
+	{
+		name: "number arrays",
+		generator: func() string {
+			var b strings.Builder
+			b.WriteString(`{"jsonrpc":"2.0","id":1,"result":[`)
+			for i := 0; i < 100; i++ {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				b.WriteString("[")
+				for j := 0; j < 50; j++ {
+					if j > 0 {
 						b.WriteString(",")
 					}
-					fmt.Fprintf(&b, `{"id":%d,"data":{"name":"item-%d","values":[%d,%d,%d]}}`,
-						i, i, i*2, i*3, i*4)
+					fmt.Fprintf(&b, "%d", 1000000000+i*j)
 				}
-				b.WriteString(`]}}`)
-				return b.String()
-			},
-			size: 1,
+				b.WriteString("]")
+			}
+			b.WriteString(`]}`)
+			return b.String()
 		},
-	}
+		size: 1,
+	},
+}
 
-	for _, bm := range benchmarks {
+func BenchmarkDecodeAll(b *testing.B) {
+	benchmarkDecodeAll(b, DefaultLexerPolicy())
+}
+
+// BenchmarkDecodeAllUncounted uses a policy without length limits like the upstream side of the proxy,
+// commas don't have to be looked at then
+func BenchmarkDecodeAllUncounted(b *testing.B) {
+	benchmarkDecodeAll(b, LexerPolicy{MaxDepth: 64})
+}
+
+func BenchmarkDecodeAllStrict(b *testing.B) {
+	policy := DefaultLexerPolicy()
+	policy.Strict = true
+	benchmarkDecodeAll(b, policy)
+}
+
+func benchmarkDecodeAll(b *testing.B, policy LexerPolicy) {
+	for _, bm := range decodeBenchmarks {
 		b.Run(bm.name, func(b *testing.B) {
 			// Generate input data once before the benchmark
 			var fullInput strings.Builder
@@ -262,7 +384,7 @@ func BenchmarkDecodeAll(b *testing.B) {
 				reader := bytes.NewReader([]byte(input))
 				b.StartTimer()
 
-				lexer := NewJsonStreamLexer(reader, 32768, 16384, false)
+				lexer := NewJsonStreamLexerWithPolicy(reader, 32768, 16384, false, policy)
 
 				var totalBytes int
 				lexer.DecodeAll(context.Background(), func(data []byte) {
@@ -278,3 +400,650 @@ func BenchmarkDecodeAll(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkDecodeAllSmallReads decodes a multi-megabyte response that arrives in small reads
+func BenchmarkDecodeAllSmallReads(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString(`{"jsonrpc":"2.0","id":1,"result":[`)
+	for i := 0; sb.Len() < 4<<20; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `{"pc":%d,"op":"PUSH1","gas":%d,"stack":["0x%x","0x80"]}`, i, 1000000-i, i)
+	}
+	sb.WriteString(`]}`)
+	input := []byte(sb.String())
+
+	for _, maxRead := range []int{4096, 65536} {
+		b.Run(fmt.Sprintf("read %d", maxRead), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader(input), 32768, maxRead, false, LexerPolicy{MaxDepth: 64})
+
+				var total int
+				lexer.DecodeAll(context.Background(), func(data []byte) {
+					total += len(data)
+				}, func(err error) {
+					b.Fatalf("unexpected error: %v", err)
+				})
+				if total != len(input) {
+					b.Fatalf("expected %d bytes, got %d", len(input), total)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFields(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		msg  string
+		keys []string
+	}{
+		{
+			name: "request",
+			msg:  `{"jsonrpc":"2.0","method":"eth_getBalance","params":["0x1234567890123456789012345678901234567890","latest"],"id":1}`,
+			keys: []string{"method", "id", "params"},
+		},
+		{
+			name: "response id after large result",
+			msg: func() string {
+				var b strings.Builder
+				b.WriteString(`{"jsonrpc":"2.0","result":{"transactions":[`)
+				for i := 0; i < 200; i++ {
+					if i > 0 {
+						b.WriteString(",")
+					}
+					fmt.Fprintf(&b, `{"hash":"0x%064x","input":"0x%0128x","logs":[{"data":"\"}\""}]}`, i, i)
+				}
+				b.WriteString(`]},"id":42}`)
+				return b.String()
+			}(),
+			keys: []string{"id"},
+		},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			msg := []byte(bm.msg)
+			values := make([][]byte, len(bm.keys))
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := Fields(msg, bm.keys, values); err != nil {
+					b.Fatalf("unexpected error: %v", err)
+				}
+				if values[0] == nil {
+					b.Fatal("field not found")
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeAllRecovery(t *testing.T) {
+	input := "garbage{\"a\":1}\n}{\"b\":2}\n{\"c\":]}\n{\"d\":4}"
+	reader := bytes.NewReader([]byte(input))
+	lexer := NewJsonStreamLexer(reader, 16384, 4096, false)
+	lexer.SetRecovery(true)
+
+	var objects []string
+	var skipped []*SkippedError
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		objects = append(objects, string(b))
+	}, func(err error) {
+		skippedErr, ok := err.(*SkippedError)
+		if !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		skipped = append(skipped, skippedErr)
+	})
+
+	expectedObjects := []string{`{"a":1}`, `{"b":2}`, `{"d":4}`}
+	if strings.Join(objects, " ") != strings.Join(expectedObjects, " ") {
+		t.Errorf("expected objects %q, got %q", expectedObjects, objects)
+	}
+
+	expectedRanges := [][2]int64{{0, 7}, {15, 1}, {24, 8}}
+	if len(skipped) != len(expectedRanges) {
+		t.Fatalf("expected %d skipped ranges, got %d", len(expectedRanges), len(skipped))
+	}
+	for i, r := range expectedRanges {
+		if skipped[i].Offset != r[0] || skipped[i].Length != r[1] {
+			t.Errorf("range %d: expected offset %d length %d, got offset %d length %d",
+				i, r[0], r[1], skipped[i].Offset, skipped[i].Length)
+		}
+		if skipped[i].Err == nil {
+			t.Errorf("range %d: missing cause", i)
+		}
+	}
+}
+
+func TestDecodeAllRecoveryAcrossReads(t *testing.T) {
+	// The garbage is longer than a single read, skipping has to continue after the next read
+	garbage := strings.Repeat("x", 100)
+	input := garbage + `{"a":1}`
+	lexer := NewJsonStreamLexer(bytes.NewReader([]byte(input)), 16, 16, false)
+	lexer.SetRecovery(true)
+
+	var objects []string
+	var skipped []*SkippedError
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		objects = append(objects, string(b))
+	}, func(err error) {
+		skipped = append(skipped, err.(*SkippedError))
+	})
+
+	if len(objects) != 1 || objects[0] != `{"a":1}` {
+		t.Errorf("unexpected objects %q", objects)
+	}
+	if len(skipped) != 1 || skipped[0].Offset != 0 || skipped[0].Length != int64(len(garbage)) {
+		t.Errorf("unexpected skipped ranges %+v", skipped)
+	}
+}
+
+func TestDecodeAllStopsOnError(t *testing.T) {
+	lexer := NewJsonStreamLexer(bytes.NewReader([]byte(`}{"a":1}`)), 16384, 4096, false)
+
+	errCount := 0
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		t.Errorf("unexpected object %q", b)
+	}, func(err error) {
+		errCount++
+	})
+
+	if errCount != 1 {
+		t.Errorf("expected 1 error, got %d", errCount)
+	}
+}
+
+func TestLexerPolicyLimits(t *testing.T) {
+	testCases := []struct {
+		name      string
+		input     string
+		policy    LexerPolicy
+		wantLimit LimitKind
+		wantErr   string
+	}{
+		{
+			name:      "string length",
+			input:     `{"key": "too long"}`,
+			policy:    LexerPolicy{MaxStringLength: 5},
+			wantLimit: LimitStringLength,
+			wantErr:   "string exceeds maximum length of 5",
+		},
+		{
+			name:      "nested array length",
+			input:     `{"a": [1, 2], "b": [[1, 2], [1, 2, 3, 4]]}`,
+			policy:    LexerPolicy{MaxArrayLength: 3},
+			wantLimit: LimitArrayLength,
+			wantErr:   "array length exceeds maximum of 3",
+		},
+		{
+			name:      "nested object length",
+			input:     `[{"a": 1}, {"a": 1, "b": [1, 2, 3], "c": 3}]`,
+			policy:    LexerPolicy{MaxObjectLength: 2},
+			wantLimit: LimitObjectLength,
+			wantErr:   "object length exceeds maximum of 2",
+		},
+		{
+			name:      "message size",
+			input:     `{"key": "value", "other": "value"}`,
+			policy:    LexerPolicy{MaxMessageSize: 16},
+			wantLimit: LimitMessageSize,
+			wantErr:   "message exceeds maximum size of 16 bytes",
+		},
+		{
+			name:      "incomplete message size",
+			input:     `{"key": "value", "other": "val`,
+			policy:    LexerPolicy{MaxMessageSize: 16},
+			wantLimit: LimitMessageSize,
+			wantErr:   "message exceeds maximum size of 16 bytes",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bytes.NewReader([]byte(tc.input))
+			lexer := NewJsonStreamLexerWithPolicy(reader, 16384, 4096, false, tc.policy)
+			_, _ = lexer.Read()
+
+			_, _, err := lexer.NextObject()
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected a *LimitError, got %v", err)
+			}
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("expected error to match ErrLimitExceeded")
+			}
+			if limitErr.Limit != tc.wantLimit {
+				t.Errorf("expected limit %s, got %s", tc.wantLimit, limitErr.Limit)
+			}
+			if err.Error() != tc.wantErr {
+				t.Errorf("expected error %q, got %q", tc.wantErr, err.Error())
+			}
+		})
+	}
+
+	// Everything within the limits passes
+	input := `{"a": [1, 2, 3], "b": {"c": [1, 2, 3]}, "d": "12345"}`
+	lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader([]byte(input)), 16384, 4096, false, LexerPolicy{
+		MaxDepth:        2,
+		MaxStringLength: 6,
+		MaxArrayLength:  3,
+		MaxObjectLength: 3,
+		MaxMessageSize:  len(input),
+	})
+	_, _ = lexer.Read()
+	if _, end, err := lexer.NextObject(); err != nil || end != len(input)-1 {
+		t.Errorf("expected complete object, got end %d and error %v", end, err)
+	}
+}
+
+func TestDecodeAllRecoveryLimit(t *testing.T) {
+	// The nested objects of a message exceeding the limit must not be treated as messages
+	tooDeep := `{"a": {"b": {"c": {"d": 1}}}}`
+	input := tooDeep + "\n" + `{"ok": 1}`
+	lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader([]byte(input)), 16, 8, false, LexerPolicy{MaxDepth: 2})
+	lexer.SetRecovery(true)
+
+	var objects []string
+	var skipped []*SkippedError
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		objects = append(objects, string(b))
+	}, func(err error) {
+		skipped = append(skipped, err.(*SkippedError))
+	})
+
+	if len(objects) != 1 || objects[0] != `{"ok": 1}` {
+		t.Errorf("unexpected objects %q", objects)
+	}
+	if len(skipped) != 1 || skipped[0].Offset != 0 || skipped[0].Length != int64(len(tooDeep)) {
+		t.Fatalf("unexpected skipped ranges %+v", skipped)
+	}
+	if !errors.Is(skipped[0], ErrLimitExceeded) {
+		t.Errorf("expected skip caused by a limit, got %v", skipped[0].Err)
+	}
+}
+
+// recordingPassthrough collects streamed messages
+type recordingPassthrough struct {
+	current  bytes.Buffer
+	messages []string
+	errs     []error
+	chunks   int
+}
+
+func (r *recordingPassthrough) Write(p []byte) (int, error) {
+	r.chunks++
+	return r.current.Write(p)
+}
+
+func (r *recordingPassthrough) EndMessage(err error) error {
+	r.messages = append(r.messages, r.current.String())
+	r.errs = append(r.errs, err)
+	r.current.Reset()
+	return nil
+}
+
+func TestDecodeAllPassthrough(t *testing.T) {
+	big := `{"id":1,"result":["` + strings.Repeat("x", 10000) + `","}]"]}`
+	input := `{"id":0}` + "\n" + big + "\n" + `{"id":2}`
+
+	const threshold = 256
+	lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader([]byte(input)), 64, 64, false, LexerPolicy{})
+	w := &recordingPassthrough{}
+	lexer.SetPassthrough(w, threshold)
+
+	var objects []string
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		objects = append(objects, string(b))
+	}, func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+
+	if len(objects) != 2 || objects[0] != `{"id":0}` || objects[1] != `{"id":2}` {
+		t.Errorf("unexpected objects %q", objects)
+	}
+	if len(w.messages) != 1 || w.messages[0] != big || w.errs[0] != nil {
+		t.Fatalf("unexpected streamed messages %d %v", len(w.messages), w.errs)
+	}
+	if w.chunks < 2 {
+		t.Errorf("expected the message to be streamed in chunks, got %d", w.chunks)
+	}
+	if c := cap(lexer.Buffer()); c > 2*threshold {
+		t.Errorf("buffer grew to %d bytes", c)
+	}
+}
+
+func TestDecodeAllPassthroughTruncated(t *testing.T) {
+	input := `{"result":"` + strings.Repeat("x", 1000)
+	lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader([]byte(input)), 64, 64, false, LexerPolicy{})
+	w := &recordingPassthrough{}
+	lexer.SetPassthrough(w, 100)
+
+	var errs []error
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		t.Errorf("unexpected object %q", b)
+	}, func(err error) {
+		errs = append(errs, err)
+	})
+
+	if len(w.messages) != 1 || w.messages[0] != input || w.errs[0] != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected streamed messages %q %v", w.messages, w.errs)
+	}
+	if len(errs) != 1 || errs[0] != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestNext(t *testing.T) {
+	input := `{"a":1} [1,2]` + "\n" + `{"b":"` + strings.Repeat("x", 100) + `"}` + "\n"
+	lexer := NewJsonStreamLexer(bytes.NewReader([]byte(input)), 16, 16, false)
+	ctx := context.Background()
+
+	expected := []string{`{"a":1}`, `[1,2]`, `{"b":"` + strings.Repeat("x", 100) + `"}`}
+	for _, e := range expected {
+		msg, err := lexer.Next(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(msg) != e {
+			t.Errorf("expected %q, got %q", e, msg)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := lexer.Next(ctx); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	}
+}
+
+func TestNextErrors(t *testing.T) {
+	ctx := context.Background()
+
+	lexer := NewJsonStreamLexer(strings.NewReader(`{"a":1} {"b":`), 64, 64, false)
+	if msg, err := lexer.Next(ctx); err != nil || string(msg) != `{"a":1}` {
+		t.Fatalf("unexpected result %q %v", msg, err)
+	}
+	if _, err := lexer.Next(ctx); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// Without recovery invalid input is final
+	lexer = NewJsonStreamLexer(strings.NewReader(`x {"a":1}`), 64, 64, false)
+	_, err := lexer.Next(ctx)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err2 := lexer.Next(ctx); err2 != err {
+		t.Errorf("expected the same error again, got %v", err2)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	lexer = NewJsonStreamLexer(strings.NewReader(`{"a":1}`), 64, 64, false)
+	if _, err := lexer.Next(cancelled); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	input := `{"a":1}` + "\ngarbage\n" + `{"b":2} {"c":3}`
+	lexer := NewJsonStreamLexer(strings.NewReader(input), 64, 64, false)
+	lexer.SetRecovery(true)
+
+	var objects []string
+	var skipped []*SkippedError
+	for msg, err := range lexer.Messages(context.Background()) {
+		if err != nil {
+			var s *SkippedError
+			if !errors.As(err, &s) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			skipped = append(skipped, s)
+			continue
+		}
+		objects = append(objects, string(msg))
+		if len(objects) == 2 {
+			break
+		}
+	}
+
+	if len(objects) != 2 || objects[0] != `{"a":1}` || objects[1] != `{"b":2}` {
+		t.Errorf("unexpected objects %q", objects)
+	}
+	if len(skipped) != 1 || skipped[0].Offset != 8 || skipped[0].Length != 8 {
+		t.Errorf("unexpected skipped ranges %+v", skipped)
+	}
+
+	// The iteration can be resumed after a break
+	var rest []string
+	for msg, err := range lexer.Messages(context.Background()) {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rest = append(rest, string(msg))
+	}
+	if len(rest) != 1 || rest[0] != `{"c":3}` {
+		t.Errorf("unexpected objects %q", rest)
+	}
+}
+
+func TestDecodeAllCancel(t *testing.T) {
+	cause := errors.New("shutting down")
+
+	// net.Conn readers are interrupted with a read deadline, other readers are closed
+	client, server := net.Pipe()
+	defer server.Close()
+	pipeReader, pipeWriter := io.Pipe()
+	defer pipeWriter.Close()
+
+	for name, reader := range map[string]io.Reader{"deadline": client, "close": pipeReader} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			lexer := NewJsonStreamLexer(reader, 64, 64, false)
+
+			done := make(chan error, 1)
+			go lexer.DecodeAll(ctx, func(b []byte) {
+				t.Errorf("unexpected object %q", b)
+			}, func(err error) {
+				done <- err
+			})
+
+			time.Sleep(10 * time.Millisecond)
+			cancel(cause)
+			select {
+			case err := <-done:
+				if err != cause {
+					t.Errorf("expected the cancel cause, got %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("DecodeAll didn't return after cancel")
+			}
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := NewBufferPool(1024, 1<<20)
+
+	buf := pool.Get(1000)
+	if len(buf) != 1000 || cap(buf) != 1024 {
+		t.Errorf("unexpected buffer len %d cap %d", len(buf), cap(buf))
+	}
+	big := pool.Get(5000)
+	if cap(big) != 8192 {
+		t.Errorf("expected a buffer of the 8k class, got cap %d", cap(big))
+	}
+	huge := pool.Get(2 << 20)
+	if len(huge) != 2<<20 {
+		t.Errorf("unexpected huge buffer len %d", len(huge))
+	}
+
+	stats := pool.Stats()
+	if stats.InUse != 1024+8192+2<<20 || stats.HighWater != stats.InUse || stats.Allocs != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	pool.Put(buf)
+	pool.Put(big)
+	pool.Put(huge)
+	stats = pool.Stats()
+	if stats.InUse != 0 || stats.HighWater != 1024+8192+2<<20 || stats.Puts != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLexerBufferPool(t *testing.T) {
+	pool := NewBufferPool(1024, 1<<20)
+	big := `{"a":"` + strings.Repeat("x", 100000) + `"}`
+	input := big + `{"b":1}`
+	lexer := NewJsonStreamLexer(strings.NewReader(input), 1024, 1024, false)
+	lexer.SetBufferPool(pool)
+
+	var objects []string
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		objects = append(objects, string(b))
+	}, func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+
+	if len(objects) != 2 || objects[0] != big || objects[1] != `{"b":1}` {
+		t.Fatalf("unexpected objects %d", len(objects))
+	}
+	// The buffer shrinks back after the large message
+	if c := cap(lexer.Buffer()); c > 8192 {
+		t.Errorf("buffer wasn't shrunk, cap %d", c)
+	}
+	if high := pool.Stats().HighWater; high < int64(len(big)) {
+		t.Errorf("high water mark %d doesn't cover the large message", high)
+	}
+
+	lexer.Release()
+	if stats := pool.Stats(); stats.InUse != 0 || stats.Gets != stats.Puts {
+		t.Errorf("buffers weren't returned %+v", stats)
+	}
+}
+
+// FuzzDecodeAllReadSizes checks that resuming incomplete messages gives the same results as
+// scanning them in one piece
+func FuzzDecodeAllReadSizes(f *testing.F) {
+	f.Add([]byte(`{"a":"`+strings.Repeat("x", 100)+`\"}"} [1,2,{"b":[]}]`), 3)
+	f.Add([]byte(`{"a":[1,2,3,4,5,6]} {"b":{"c":{"d":{"e":1}}}} x {"f":"\\"}`), 1)
+	f.Fuzz(func(t *testing.T, input []byte, maxRead int) {
+		if maxRead <= 0 || maxRead > len(input) {
+			return
+		}
+		policy := LexerPolicy{MaxDepth: 3, MaxStringLength: 50, MaxArrayLength: 5, MaxObjectLength: 5, MaxMessageSize: 200}
+
+		decode := func(maxRead int) string {
+			var out strings.Builder
+			lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader(input), 16, maxRead, false, policy)
+			lexer.SetRecovery(true)
+			lexer.DecodeAll(context.Background(), func(b []byte) {
+				fmt.Fprintf(&out, "msg %q\n", b)
+			}, func(err error) {
+				// Error texts contain buffer positions, only compare stream offsets
+				var skipped *SkippedError
+				var limitErr *LimitError
+				if errors.As(err, &skipped) {
+					fmt.Fprintf(&out, "skipped %d %d", skipped.Offset, skipped.Length)
+				}
+				if errors.As(err, &limitErr) {
+					fmt.Fprintf(&out, " limit %v %d", limitErr.Limit, limitErr.Offset)
+				}
+				out.WriteString("\n")
+			})
+			return out.String()
+		}
+
+		want := decode(len(input))
+		if got := decode(maxRead); got != want {
+			t.Fatalf("reads of %d bytes differ\ngot:\n%s\nwant:\n%s", maxRead, got, want)
+		}
+	})
+}
+
+func TestDecodeAllStrict(t *testing.T) {
+	input := `{"a":1} {"a": tru} {,,,}` + "\n" + `{"b":[1,2]} {"c":"` + "\x01" + `"}`
+	policy := DefaultLexerPolicy()
+	policy.Strict = true
+	lexer := NewJsonStreamLexerWithPolicy(strings.NewReader(input), 16, 16, false, policy)
+	lexer.SetRecovery(true)
+
+	var objects []string
+	var skipped []*SkippedError
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		objects = append(objects, string(b))
+	}, func(err error) {
+		var s *SkippedError
+		if !errors.As(err, &s) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		skipped = append(skipped, s)
+	})
+
+	if len(objects) != 2 || objects[0] != `{"a":1}` || objects[1] != `{"b":[1,2]}` {
+		t.Errorf("unexpected objects %q", objects)
+	}
+	expected := []struct{ offset, length, errOffset int64 }{
+		{8, 10, 14},
+		{19, 5, 20},
+		{37, 9, 43},
+	}
+	if len(skipped) != len(expected) {
+		t.Fatalf("expected %d skipped messages, got %+v", len(expected), skipped)
+	}
+	for i, e := range expected {
+		var syntaxErr *SyntaxError
+		if !errors.As(skipped[i].Err, &syntaxErr) {
+			t.Errorf("expected a *SyntaxError, got %v", skipped[i].Err)
+			continue
+		}
+		if skipped[i].Offset != e.offset || skipped[i].Length != e.length || syntaxErr.Offset != e.errOffset {
+			t.Errorf("unexpected skip %d: %+v %v", i, skipped[i], syntaxErr)
+		}
+	}
+}
+
+// FuzzDecodeAllStrict checks that strict mode only lets valid messages through, and that
+// resuming in the middle of a token or escape doesn't change the result
+func FuzzDecodeAllStrict(f *testing.F) {
+	f.Add([]byte(`{"a":[1,-2.5e3,true,null],"b":"é\n`+strings.Repeat("x", 40)+`"} {"a":01}`), 2)
+	f.Add([]byte(`[{"a":"é"},{"b":"\ud83d"}] {"a" 1} [1,]`), 1)
+	f.Fuzz(func(t *testing.T, input []byte, maxRead int) {
+		if maxRead <= 0 || maxRead > len(input) {
+			return
+		}
+		policy := DefaultLexerPolicy()
+		policy.Strict = true
+
+		decode := func(maxRead int) string {
+			var out strings.Builder
+			lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader(input), 16, maxRead, false, policy)
+			lexer.SetRecovery(true)
+			lexer.DecodeAll(context.Background(), func(b []byte) {
+				if err := Validate(b); err != nil {
+					t.Fatalf("invalid message %q passed: %v", b, err)
+				}
+				fmt.Fprintf(&out, "msg %q\n", b)
+			}, func(err error) {
+				var skipped *SkippedError
+				if errors.As(err, &skipped) {
+					fmt.Fprintf(&out, "skipped %d %d", skipped.Offset, skipped.Length)
+				}
+				out.WriteString("\n")
+			})
+			return out.String()
+		}
+
+		want := decode(len(input))
+		if got := decode(maxRead); got != want {
+			t.Fatalf("reads of %d bytes differ\ngot:\n%s\nwant:\n%s", maxRead, got, want)
+		}
+	})
+}
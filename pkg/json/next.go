@@ -0,0 +1,108 @@
+package json
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+)
+
+// Next blocks until the next complete message is read and returns it.
+//
+// The returned slice points into the lexer buffer and is only valid until the next call to Next,
+// copy it to keep it longer. In recovery mode skipped input is returned as a *SkippedError and
+// Next can be called again. Other errors are final and returned by every following call,
+// io.EOF marks the regular end of the stream and io.ErrUnexpectedEOF a stream that ended
+// inside a message. If ctx is done before a message is complete, Next returns context.Cause(ctx).
+// That error is final if a blocked read had to be interrupted, see DecodeAll.
+//
+// Next and Messages must not be mixed with DecodeAll on the same lexer.
+func (l *JsonStreamLexer) Next(ctx context.Context) ([]byte, error) {
+	for {
+		if l.pullErr != nil {
+			return nil, l.pullErr
+		}
+
+		// Release the message returned by the last call
+		l.compact()
+
+		if l.length > 0 {
+			start, end, err := l.nextMessage()
+			if err != nil {
+				var skipped *SkippedError
+				if !errors.As(err, &skipped) {
+					l.pullErr = err
+				}
+				return nil, err
+			}
+			if end != -1 {
+				l.cursor = end + 1
+				return l.buffer[start : end+1], nil
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+
+		stop := context.AfterFunc(ctx, l.interrupt)
+		_, err := l.Read()
+		if !stop() {
+			// The reader was interrupted and can't be used anymore
+			l.abortStreaming(context.Cause(ctx))
+			l.pullErr = context.Cause(ctx)
+			return nil, l.pullErr
+		}
+		if err == io.EOF {
+			return nil, l.endOfInput()
+		}
+		if err != nil {
+			l.abortStreaming(err)
+			l.pullErr = err
+			return nil, err
+		}
+	}
+}
+
+// endOfInput sets the final error once the reader is exhausted and returns what Next reports
+func (l *JsonStreamLexer) endOfInput() error {
+	l.pullErr = io.EOF
+
+	switch {
+	case l.skipping:
+		return l.finishSkip(l.length)
+	case l.streaming:
+		l.abortStreaming(io.ErrUnexpectedEOF)
+		l.pullErr = io.ErrUnexpectedEOF
+	default:
+		for _, c := range l.buffer[l.cursor:l.length] {
+			if !isWhitespace[c] {
+				l.pullErr = io.ErrUnexpectedEOF
+				break
+			}
+		}
+	}
+	return l.pullErr
+}
+
+// Messages returns an iterator over the messages of the stream, see Next.
+// The iteration ends at io.EOF and after yielding a final error, skipped input is yielded
+// as *SkippedError and the iteration continues. Each message is only valid until the next iteration.
+func (l *JsonStreamLexer) Messages(ctx context.Context) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		for {
+			msg, err := l.Next(ctx)
+			if err == io.EOF {
+				return
+			}
+			if !yield(msg, err) {
+				return
+			}
+
+			var skipped *SkippedError
+			if err != nil && !errors.As(err, &skipped) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package json
+
+import "io"
+
+// PassthroughWriter receives messages that are too big to buffer, see SetPassthrough
+type PassthroughWriter interface {
+	// Write is called with consecutive chunks of the message
+	io.Writer
+	// EndMessage is called after the last chunk of a message with a nil error, or with the
+	// reason the message was cut off, e.g. io.ErrUnexpectedEOF or the error returned by Write
+	EndMessage(err error) error
+}
+
+// SetPassthrough enables streaming of messages bigger than threshold bytes to w. Once an incomplete
+// message exceeds the threshold, everything buffered so far is written to w and the rest of the
+// message is forwarded chunk by chunk as it is read, so the buffer doesn't grow past the threshold.
+// Streamed messages are not passed to the DecodeAll callback and only their structure is tracked,
+// the limits of the policy are enforced for the first threshold bytes only.
+// A nil writer or a threshold <= 0 disables streaming.
+func (l *JsonStreamLexer) SetPassthrough(w PassthroughWriter, threshold int) {
+	if threshold <= 0 {
+		w = nil
+	}
+	l.passthrough = w
+	l.passthroughThreshold = threshold
+}
+
+// startStreaming switches to streaming mode for the incomplete message at start
+func (l *JsonStreamLexer) startStreaming(start int) error {
+	l.streaming = true
+	l.streamScan = scanState{}
+	l.partial = partialScan{}
+	l.cursor = start
+	return l.streamMessage()
+}
+
+// streamMessage forwards the buffered part of the streamed message to the passthrough writer
+func (l *JsonStreamLexer) streamMessage() error {
+	chunk := l.buffer[l.cursor:l.length]
+	if len(chunk) == 0 {
+		return nil
+	}
+	end := l.streamScan.scan(chunk)
+	if end != -1 {
+		chunk = chunk[:end+1]
+	}
+
+	if _, err := l.passthrough.Write(chunk); err != nil {
+		l.streaming = false
+		l.passthrough.EndMessage(err)
+		return err
+	}
+	l.cursor += len(chunk)
+	l.compact()
+
+	if end != -1 {
+		l.streaming = false
+		return l.passthrough.EndMessage(nil)
+	}
+	return nil
+}
+
+// abortStreaming ends a streamed message that can't be completed anymore
+func (l *JsonStreamLexer) abortStreaming(err error) {
+	if l.streaming {
+		l.streaming = false
+		l.passthrough.EndMessage(err)
+	}
+}
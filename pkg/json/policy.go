@@ -0,0 +1,164 @@
+package json
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// LexerPolicy limits the messages a JsonStreamLexer accepts. A zero value disables the limit.
+type LexerPolicy struct {
+	// Maximum nesting depth, counted separately for objects and arrays
+	MaxDepth int `json:"maxDepth,omitempty"`
+	// Maximum length of a single string in bytes
+	MaxStringLength int `json:"maxStringLength,omitempty"`
+	// Maximum number of elements in a single array
+	MaxArrayLength int `json:"maxArrayLength,omitempty"`
+	// Maximum number of members in a single object
+	MaxObjectLength int `json:"maxObjectLength,omitempty"`
+	// Maximum size of a whole message in bytes
+	MaxMessageSize int `json:"maxMessageSize,omitempty"`
+	// Validate the full JSON grammar of every message instead of only balancing brackets,
+	// invalid messages fail with a *SyntaxError. Streamed messages aren't validated.
+	Strict bool `json:"strict,omitempty"`
+}
+
+// DefaultLexerPolicy returns the limits used by NewJsonStreamLexer
+func DefaultLexerPolicy() LexerPolicy {
+	return LexerPolicy{
+		MaxDepth:        20,
+		MaxStringLength: 999999,
+		MaxArrayLength:  9999,
+		MaxObjectLength: 9999,
+	}
+}
+
+// LimitKind identifies a limit of the LexerPolicy
+type LimitKind int
+
+const (
+	LimitObjectDepth LimitKind = iota
+	LimitArrayDepth
+	LimitStringLength
+	LimitArrayLength
+	LimitObjectLength
+	LimitMessageSize
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitObjectDepth:
+		return "object depth"
+	case LimitArrayDepth:
+		return "array depth"
+	case LimitStringLength:
+		return "string length"
+	case LimitArrayLength:
+		return "array length"
+	case LimitObjectLength:
+		return "object length"
+	case LimitMessageSize:
+		return "message size"
+	}
+	return fmt.Sprintf("LimitKind(%d)", int(k))
+}
+
+// ErrLimitExceeded matches every *LimitError with errors.Is
+var ErrLimitExceeded = errors.New("lexer limit exceeded")
+
+// LimitError is returned when a message violates the LexerPolicy
+type LimitError struct {
+	Limit  LimitKind
+	Max    int
+	Offset int64 // Stream offset where the limit was exceeded
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case LimitObjectDepth:
+		return fmt.Sprintf("object exceeds maximum depth of %d", e.Max)
+	case LimitArrayDepth:
+		return fmt.Sprintf("array exceeds maximum depth of %d", e.Max)
+	case LimitStringLength:
+		return fmt.Sprintf("string exceeds maximum length of %d", e.Max)
+	case LimitArrayLength:
+		return fmt.Sprintf("array length exceeds maximum of %d", e.Max)
+	case LimitObjectLength:
+		return fmt.Sprintf("object length exceeds maximum of %d", e.Max)
+	case LimitMessageSize:
+		return fmt.Sprintf("message exceeds maximum size of %d bytes", e.Max)
+	}
+	return fmt.Sprintf("%s exceeds maximum of %d", e.Limit, e.Max)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// limits is the LexerPolicy prepared for the hot loop, disabled limits are math.MaxInt
+type limits struct {
+	maxDepth        int
+	maxStringLength int
+	maxArrayLength  int
+	maxObjectLength int
+	maxMessageSize  int
+
+	// Commas are only structural if element counts are limited
+	countLengths bool
+}
+
+func newLimits(p LexerPolicy) limits {
+	orMax := func(v int) int {
+		if v <= 0 {
+			return math.MaxInt
+		}
+		return v
+	}
+
+	return limits{
+		maxDepth:        orMax(p.MaxDepth),
+		maxStringLength: orMax(p.MaxStringLength),
+		maxArrayLength:  orMax(p.MaxArrayLength),
+		maxObjectLength: orMax(p.MaxObjectLength),
+		maxMessageSize:  orMax(p.MaxMessageSize),
+		countLengths:    p.MaxArrayLength > 0 || p.MaxObjectLength > 0,
+	}
+}
+
+// scanState tracks just enough structure to find the end of a value without any limits
+type scanState struct {
+	depth    int
+	inString bool
+	escaped  bool
+}
+
+// scan consumes buf and returns the index of the byte closing the outermost value, -1 if it isn't in buf
+func (s *scanState) scan(buf []byte) int {
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		if s.inString {
+			switch {
+			case s.escaped:
+				s.escaped = false
+			case c == '\\':
+				s.escaped = true
+			case c == '"':
+				s.inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			s.inString = true
+		case '{', '[':
+			s.depth++
+		case '}', ']':
+			s.depth--
+			if s.depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,110 @@
+package json
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPool is a size-classed pool of byte buffers shared by lexers, see SetBufferPool.
+// Buffers are kept in power of two size classes between the minimum and maximum size,
+// bigger buffers are allocated and dropped as usual.
+type BufferPool struct {
+	minShift uint
+	classes  []sync.Pool // Class i holds *[]byte with a capacity of at least 1<<(minShift+i)
+
+	gets      atomic.Uint64
+	puts      atomic.Uint64
+	allocs    atomic.Uint64
+	inUse     atomic.Int64
+	highWater atomic.Int64
+}
+
+// BufferPoolStats is a snapshot of the pool counters
+type BufferPoolStats struct {
+	Gets      uint64 `json:"gets"`
+	Puts      uint64 `json:"puts"`
+	Allocs    uint64 `json:"allocs"`    // Gets that had to allocate a new buffer
+	InUse     int64  `json:"inUse"`     // Bytes handed out and not returned yet
+	HighWater int64  `json:"highWater"` // Maximum of InUse since the pool was created
+}
+
+// DefaultBufferPool is shared by all lexers that don't get a pool of their own
+var DefaultBufferPool = NewBufferPool(1<<10, 64<<20)
+
+// NewBufferPool creates a pool for buffers between minSize and maxSize bytes, both rounded up to a power of two
+func NewBufferPool(minSize, maxSize int) *BufferPool {
+	minShift := uint(bits.Len(uint(max(minSize, 1) - 1)))
+	maxShift := uint(bits.Len(uint(max(maxSize, minSize, 1) - 1)))
+	return &BufferPool{
+		minShift: minShift,
+		classes:  make([]sync.Pool, maxShift-minShift+1),
+	}
+}
+
+// Get returns a buffer of length size. Its capacity is the size rounded up to the next size class.
+func (p *BufferPool) Get(size int) []byte {
+	p.gets.Add(1)
+
+	class := p.class(size)
+	if class >= len(p.classes) {
+		p.allocs.Add(1)
+		p.track(int64(size))
+		return make([]byte, size)
+	}
+
+	if buf, ok := p.classes[class].Get().(*[]byte); ok {
+		p.track(int64(cap(*buf)))
+		return (*buf)[:size]
+	}
+	p.allocs.Add(1)
+	classSize := 1 << (p.minShift + uint(class))
+	p.track(int64(classSize))
+	return make([]byte, size, classSize)
+}
+
+// Put returns a buffer obtained from Get. It must not be used afterwards.
+func (p *BufferPool) Put(buf []byte) {
+	if buf == nil {
+		return
+	}
+	p.puts.Add(1)
+	p.track(-int64(cap(buf)))
+
+	// Buffers are filed under the biggest class they can serve
+	class := bits.Len(uint(cap(buf))) - 1 - int(p.minShift)
+	if class < 0 || class >= len(p.classes) {
+		return
+	}
+	buf = buf[:0]
+	p.classes[class].Put(&buf)
+}
+
+// Stats returns the current counters of the pool
+func (p *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:      p.gets.Load(),
+		Puts:      p.puts.Load(),
+		Allocs:    p.allocs.Load(),
+		InUse:     p.inUse.Load(),
+		HighWater: p.highWater.Load(),
+	}
+}
+
+// class returns the size class that fits size bytes
+func (p *BufferPool) class(size int) int {
+	if size <= 1<<p.minShift {
+		return 0
+	}
+	return bits.Len(uint(size-1)) - int(p.minShift)
+}
+
+func (p *BufferPool) track(delta int64) {
+	inUse := p.inUse.Add(delta)
+	for {
+		high := p.highWater.Load()
+		if inUse <= high || p.highWater.CompareAndSwap(high, inUse) {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package json
+
+// The lexer spends most of its time looking for the next byte that changes its state,
+// like the closing quote of a long hex string. indexAny finds it with SIMD where available.
+// String bodies are always scanned this way. Outside of strings the structural characters
+// are usually too dense for a SIMD jump to pay off, NextObject only jumps between them once
+// a message turns out to be sparse, like arrays of numbers.
+
+// byteSet is a set of up to 8 bytes for indexAny
+type byteSet struct {
+	table [256]bool
+	bytes [8]byte // The members, padded by repeating the first one
+}
+
+func newByteSet(members string) *byteSet {
+	if len(members) == 0 || len(members) > 8 {
+		panic("byteSet needs 1 to 8 members")
+	}
+	s := &byteSet{}
+	for i := range s.bytes {
+		c := members[0]
+		if i < len(members) {
+			c = members[i]
+		}
+		s.bytes[i] = c
+		s.table[c] = true
+	}
+	return s
+}
+
+var (
+	stringSet             = newByteSet(`"\`)
+	structuralSet         = newByteSet(`"{}[]`)
+	structuralCountingSet = newByteSet(`"{}[],`) // Includes commas to count elements
+)
+
+// Size of the blocks the SIMD implementations work on
+const simdBlock = 32
+
+// indexAnyGeneric returns the index of the first member of set in buf, len(buf) if there is none
+func indexAnyGeneric(buf []byte, set *byteSet) int {
+	for i, c := range buf {
+		if set.table[c] {
+			return i
+		}
+	}
+	return len(buf)
+}
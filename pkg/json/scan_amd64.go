@@ -0,0 +1,13 @@
+//go:build !purego
+
+package json
+
+import "golang.org/x/sys/cpu"
+
+var useSIMD = cpu.X86.HasAVX2
+
+// indexAnySIMD scans the whole 32 byte blocks of buf with AVX2. It returns the index of the
+// first member of set or the number of bytes scanned if there is none.
+//
+//go:noescape
+func indexAnySIMD(buf []byte, set *[8]byte) int
@@ -0,0 +1,58 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// func indexAnySIMD(buf []byte, set *[8]byte) int
+TEXT ·indexAnySIMD(SB), NOSPLIT, $0-40
+	MOVQ buf_base+0(FP), SI
+	MOVQ buf_len+8(FP), BX
+	MOVQ set+24(FP), DI
+
+	// One register per set member
+	VPBROADCASTB 0(DI), Y1
+	VPBROADCASTB 1(DI), Y2
+	VPBROADCASTB 2(DI), Y3
+	VPBROADCASTB 3(DI), Y4
+	VPBROADCASTB 4(DI), Y5
+	VPBROADCASTB 5(DI), Y6
+	VPBROADCASTB 6(DI), Y7
+	VPBROADCASTB 7(DI), Y8
+
+	XORQ AX, AX
+	ANDQ $-32, BX
+
+loop:
+	CMPQ AX, BX
+	JAE  done
+
+	VMOVDQU  (SI)(AX*1), Y0
+	VPCMPEQB Y0, Y1, Y9
+	VPCMPEQB Y0, Y2, Y10
+	VPOR     Y10, Y9, Y9
+	VPCMPEQB Y0, Y3, Y10
+	VPOR     Y10, Y9, Y9
+	VPCMPEQB Y0, Y4, Y10
+	VPOR     Y10, Y9, Y9
+	VPCMPEQB Y0, Y5, Y10
+	VPOR     Y10, Y9, Y9
+	VPCMPEQB Y0, Y6, Y10
+	VPOR     Y10, Y9, Y9
+	VPCMPEQB Y0, Y7, Y10
+	VPOR     Y10, Y9, Y9
+	VPCMPEQB Y0, Y8, Y10
+	VPOR     Y10, Y9, Y9
+
+	VPMOVMSKB Y9, CX
+	TESTL     CX, CX
+	JNZ       found
+	ADDQ      $32, AX
+	JMP       loop
+
+found:
+	BSFL CX, CX
+	ADDQ CX, AX
+
+done:
+	VZEROUPPER
+	MOVQ AX, ret+32(FP)
+	RET
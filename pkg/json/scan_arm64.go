@@ -0,0 +1,13 @@
+//go:build !purego
+
+package json
+
+import "golang.org/x/sys/cpu"
+
+var useSIMD = cpu.ARM64.HasASIMD
+
+// indexAnySIMD scans the whole 32 byte blocks of buf with NEON. It returns the index of the
+// first member of set or the number of bytes scanned if there is none.
+//
+//go:noescape
+func indexAnySIMD(buf []byte, set *[8]byte) int
@@ -0,0 +1,91 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// func indexAnySIMD(buf []byte, set *[8]byte) int
+TEXT ·indexAnySIMD(SB), NOSPLIT, $0-40
+	MOVD buf_base+0(FP), R0
+	MOVD buf_len+8(FP), R2
+	MOVD set+24(FP), R1
+
+	// One register per set member
+	MOVBU 0(R1), R4
+	VMOV  R4, V1.B16
+	MOVBU 1(R1), R4
+	VMOV  R4, V2.B16
+	MOVBU 2(R1), R4
+	VMOV  R4, V3.B16
+	MOVBU 3(R1), R4
+	VMOV  R4, V4.B16
+	MOVBU 4(R1), R4
+	VMOV  R4, V5.B16
+	MOVBU 5(R1), R4
+	VMOV  R4, V6.B16
+	MOVBU 6(R1), R4
+	VMOV  R4, V7.B16
+	MOVBU 7(R1), R4
+	VMOV  R4, V8.B16
+
+	// Magic constant to build a syndrome with two bits per byte, like bytes.IndexByte
+	MOVD $0x40100401, R5
+	VMOV R5, V9.S4
+
+	MOVD $0, R3
+	AND  $-32, R2
+
+loop:
+	CMP R2, R3
+	BHS done
+
+	ADD   R0, R3, R4
+	VLD1  (R4), [V10.B16, V11.B16]
+	VCMEQ V1.B16, V10.B16, V12.B16
+	VCMEQ V1.B16, V11.B16, V13.B16
+	VCMEQ V2.B16, V10.B16, V14.B16
+	VCMEQ V2.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+	VCMEQ V3.B16, V10.B16, V14.B16
+	VCMEQ V3.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+	VCMEQ V4.B16, V10.B16, V14.B16
+	VCMEQ V4.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+	VCMEQ V5.B16, V10.B16, V14.B16
+	VCMEQ V5.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+	VCMEQ V6.B16, V10.B16, V14.B16
+	VCMEQ V6.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+	VCMEQ V7.B16, V10.B16, V14.B16
+	VCMEQ V7.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+	VCMEQ V8.B16, V10.B16, V14.B16
+	VCMEQ V8.B16, V11.B16, V15.B16
+	VORR  V14.B16, V12.B16, V12.B16
+	VORR  V15.B16, V13.B16, V13.B16
+
+	// Reduce the 32 byte mask to 64 bits
+	VAND  V9.B16, V12.B16, V12.B16
+	VAND  V9.B16, V13.B16, V13.B16
+	VADDP V13.B16, V12.B16, V16.B16
+	VADDP V16.B16, V16.B16, V16.B16
+	VMOV  V16.D[0], R6
+	CBNZ  R6, found
+
+	ADD $32, R3
+	B   loop
+
+found:
+	RBIT R6, R6
+	CLZ  R6, R6
+	ADD  R6>>1, R3, R3
+
+done:
+	MOVD R3, ret+32(FP)
+	RET
@@ -0,0 +1,10 @@
+//go:build (!amd64 && !arm64) || purego
+
+package json
+
+var useSIMD = false
+
+// indexAny returns the index of the first member of set in buf, len(buf) if there is none
+func indexAny(buf []byte, set *byteSet) int {
+	return indexAnyGeneric(buf, set)
+}
@@ -0,0 +1,17 @@
+//go:build (amd64 || arm64) && !purego
+
+package json
+
+// indexAny returns the index of the first member of set in buf, len(buf) if there is none
+func indexAny(buf []byte, set *byteSet) int {
+	if !useSIMD || len(buf) < simdBlock {
+		return indexAnyGeneric(buf, set)
+	}
+
+	// The SIMD part only handles whole blocks
+	i := indexAnySIMD(buf, &set.bytes)
+	if i < len(buf)&^(simdBlock-1) {
+		return i
+	}
+	return i + indexAnyGeneric(buf[i:], set)
+}
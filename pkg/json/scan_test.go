@@ -0,0 +1,75 @@
+package json
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIndexAny(t *testing.T) {
+	for _, set := range []*byteSet{stringSet, newByteSet(`{}[]"`), newByteSet(`{}[]",`)} {
+		for n := 0; n < 100; n++ {
+			// Every position of a match, no match and a match in the tail after the last block
+			for pos := 0; pos <= n; pos++ {
+				buf := bytes.Repeat([]byte("a"), n)
+				if pos < n {
+					buf[pos] = set.bytes[len(set.bytes)-1]
+				}
+				if got, want := indexAny(buf, set), indexAnyGeneric(buf, set); got != want {
+					t.Fatalf("len %d match at %d: got %d, want %d", n, pos, got, want)
+				}
+			}
+		}
+	}
+}
+
+func FuzzIndexAny(f *testing.F) {
+	f.Add([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x0000000000000000000000000000000000000000"}`), "\"\\")
+	f.Add(bytes.Repeat([]byte{0xff}, 100), "{}[]\",")
+	f.Add([]byte{}, "a")
+	f.Fuzz(func(t *testing.T, buf []byte, members string) {
+		if len(members) == 0 || len(members) > 8 {
+			return
+		}
+		set := newByteSet(members)
+		if got, want := indexAny(buf, set), indexAnyGeneric(buf, set); got != want {
+			t.Fatalf("got %d, want %d", got, want)
+		}
+	})
+}
+
+// decodeResults runs a lexer over input and records everything it reports
+func decodeResults(input []byte, maxRead int, policy LexerPolicy) string {
+	var out strings.Builder
+	lexer := NewJsonStreamLexerWithPolicy(bytes.NewReader(input), 64, maxRead, false, policy)
+	lexer.SetRecovery(true)
+	lexer.DecodeAll(context.Background(), func(b []byte) {
+		fmt.Fprintf(&out, "msg %q\n", b)
+	}, func(err error) {
+		fmt.Fprintf(&out, "err %v\n", err)
+	})
+	return out.String()
+}
+
+// FuzzNextObjectSIMD proves the lexer gives identical results with and without SIMD
+func FuzzNextObjectSIMD(f *testing.F) {
+	f.Add([]byte(`{"a":"`+strings.Repeat("x", 100)+`\"}"} [1,2,{"b":[]}]`), 7, 40)
+	f.Add([]byte(`{"a":1}}{"b":"\\\\"}`+"\n"+`garbage {"c":[[[[]]]]}`), 64, 0)
+	f.Fuzz(func(t *testing.T, input []byte, maxRead int, limit int) {
+		if maxRead <= 0 || maxRead > 1<<16 || limit < 0 {
+			return
+		}
+		policy := LexerPolicy{MaxDepth: 4, MaxStringLength: limit, MaxArrayLength: limit, MaxObjectLength: limit}
+
+		simd := useSIMD
+		defer func() { useSIMD = simd }()
+		useSIMD = false
+		want := decodeResults(input, maxRead, policy)
+		useSIMD = simd
+		if got := decodeResults(input, maxRead, policy); got != want {
+			t.Fatalf("SIMD results differ\ngot:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package json
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+)
+
+// SyntaxError is returned for input that isn't valid JSON, see Validate and LexerPolicy.Strict
+type SyntaxError struct {
+	Offset int64 // Position of the error, a stream offset when returned by the lexer
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid JSON: %s at offset %d", e.msg, e.Offset)
+}
+
+// Validate checks that data is exactly one JSON value as specified by RFC 8259,
+// including the UTF-8 encoding of strings. Whitespace around the value is allowed.
+func Validate(data []byte) error {
+	var v validator
+	return v.validate(data)
+}
+
+// validator checks the grammar of complete messages without recursion or allocations per message
+type validator struct {
+	stack []byte // Open containers, '{' or '['
+}
+
+func (v *validator) validate(data []byte) error {
+	v.stack = v.stack[:0]
+	i := 0
+
+	for {
+		// A value is expected at i
+		i = skipWhitespace(data, i)
+		if i >= len(data) {
+			return syntaxError(i, "unexpected end of input")
+		}
+
+		var err error
+		switch c := data[i]; {
+		case c == '{':
+			i = skipWhitespace(data, i+1)
+			if i < len(data) && data[i] == '}' {
+				i++
+				break
+			}
+			v.stack = append(v.stack, '{')
+			if i, err = validKey(data, i); err != nil {
+				return err
+			}
+			continue
+		case c == '[':
+			i = skipWhitespace(data, i+1)
+			if i < len(data) && data[i] == ']' {
+				i++
+				break
+			}
+			v.stack = append(v.stack, '[')
+			continue
+		case c == '"':
+			i, err = validString(data, i)
+		case c == 't':
+			i, err = validLiteral(data, i, "true")
+		case c == 'f':
+			i, err = validLiteral(data, i, "false")
+		case c == 'n':
+			i, err = validLiteral(data, i, "null")
+		case c == '-' || ('0' <= c && c <= '9'):
+			i, err = validNumberAt(data, i)
+		default:
+			return syntaxError(i, fmt.Sprintf("unexpected character %q", c))
+		}
+		if err != nil {
+			return err
+		}
+
+		// After a value: close containers until the next element starts
+	afterValue:
+		for {
+			i = skipWhitespace(data, i)
+			if len(v.stack) == 0 {
+				if i != len(data) {
+					return syntaxError(i, "unexpected data after value")
+				}
+				return nil
+			}
+			if i >= len(data) {
+				return syntaxError(i, "unexpected end of input")
+			}
+
+			top := v.stack[len(v.stack)-1]
+			switch c := data[i]; {
+			case c == ',':
+				i++
+				if top == '{' {
+					if i, err = validKey(data, i); err != nil {
+						return err
+					}
+				}
+				break afterValue
+			case top == '{' && c == '}', top == '[' && c == ']':
+				v.stack = v.stack[:len(v.stack)-1]
+				i++
+			default:
+				return syntaxError(i, fmt.Sprintf("unexpected character %q after element", c))
+			}
+		}
+	}
+}
+
+// validKey checks an object key and the colon after it and returns the position after the colon
+func validKey(data []byte, i int) (int, error) {
+	i = skipWhitespace(data, i)
+	if i >= len(data) || data[i] != '"' {
+		return i, syntaxError(i, "expected string key")
+	}
+	i, err := validString(data, i)
+	if err != nil {
+		return i, err
+	}
+	i = skipWhitespace(data, i)
+	if i >= len(data) || data[i] != ':' {
+		return i, syntaxError(i, "expected ':'")
+	}
+	return i + 1, nil
+}
+
+// plainStringByte marks bytes that can appear unescaped in a string and need no further checks
+var plainStringByte [256]bool
+
+// Lookup tables for the strict mode of JsonStreamLexer.NextObject
+var (
+	stringSpecialStrict [256]bool // Bytes that end the fast path inside a string
+	isSignificant       [256]bool // Everything but whitespace, every token is checked
+	isTokenByte         [256]bool // Bytes of numbers and literals
+	validEscape         [256]bool // Escaped characters besides \u
+	isHexDigit          [256]bool
+)
+
+func init() {
+	for c := 0x20; c < utf8.RuneSelf; c++ {
+		plainStringByte[c] = c != '"' && c != '\\'
+	}
+	for c := range 256 {
+		stringSpecialStrict[c] = !plainStringByte[c]
+		isSignificant[c] = c != ' ' && c != '\n' && c != '\r' && c != '\t'
+		isTokenByte[c] = ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || c == '-' || c == '+' || c == '.' || c == 'E'
+		isHexDigit[c] = ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+	}
+	for _, c := range []byte(`"\\/bfnrt`) {
+		validEscape[c] = true
+	}
+}
+
+const (
+	swarOnes  = 0x0101010101010101
+	swarHighs = 0x8080808080808080
+)
+
+// plainStringWord reports whether none of the 8 bytes in w is a quote, backslash, control
+// character or part of a multibyte UTF-8 sequence
+func plainStringWord(w uint64) bool {
+	quote := w ^ ('"' * swarOnes)
+	backslash := w ^ ('\\' * swarOnes)
+	special := (quote-swarOnes) & ^quote |
+		(backslash-swarOnes) & ^backslash |
+		(w-0x20*swarOnes) & ^w | // Bytes < 0x20
+		w // Bytes >= 0x80
+	return special&swarHighs == 0
+}
+
+// validString checks the string starting at data[i] and returns the position after it
+func validString(data []byte, i int) (int, error) {
+	for j := i + 1; j < len(data); {
+		// Short strings like keys end after a few bytes, long ones like hex data
+		// are checked 8 bytes at a time after that
+		run := j
+		for j < len(data) && plainStringByte[data[j]] {
+			j++
+			if j-run == 16 {
+				for j+8 <= len(data) && plainStringWord(binary.LittleEndian.Uint64(data[j:])) {
+					j += 8
+				}
+			}
+		}
+		if j >= len(data) {
+			break
+		}
+
+		switch c := data[j]; {
+		case c == '"':
+			return j + 1, nil
+		case c == '\\':
+			if j+1 >= len(data) {
+				return j, syntaxError(j, "unterminated string")
+			}
+			switch data[j+1] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				j += 2
+			case 'u':
+				if _, ok := hexRune(data, j+2); !ok {
+					return j, syntaxError(j, "invalid unicode escape")
+				}
+				j += 6
+			default:
+				return j, syntaxError(j, "invalid escape sequence")
+			}
+		case c < 0x20:
+			return j, syntaxError(j, "control character in string")
+		default:
+			r, size := utf8.DecodeRune(data[j:])
+			if r == utf8.RuneError && size == 1 {
+				return j, syntaxError(j, "invalid UTF-8 in string")
+			}
+			j += size
+		}
+	}
+	return len(data), syntaxError(len(data), "unterminated string")
+}
+
+// validLiteral checks for the literal lit at data[i]
+func validLiteral(data []byte, i int, lit string) (int, error) {
+	if len(data)-i < len(lit) || string(data[i:i+len(lit)]) != lit {
+		return i, syntaxError(i, "invalid literal")
+	}
+	return i + len(lit), nil
+}
+
+// validNumberAt checks the number starting at data[i] and returns the position after it
+func validNumberAt(data []byte, i int) (int, error) {
+	j := i
+	for j < len(data) {
+		c := data[j]
+		if ('0' <= c && c <= '9') || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E' {
+			j++
+			continue
+		}
+		break
+	}
+	if !validNumber(data[i:j]) {
+		return i, syntaxError(i, "invalid number")
+	}
+	return j, nil
+}
+
+func syntaxError(pos int, msg string) *SyntaxError {
+	return &SyntaxError{Offset: int64(pos), msg: msg}
+}
+
+// plainStringLength returns the number of bytes at the start of buf that can appear in a string
+// without further checks, long runs are checked 8 bytes at a time
+func plainStringLength(buf []byte) int {
+	j := 0
+	for j+8 <= len(buf) && plainStringWord(binary.LittleEndian.Uint64(buf[j:])) {
+		j += 8
+	}
+	for j < len(buf) && plainStringByte[buf[j]] {
+		j++
+	}
+	return j
+}
+
+// The checks below are the parts of strict mode that NextObject keeps out of its loop
+
+// checkEscape checks the byte c after a backslash. hexLeft is the number of digits left of a
+// \u escape, the escape is complete once the returned count is 0. msg describes an invalid escape.
+func checkEscape(c byte, hexLeft int) (left int, msg string) {
+	switch {
+	case hexLeft > 0:
+		if !isHexDigit[c] {
+			return 0, "invalid unicode escape"
+		}
+		return hexLeft - 1, ""
+	case c == 'u':
+		return 4, ""
+	case !validEscape[c]:
+		return 0, "invalid escape sequence"
+	}
+	return 0, ""
+}
+
+// escapeLength returns the distance from the backslash of an escape to the byte checkEscape got
+func escapeLength(hexLeft int) int {
+	if hexLeft > 0 {
+		return 6 - hexLeft
+	}
+	return 1
+}
+
+// stringRune checks a control character or multibyte UTF-8 sequence at the start of buf and
+// returns its size, 0 if the sequence continues after buf
+func stringRune(buf []byte) (size int, msg string) {
+	if buf[0] < 0x20 {
+		return 0, "control character in string"
+	}
+	if !utf8.FullRune(buf) {
+		return 0, ""
+	}
+	r, size := utf8.DecodeRune(buf)
+	if r == utf8.RuneError && size == 1 {
+		return 0, "invalid UTF-8 in string"
+	}
+	return size, ""
+}
+
+// tokenLength checks the number or literal at the start of buf and returns its size,
+// 0 if it may continue after buf
+func tokenLength(buf []byte) (size int, msg string) {
+	if !isTokenByte[buf[0]] {
+		return 0, unexpectedChar(buf[0])
+	}
+	for size = 1; size < len(buf) && isTokenByte[buf[size]]; size++ {
+	}
+	if size == len(buf) {
+		return 0, ""
+	}
+
+	switch token := buf[:size]; buf[0] {
+	case 't', 'f', 'n':
+		if string(token) != "true" && string(token) != "false" && string(token) != "null" {
+			return 0, "invalid literal"
+		}
+	default:
+		if !validNumber(token) {
+			return 0, "invalid number"
+		}
+	}
+	return size, ""
+}
+
+func unexpectedChar(c byte) string {
+	return fmt.Sprintf("unexpected character %q", c)
+}
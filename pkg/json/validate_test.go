@@ -0,0 +1,72 @@
+package json
+
+import (
+	stdJson "encoding/json"
+	"errors"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []string{
+		`{}`, `[]`, ` { "a" : [ 1 , -2.5e+3 , "xé\"" , true , false , null ] } `,
+		`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0x0"},"latest"]}`,
+		`"ü"`, `0`, `-0.0e0`, `[[[]],{}]`, `{"a":{"b":{}}}`,
+	}
+	for _, v := range valid {
+		if err := Validate([]byte(v)); err != nil {
+			t.Errorf("%s: unexpected error %v", v, err)
+		}
+	}
+
+	invalid := map[string]int64{
+		`{"a": tru}`:     6,
+		`{,,,}`:          1,
+		`{"a":1,}`:       7,
+		`[1,]`:           3,
+		`{"a" 1}`:        5,
+		`{"a":01}`:       5,
+		`[1 2]`:          3,
+		`{]`:             1,
+		`["a\x"]`:        3,
+		"[\"a\x01\"]":    3,
+		"[\"\xff\"]":     2,
+		`[1.]`:           1,
+		`{"a":1}{"b":2}`: 7,
+		`{"a":"\u12G4"}`: 6,
+		`{"a":[1}`:       7,
+		`{"unterminated`: 14,
+		`[`:              1,
+	}
+	for v, offset := range invalid {
+		err := Validate([]byte(v))
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%s: expected a *SyntaxError, got %v", v, err)
+			continue
+		}
+		if syntaxErr.Offset != offset {
+			t.Errorf("%s: expected offset %d, got %d (%v)", v, offset, syntaxErr.Offset, err)
+		}
+	}
+}
+
+// FuzzValidate uses encoding/json as oracle. It doesn't check the UTF-8 encoding of strings,
+// so inputs with invalid UTF-8 only have to be rejected by us.
+func FuzzValidate(f *testing.F) {
+	f.Add([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0x0"},"latest"]}`))
+	f.Add([]byte(`[1,-2.5e+3,"é😀",true,false,null,{}]`))
+	f.Add([]byte(`{"a": tru}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := Validate(data)
+		if !utf8.Valid(data) {
+			if err == nil {
+				t.Fatalf("accepted invalid UTF-8 %q", data)
+			}
+			return
+		}
+		if (err == nil) != stdJson.Valid(data) {
+			t.Fatalf("Validate(%q) = %v, encoding/json says valid %v", data, err, stdJson.Valid(data))
+		}
+	})
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// CircuitState is the state of the circuit breaker of an upstream
+type CircuitState int32
+
+const (
+	// CircuitClosed lets all traffic through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen routes around the upstream
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probes through to test if the upstream recovered
+	CircuitHalfOpen
+)
+
+var circuitStateNames = map[CircuitState]string{
+	CircuitClosed:   "closed",
+	CircuitOpen:     "open",
+	CircuitHalfOpen: "half-open",
+}
+
+func (s CircuitState) String() string {
+	if name, ok := circuitStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitBreaker stops sending traffic to a failing upstream. Transport errors, request timeouts and
+// responses with one of ErrorCodes count as failures. New connections, hedges and retries skip an
+// open upstream, connections already on it are kept.
+type CircuitBreaker struct {
+	// Open after this many failures in a row, 0 disables the check
+	ConsecutiveFailures int `json:"consecutiveFailures,omitempty"`
+	// Open when this share of the last Window requests failed, 0 disables the check
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	Window    int     `json:"window,omitempty"`
+	// Time an open breaker waits before it lets probes through
+	OpenDuration Duration `json:"openDuration,omitempty"`
+	// Successful probes needed in half-open state to close the breaker again
+	HalfOpenProbes int `json:"halfOpenProbes,omitempty"`
+	// JSON-RPC error codes of upstream responses that count as failures
+	ErrorCodes []int `json:"errorCodes,omitempty"`
+}
+
+func (c *CircuitBreaker) enabled() bool {
+	return c.ConsecutiveFailures > 0 || c.ErrorRate > 0
+}
+
+// UpstreamState is a snapshot of the health of an upstream
+type UpstreamState struct {
+	Upstream string
+	Healthy  bool
+	Circuit  CircuitState
+	Failures int // Failures in a row
+}
+
+// circuitBreaker tracks the outcomes of requests to one upstream
+type circuitBreaker struct {
+	config   *CircuitBreaker
+	upstream Upstream
+
+	lock        sync.Mutex
+	state       CircuitState
+	changedAt   time.Time
+	consecutive int
+	outcomes    []bool // Ring buffer of the last Window outcomes, true is a failure
+	next        int
+	seen        int
+	failures    int    // Failures in outcomes
+	probes      int    // Requests let through in half-open state
+	successes   int    // Successful probes
+	epoch       uint64 // Counts half-open periods, probes are tagged with the one they were let through in
+}
+
+func newCircuitBreaker(config *CircuitBreaker, upstream Upstream) *circuitBreaker {
+	b := &circuitBreaker{config: config, upstream: upstream}
+	if config.ErrorRate > 0 {
+		b.outcomes = make([]bool, max(config.Window, 1))
+	}
+	return b
+}
+
+// allow reports whether the upstream may get traffic. An open breaker turns half-open once
+// OpenDuration passed, from is the state before the call. Traffic let through in half-open state
+// gets a probe tag that has to be passed to record, it is 0 otherwise.
+func (b *circuitBreaker) allow() (ok bool, probe uint64, from, to CircuitState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	from = b.state
+
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.changedAt) < time.Duration(b.config.OpenDuration) {
+			return false, 0, from, b.state
+		}
+		b.transition(CircuitHalfOpen)
+		fallthrough
+	case CircuitHalfOpen:
+		if b.probes >= max(b.config.HalfOpenProbes, 1) {
+			// Probes that never reported back don't block the upstream forever
+			if time.Since(b.changedAt) < time.Duration(b.config.OpenDuration) {
+				return false, 0, from, b.state
+			}
+			b.transition(CircuitHalfOpen)
+		}
+		b.probes++
+		probe = b.epoch
+	}
+	return true, probe, from, b.state
+}
+
+// record adds the outcome of a request and returns the state before and after it. In half-open
+// state only outcomes of the current probes count, probe is the tag allow returned for the traffic.
+func (b *circuitBreaker) record(failed bool, probe uint64) (from, to CircuitState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	from = b.state
+
+	switch b.state {
+	case CircuitOpen:
+		// Requests of the connections that stay on the upstream
+		return from, b.state
+	case CircuitHalfOpen:
+		// Connections that were opened before the breaker opened don't tell if the upstream recovered
+		if probe != b.epoch {
+			return from, b.state
+		}
+		if failed {
+			b.transition(CircuitOpen)
+			return from, b.state
+		}
+		b.successes++
+		if b.successes >= max(b.config.HalfOpenProbes, 1) {
+			b.transition(CircuitClosed)
+		}
+		return from, b.state
+	}
+
+	if failed {
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+	if b.outcomes != nil {
+		if b.seen == len(b.outcomes) && b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % len(b.outcomes)
+		b.seen = min(b.seen+1, len(b.outcomes))
+		if failed {
+			b.failures++
+		}
+	}
+
+	if b.config.ConsecutiveFailures > 0 && b.consecutive >= b.config.ConsecutiveFailures {
+		b.transition(CircuitOpen)
+	} else if b.outcomes != nil && b.seen == len(b.outcomes) &&
+		float64(b.failures)/float64(len(b.outcomes)) >= b.config.ErrorRate {
+		b.transition(CircuitOpen)
+	}
+	return from, b.state
+}
+
+// transition changes the state and resets the counters, the lock has to be held
+func (b *circuitBreaker) transition(state CircuitState) {
+	b.state = state
+	b.changedAt = time.Now()
+	b.consecutive = 0
+	clear(b.outcomes)
+	b.next, b.seen, b.failures = 0, 0, 0
+	b.probes, b.successes = 0, 0
+	if state == CircuitHalfOpen {
+		b.epoch++
+	}
+}
+
+func (b *circuitBreaker) snapshot() (CircuitState, int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state, b.consecutive
+}
+
+// upstreamName identifies an upstream in logs
+func upstreamName(upstream Upstream) string {
+	if s, ok := upstream.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", upstream)
+}
+
+// admit reports whether a new stream or request may go to upstream. The probe tag has to be
+// passed along with the outcomes of the traffic.
+func (j *JsonReverseProxy) admit(upstream Upstream) (ok bool, probe uint64) {
+	if !upstream.Healthy() {
+		return false, 0
+	}
+	b := j.breakers[upstream]
+	if b == nil {
+		return true, 0
+	}
+	ok, probe, from, to := b.allow()
+	if from != to {
+		j.circuitChanged(b, from, to, "open duration elapsed")
+	}
+	return ok, probe
+}
+
+// recordFailure counts a transport error or timeout of upstream
+func (j *JsonReverseProxy) recordFailure(upstream Upstream, probe uint64, reason string) {
+	if b := j.breakers[upstream]; b != nil {
+		if from, to := b.record(true, probe); from != to {
+			j.circuitChanged(b, from, to, reason)
+		}
+	}
+}
+
+// recordResponse counts an upstream response, notifications are ignored
+func (j *JsonReverseProxy) recordResponse(upstream Upstream, probe uint64, msg []byte) {
+	b := j.breakers[upstream]
+	// Responses have an id, most notifications are skipped without parsing them
+	if b == nil || !bytes.Contains(msg, idKey) {
+		return
+	}
+
+	failed := false
+	if len(j.CircuitBreaker.ErrorCodes) > 0 && bytes.Contains(msg, errorKey) {
+		failed = j.CircuitBreaker.failureCode(msg)
+	} else if isNotification(msg) {
+		return
+	}
+	if from, to := b.record(failed, probe); from != to {
+		j.circuitChanged(b, from, to, "error response")
+	}
+}
+
+var (
+	idKey    = []byte(`"id"`)
+	errorKey = []byte(`"error"`)
+)
+
+// failureCode reports whether msg is an error response with one of the configured codes
+func (c *CircuitBreaker) failureCode(msg []byte) bool {
+	errObj, err := blzdJson.Field(msg, "error")
+	if err != nil {
+		return false
+	}
+	code, err := blzdJson.Field(errObj, "code")
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(string(code))
+	return err == nil && slices.Contains(c.ErrorCodes, n)
+}
+
+// circuitChanged logs a state change of a breaker
+func (j *JsonReverseProxy) circuitChanged(b *circuitBreaker, from, to CircuitState, reason string) {
+	name := upstreamName(b.upstream)
+	switch to {
+	case CircuitOpen:
+		atomic.AddInt64(&j.CircuitOpenedCount, 1)
+		j.logger.Warn().
+			Str("upstream", name).
+			Stringer("from", from).
+			Str("reason", reason).
+			Dur("open_duration", time.Duration(j.CircuitBreaker.OpenDuration)).
+			Msg("Circuit breaker opened")
+	default:
+		j.logger.Info().
+			Str("upstream", name).
+			Stringer("from", from).
+			Stringer("to", to).
+			Msg("Circuit breaker changed state")
+	}
+}
+
+// UpstreamStates returns the health and circuit breaker state of all upstreams
+func (j *JsonReverseProxy) UpstreamStates() []UpstreamState {
+	states := make([]UpstreamState, 0, len(j.upstreams))
+	for _, upstream := range j.upstreams {
+		state := UpstreamState{Upstream: upstreamName(upstream), Healthy: upstream.Healthy()}
+		if b := j.breakers[upstream]; b != nil {
+			state.Circuit, state.Failures = b.snapshot()
+		}
+		states = append(states, state)
+	}
+	return states
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	config := &CircuitBreaker{ConsecutiveFailures: 2, OpenDuration: Duration(20 * time.Millisecond), HalfOpenProbes: 2}
+	b := newCircuitBreaker(config, nil)
+
+	b.record(true, 0)
+	b.record(false, 0)
+	b.record(true, 0)
+	_, to := b.record(true, 0)
+	assert.Equal(t, CircuitOpen, to)
+	ok, _, _, _ := b.allow()
+	assert.False(t, ok)
+
+	// Only the configured number of probes is let through
+	time.Sleep(time.Duration(config.OpenDuration))
+	ok, probe, from, to := b.allow()
+	assert.True(t, ok)
+	assert.NotZero(t, probe)
+	assert.Equal(t, CircuitOpen, from)
+	assert.Equal(t, CircuitHalfOpen, to)
+	ok, _, _, _ = b.allow()
+	assert.True(t, ok)
+	ok, _, _, _ = b.allow()
+	assert.False(t, ok)
+
+	// A failed probe opens the breaker again, enough successful ones close it
+	_, to = b.record(true, probe)
+	assert.Equal(t, CircuitOpen, to)
+	time.Sleep(time.Duration(config.OpenDuration))
+	_, probe, _, _ = b.allow()
+	b.allow()
+	_, to = b.record(false, probe)
+	assert.Equal(t, CircuitHalfOpen, to)
+	_, to = b.record(false, probe)
+	assert.Equal(t, CircuitClosed, to)
+
+	// The error rate only counts once the window is full
+	b = newCircuitBreaker(&CircuitBreaker{ErrorRate: 0.5, Window: 4}, nil)
+	b.record(true, 0)
+	b.record(true, 0)
+	_, to = b.record(false, 0)
+	assert.Equal(t, CircuitClosed, to)
+	_, to = b.record(false, 0)
+	assert.Equal(t, CircuitOpen, to)
+}
+
+func TestCircuitBreakerOnlyCountsProbes(t *testing.T) {
+	config := &CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: Duration(20 * time.Millisecond)}
+	b := newCircuitBreaker(config, nil)
+	_, to := b.record(true, 0)
+	assert.Equal(t, CircuitOpen, to)
+
+	// Responses on connections that were opened before don't close a half-open breaker
+	time.Sleep(time.Duration(config.OpenDuration))
+	_, probe, _, to := b.allow()
+	assert.Equal(t, CircuitHalfOpen, to)
+	_, to = b.record(false, 0)
+	assert.Equal(t, CircuitHalfOpen, to)
+	_, to = b.record(true, 0)
+	assert.Equal(t, CircuitHalfOpen, to)
+
+	// Neither do probes of an earlier half-open period
+	_, to = b.record(true, probe)
+	assert.Equal(t, CircuitOpen, to)
+	time.Sleep(time.Duration(config.OpenDuration))
+	_, next, _, _ := b.allow()
+	_, to = b.record(false, probe)
+	assert.Equal(t, CircuitHalfOpen, to)
+	_, to = b.record(false, next)
+	assert.Equal(t, CircuitClosed, to)
+}
+
+func TestCircuitBreakerRoutesAround(t *testing.T) {
+	failing := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32603,"message":"internal error"}}`, id)
+	})
+	healthy := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":"0x1"}`, id)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(failing), WithUnixUpstream(healthy),
+		WithCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 2, OpenDuration: Duration(time.Minute), ErrorCodes: []int{-32603}}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` +
+		`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":2}` + "\n"))
+	assert.NoError(t, err)
+	responses := readResponses(t, reader, 2)
+	assert.Contains(t, responses["2"], "-32603")
+
+	// The breaker opened, the connection stays on the failing upstream
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":4}` + "\n"))
+	assert.NoError(t, err)
+	responses = readResponses(t, reader, 1)
+	assert.Contains(t, responses["4"], "-32603")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.CircuitOpenedCount))
+	states := proxy.UpstreamStates()
+	assert.Equal(t, CircuitOpen, states[0].Circuit)
+	assert.Equal(t, CircuitClosed, states[1].Circuit)
+
+	// New clients are routed around it
+	client, err = net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":3}` + "\n"))
+	assert.NoError(t, err)
+	responses = readResponses(t, bufio.NewReader(client), 1)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":3,"result":"0x1"}`, responses["3"])
+}
+
+func TestCircuitBreakerIgnoresIdleTimeout(t *testing.T) {
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(startSilentUpstream(t)),
+		WithTimeouts(Timeouts{Idle: Duration(20 * time.Millisecond)}),
+		WithCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: Duration(time.Minute)}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	// Idle connections are closed, that says nothing about the health of the upstream
+	for range 5 {
+		client, err := net.Dial("unix", proxySocket)
+		assert.NoError(t, err)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, io.EOF)
+		client.Close()
+	}
+	assert.Equal(t, CircuitClosed, proxy.UpstreamStates()[0].Circuit)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&proxy.CircuitOpenedCount))
+}
+
+func TestCircuitBreakerHalfOpenIgnoresExistingSessions(t *testing.T) {
+	upstream := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		if method == "debug_fail" {
+			return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32603,"message":"internal error"}}`, id)
+		}
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":"0x1"}`, id)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(upstream),
+		WithCircuitBreaker(CircuitBreaker{ConsecutiveFailures: 1, OpenDuration: Duration(50 * time.Millisecond), ErrorCodes: []int{-32603}}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		client, err := net.Dial("unix", proxySocket)
+		assert.NoError(t, err)
+		t.Cleanup(func() { client.Close() })
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		return client, bufio.NewReader(client)
+	}
+	send := func(client net.Conn, reader *bufio.Reader, method string, id int) {
+		_, err := fmt.Fprintf(client, `{"jsonrpc":"2.0","method":%q,"params":[],"id":%d}`+"\n", method, id)
+		assert.NoError(t, err)
+		readResponses(t, reader, 1)
+	}
+
+	existing, existingReader := dial()
+	send(existing, existingReader, "debug_fail", 1)
+	assert.Equal(t, CircuitOpen, proxy.UpstreamStates()[0].Circuit)
+
+	// The next connection is the probe, successes of the existing one don't count
+	time.Sleep(50 * time.Millisecond)
+	probe, probeReader := dial()
+	assert.Eventually(t, func() bool {
+		return proxy.UpstreamStates()[0].Circuit == CircuitHalfOpen
+	}, time.Second, time.Millisecond)
+	send(existing, existingReader, "eth_blockNumber", 2)
+	assert.Equal(t, CircuitHalfOpen, proxy.UpstreamStates()[0].Circuit)
+
+	send(probe, probeReader, "eth_blockNumber", 3)
+	assert.Equal(t, CircuitClosed, proxy.UpstreamStates()[0].Circuit)
+}
@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// subscriptionHub shares upstream subscriptions between clients, see JsonReverseProxy.SharedSubscriptions.
+// It holds an upstream stream of its own: identical eth_subscribe requests (same params) of all clients
+// are served by a single upstream subscription, and its notifications are copied to every subscriber
+// with the subscriber's own subscription id substituted.
+type subscriptionHub struct {
+	proxy  *JsonReverseProxy
+	lastID atomic.Uint64 // For ids of requests the hub sends itself
+
+	lock         sync.Mutex
+	stream       UpstreamStream                 // Opened with the first subscription
+	byKey        map[string]*sharedSubscription // by compacted params
+	byUpstreamID map[string]*sharedSubscription
+	byClientID   map[string]*subscriber
+	requests     map[string]*sharedSubscription // eth_subscribe requests waiting for the upstream by raw JSON id
+
+	// Subscribers of the notification being delivered, only used by the receiving goroutine
+	recipients []*subscriber
+}
+
+// sharedSubscription is one upstream subscription and the clients attached to it
+type sharedSubscription struct {
+	key         string
+	params      []byte
+	upstreamID  string                 // Empty until the upstream confirmed the subscription
+	subscribers map[string]*subscriber // by client subscription id
+}
+
+// subscriber is a client attached to a shared subscription
+type subscriber struct {
+	id        string // Subscription id the client knows
+	connID    string
+	conn      *ProxyConn
+	requestID []byte // Raw JSON id of the eth_subscribe request
+	shared    *sharedSubscription
+	createdAt time.Time
+
+	// Set once the client got the response to its eth_subscribe request, no notifications are sent before
+	ready         atomic.Bool
+	notifications atomic.Uint64
+}
+
+func newSubscriptionHub(proxy *JsonReverseProxy) *subscriptionHub {
+	return &subscriptionHub{
+		proxy:        proxy,
+		byKey:        make(map[string]*sharedSubscription),
+		byUpstreamID: make(map[string]*sharedSubscription),
+		byClientID:   make(map[string]*subscriber),
+		requests:     make(map[string]*sharedSubscription),
+	}
+}
+
+// newSubscriptionID returns a random subscription id in the format of geth
+func newSubscriptionID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return "0x" + hex.EncodeToString(id[:])
+}
+
+// handle takes over eth_subscribe and eth_unsubscribe requests of a client. It reports false for
+// all other messages, they are forwarded to the client's upstream as usual.
+func (h *subscriptionHub) handle(connID string, conn *ProxyConn, msg []byte) bool {
+	if !bytes.Contains(msg, subscribeKeyword) {
+		return false
+	}
+	header := parseHeader(msg)
+	if len(header.ID) == 0 || bytes.Equal(header.ID, nullID) {
+		return false
+	}
+
+	switch {
+	case bytes.Equal(header.Method, subscribeMethod):
+		params, err := blzdJson.Field(msg, "params")
+		if err != nil {
+			return false
+		}
+		var key bytes.Buffer
+		if json.Compact(&key, params) != nil {
+			return false
+		}
+		h.subscribe(connID, conn, bytes.Clone(header.ID), key.Bytes())
+		return true
+	case bytes.Equal(header.Method, unsubscribeMethod):
+		return h.unsubscribe(conn, header.ID, firstParam(msg))
+	}
+	return false
+}
+
+// subscribe attaches the client to the subscription for params, creating it on the upstream if needed
+func (h *subscriptionHub) subscribe(connID string, conn *ProxyConn, requestID, params []byte) {
+	sub := &subscriber{
+		id:        newSubscriptionID(),
+		connID:    connID,
+		conn:      conn,
+		requestID: requestID,
+		createdAt: time.Now(),
+	}
+
+	h.lock.Lock()
+	shared := h.byKey[string(params)]
+	created := shared == nil
+	if created {
+		shared = &sharedSubscription{key: string(params), params: params, subscribers: make(map[string]*subscriber)}
+	}
+	sub.shared = shared
+	// Registered with the session under the hub lock, so closeSession either sees the subscriber
+	// or the client disconnected before and it is never attached
+	if !conn.session.addShared(sub) {
+		h.lock.Unlock()
+		return
+	}
+	if created {
+		h.byKey[shared.key] = shared
+	}
+	shared.subscribers[sub.id] = sub
+	h.byClientID[sub.id] = sub
+	confirmed := shared.upstreamID != ""
+
+	var stream UpstreamStream
+	var err error
+	var reqID, msg []byte
+	if created {
+		reqID = strconv.AppendUint([]byte(`"proxy_subscribe_`), h.lastID.Add(1), 10)
+		reqID = append(reqID, '"')
+		h.requests[string(reqID)] = shared
+		stream, err = h.openStream()
+
+		msg = append(msg, `{"jsonrpc":"2.0","id":`...)
+		msg = append(msg, reqID...)
+		msg = append(msg, `,"method":"eth_subscribe","params":`...)
+		msg = append(msg, params...)
+		msg = append(msg, '}')
+	}
+	h.lock.Unlock()
+
+	if confirmed {
+		h.confirm(sub)
+		return
+	}
+	if created {
+		if err == nil {
+			err = stream.Send(msg)
+		}
+		if err != nil {
+			h.proxy.logger.Error().Err(err).Str("params", string(params)).Msg("Error creating shared subscription")
+			h.fail(shared, reqID, nil)
+		}
+	}
+	// Otherwise the response to the pending eth_subscribe request confirms the subscriber
+}
+
+// openStream returns the upstream stream of the hub and opens it if necessary, the lock has to be held
+func (h *subscriptionHub) openStream() (UpstreamStream, error) {
+	if h.stream != nil {
+		return h.stream, nil
+	}
+
+	link, err := h.proxy.openUpstream(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	stream := link.stream
+	if s, ok := stream.(*connStream); ok {
+		j := h.proxy
+		s.configure(j.bufferSize, j.maxRead, j.UpstreamPolicy, j.BufferPool, time.Duration(j.Timeouts.Write))
+	}
+	h.stream = stream
+	go h.receive(stream)
+	return stream, nil
+}
+
+// receive handles the messages of the hub stream until it closes
+func (h *subscriptionHub) receive(stream UpstreamStream) {
+	for {
+		msg, err := stream.Receive(context.Background())
+		if err != nil {
+			h.reset(stream, err)
+			return
+		}
+
+		header := parseHeader(msg)
+		switch {
+		case bytes.Equal(header.Method, subscriptionMethod):
+			h.deliver(msg)
+		case len(header.ID) > 0:
+			h.handleResponse(header.ID, msg)
+		}
+	}
+}
+
+// handleResponse confirms or fails the subscription created by the request with the given id.
+// Responses to eth_unsubscribe requests of the hub are ignored.
+func (h *subscriptionHub) handleResponse(id, msg []byte) {
+	h.lock.Lock()
+	shared := h.requests[string(id)]
+	if shared == nil {
+		h.lock.Unlock()
+		return
+	}
+	delete(h.requests, string(id))
+
+	result, err := blzdJson.Field(msg, "result")
+	var upstreamID []byte
+	if err == nil {
+		upstreamID, err = blzdJson.Unquote(result)
+	}
+	if err != nil || len(upstreamID) == 0 {
+		h.lock.Unlock()
+		h.fail(shared, id, msg)
+		return
+	}
+
+	shared.upstreamID = string(upstreamID)
+	subs := make([]*subscriber, 0, len(shared.subscribers))
+	for _, sub := range shared.subscribers {
+		subs = append(subs, sub)
+	}
+	if len(subs) > 0 {
+		h.byUpstreamID[shared.upstreamID] = shared
+	}
+	stream := h.stream
+	h.lock.Unlock()
+
+	if len(subs) == 0 {
+		// Everyone left while the subscription was created
+		h.sendUnsubscribe(stream, shared.upstreamID)
+		return
+	}
+	for _, sub := range subs {
+		h.confirm(sub)
+	}
+}
+
+// confirm answers the eth_subscribe request of sub and starts sending it notifications
+func (h *subscriptionHub) confirm(sub *subscriber) {
+	resp := appendResultResponse(nil, sub.requestID, appendJSONString(nil, sub.id))
+	if err := h.proxy.handleMessage(sub.conn, resp, directionUpstreamToClient); err != nil {
+		h.proxy.logger.Debug().Err(err).Str("connID", sub.connID).Msg("Error writing subscription response")
+		return
+	}
+	sub.ready.Store(true)
+}
+
+// fail detaches all subscribers of a subscription the upstream didn't create and sends them
+// the upstream error response, or an internal error if there is none
+func (h *subscriptionHub) fail(shared *sharedSubscription, reqID []byte, resp []byte) {
+	h.lock.Lock()
+	delete(h.requests, string(reqID))
+	if h.byKey[shared.key] == shared {
+		delete(h.byKey, shared.key)
+	}
+	subs := make([]*subscriber, 0, len(shared.subscribers))
+	for id, sub := range shared.subscribers {
+		delete(h.byClientID, id)
+		subs = append(subs, sub)
+	}
+	shared.subscribers = nil
+	h.lock.Unlock()
+
+	for _, sub := range subs {
+		sub.conn.session.removeShared(sub.id)
+
+		var out []byte
+		if resp != nil {
+			out, _, _ = blzdJson.ReplaceID(nil, resp, sub.requestID)
+		}
+		if out == nil {
+			out = appendErrorResponse(nil, sub.requestID, ErrCodeInternalError, "Internal error")
+		}
+		if err := h.proxy.handleMessage(sub.conn, out, directionUpstreamToClient); err != nil {
+			h.proxy.logger.Debug().Err(err).Str("connID", sub.connID).Msg("Error writing subscription response")
+		}
+	}
+}
+
+// deliver copies a notification to all subscribers of its subscription
+func (h *subscriptionHub) deliver(msg []byte) {
+	paramsStart, paramsEnd, err := blzdJson.FieldRange(msg, "params")
+	if err != nil {
+		return
+	}
+	idStart, idEnd, err := blzdJson.FieldRange(msg[paramsStart:paramsEnd], "subscription")
+	if err != nil {
+		return
+	}
+	idStart, idEnd = paramsStart+idStart, paramsStart+idEnd
+	upstreamID, err := blzdJson.Unquote(msg[idStart:idEnd])
+	if err != nil {
+		return
+	}
+
+	h.lock.Lock()
+	h.recipients = h.recipients[:0]
+	if shared := h.byUpstreamID[string(upstreamID)]; shared != nil {
+		for _, sub := range shared.subscribers {
+			if sub.ready.Load() {
+				h.recipients = append(h.recipients, sub)
+			}
+		}
+	}
+	h.lock.Unlock()
+
+	var out []byte
+	for _, sub := range h.recipients {
+		out = append(out[:0], msg[:idStart]...)
+		out = appendJSONString(out, sub.id)
+		out = append(out, msg[idEnd:]...)
+		if err := h.proxy.sendNotification(sub.connID, sub.conn, out, true); err != nil {
+			h.proxy.logger.Debug().Err(err).Str("connID", sub.connID).Msg("Error writing subscription notification")
+			continue
+		}
+		sub.notifications.Add(1)
+	}
+	clear(h.recipients)
+}
+
+// unsubscribe detaches the client from a shared subscription, it reports false if the
+// subscription id isn't one of the hub so the request is forwarded
+func (h *subscriptionHub) unsubscribe(conn *ProxyConn, requestID []byte, id string) bool {
+	h.lock.Lock()
+	sub := h.byClientID[id]
+	h.lock.Unlock()
+	if sub == nil || sub.conn != conn {
+		return false
+	}
+
+	h.detach(sub)
+	conn.session.removeShared(sub.id)
+	resp := appendResultResponse(nil, requestID, []byte("true"))
+	// Notifications already queued for the subscription are sent first
+	if err := h.proxy.sendResponse(conn, resp); err != nil {
+		h.proxy.logger.Debug().Err(err).Str("connID", sub.connID).Msg("Error writing unsubscribe response")
+	}
+	return true
+}
+
+// detach removes a subscriber and drops the upstream subscription when the last one left
+func (h *subscriptionHub) detach(sub *subscriber) {
+	h.lock.Lock()
+	if h.byClientID[sub.id] != sub {
+		h.lock.Unlock()
+		return
+	}
+	shared := sub.shared
+	delete(h.byClientID, sub.id)
+	delete(shared.subscribers, sub.id)
+
+	drop := len(shared.subscribers) == 0 && shared.upstreamID != ""
+	if len(shared.subscribers) == 0 {
+		if h.byKey[shared.key] == shared {
+			delete(h.byKey, shared.key)
+		}
+		delete(h.byUpstreamID, shared.upstreamID)
+	}
+	stream := h.stream
+	h.lock.Unlock()
+
+	if drop {
+		h.sendUnsubscribe(stream, shared.upstreamID)
+	}
+}
+
+func (h *subscriptionHub) sendUnsubscribe(stream UpstreamStream, upstreamID string) {
+	if stream == nil {
+		return
+	}
+
+	msg := strconv.AppendUint([]byte(`{"jsonrpc":"2.0","id":"proxy_unsubscribe_`), h.lastID.Add(1), 10)
+	msg = append(msg, `","method":"eth_unsubscribe","params":[`...)
+	msg = appendJSONString(msg, upstreamID)
+	msg = append(msg, "]}"...)
+	if err := stream.Send(msg); err != nil {
+		h.proxy.logger.Debug().Err(err).Str("subscription", upstreamID).Msg("Error dropping shared subscription")
+	}
+}
+
+// reset forgets all subscriptions after the hub stream closed. The subscribers are disconnected,
+// their clients have to subscribe again.
+func (h *subscriptionHub) reset(stream UpstreamStream, err error) {
+	stream.Close()
+
+	h.lock.Lock()
+	if h.stream != stream {
+		h.lock.Unlock()
+		return
+	}
+	subs := make([]*subscriber, 0, len(h.byClientID))
+	for _, sub := range h.byClientID {
+		subs = append(subs, sub)
+	}
+	h.stream = nil
+	clear(h.byKey)
+	clear(h.byUpstreamID)
+	clear(h.byClientID)
+	clear(h.requests)
+	h.lock.Unlock()
+
+	h.proxy.logger.Warn().Err(err).Int("subscribers", len(subs)).Msg("Shared subscription upstream closed, disconnecting subscribers")
+	for _, sub := range subs {
+		sub.conn.clientConn.Close()
+	}
+}
+
+// close closes the hub stream, used on shutdown
+func (h *subscriptionHub) close() {
+	h.lock.Lock()
+	stream := h.stream
+	h.stream = nil
+	h.lock.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+}
+
+// stats returns the number of upstream subscriptions and of clients attached to them
+func (h *subscriptionHub) stats() (subscriptions, subscribers int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.byUpstreamID), len(h.byClientID)
+}
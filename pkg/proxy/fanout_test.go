@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// fanoutUpstream is a mock node that reports subscription requests and sends notifications on demand
+type fanoutUpstream struct {
+	socket       string
+	subscribed   chan string // Params of eth_subscribe requests
+	unsubscribed chan string // Params of eth_unsubscribe requests
+
+	lock    sync.Mutex
+	hubConn net.Conn // Connection of the last eth_subscribe request
+}
+
+func startFanoutUpstream(t *testing.T) *fanoutUpstream {
+	u := &fanoutUpstream{
+		subscribed:   make(chan string, 16),
+		unsubscribed: make(chan string, 16),
+	}
+	count := 0
+	issued := map[string]bool{}
+	u.socket = startMockUpstream(t, func(conn net.Conn) {
+		decoder := blzdJson.NewJsonStreamLexer(conn, 4096, 4096, false)
+		for msg, err := range decoder.Messages(context.Background()) {
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     json.RawMessage `json:"id"`
+				Method string          `json:"method"`
+				Params json.RawMessage `json:"params"`
+			}
+			if json.Unmarshal(msg, &req) != nil {
+				continue
+			}
+
+			u.lock.Lock()
+			switch req.Method {
+			case "eth_subscribe":
+				count++
+				u.hubConn = conn
+				issued[fmt.Sprintf(`["0x%d"]`, count)] = true
+				u.subscribed <- string(req.Params)
+				fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":"0x%d"}`+"\n", req.ID, count)
+			case "eth_unsubscribe":
+				// Like a node, only subscriptions it created can be cancelled
+				known := issued[string(req.Params)]
+				if known {
+					u.unsubscribed <- string(req.Params)
+				}
+				fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":%t}`+"\n", req.ID, known)
+			default:
+				fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":null}`+"\n", req.ID)
+			}
+			u.lock.Unlock()
+		}
+	})
+	return u
+}
+
+// notify sends a notification for the upstream subscription id
+func (u *fanoutUpstream) notify(id string, result int) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.hubConn != nil {
+		fmt.Fprintf(u.hubConn, `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":%q,"result":%d}}`+"\n", id, result)
+	}
+}
+
+type fanoutClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialFanoutClient(t *testing.T, socket string) *fanoutClient {
+	conn, err := net.Dial("unix", socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return &fanoutClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// call sends a request and returns the decoded response
+func (c *fanoutClient) call(t *testing.T, request string) map[string]any {
+	_, err := c.conn.Write([]byte(request + "\n"))
+	assert.NoError(t, err)
+	return c.read(t)
+}
+
+func (c *fanoutClient) read(t *testing.T) map[string]any {
+	line, err := c.reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	var msg map[string]any
+	assert.NoError(t, json.Unmarshal(line, &msg))
+	return msg
+}
+
+func TestSharedSubscriptions(t *testing.T) {
+	upstream := startFanoutUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(upstream.socket), WithSharedSubscriptions(true))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	a := dialFanoutClient(t, proxySocket)
+	b := dialFanoutClient(t, proxySocket)
+
+	respA := a.call(t, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)
+	assert.Equal(t, `["newHeads"]`, <-upstream.subscribed)
+	// Same type and params modulo whitespace share the upstream subscription
+	respB := b.call(t, `{"jsonrpc":"2.0","id":"b","method":"eth_subscribe","params":[ "newHeads" ]}`)
+	assert.Equal(t, float64(1), respA["id"])
+	assert.Equal(t, "b", respB["id"])
+	subA, subB := respA["result"].(string), respB["result"].(string)
+	assert.NotEmpty(t, subA)
+	assert.NotEqual(t, subA, subB, "every client gets its own subscription id")
+
+	// Other requests still go to the client's own upstream connection
+	resp := a.call(t, `{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]}`)
+	assert.Equal(t, float64(2), resp["id"])
+
+	upstream.notify("0x1", 7)
+	for client, id := range map[*fanoutClient]string{a: subA, b: subB} {
+		msg := client.read(t)
+		assert.Equal(t, "eth_subscription", msg["method"])
+		assert.Equal(t, map[string]any{"subscription": id, "result": float64(7)}, msg["params"])
+	}
+	assert.Eventually(t, func() bool {
+		subs := b.sessionSubscriptions(proxy)
+		return len(subs) == 1 && subs[0].Shared && subs[0].Notifications == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Unsubscribing only detaches the client
+	resp = a.call(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":3,"method":"eth_unsubscribe","params":[%q]}`, subA))
+	assert.Equal(t, true, resp["result"])
+	resp = a.call(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":4,"method":"eth_unsubscribe","params":[%q]}`, subB))
+	assert.Equal(t, float64(4), resp["id"])
+	assert.NotEqual(t, true, resp["result"], "clients can't unsubscribe others")
+	assert.Empty(t, upstream.unsubscribed)
+
+	upstream.notify("0x1", 8)
+	msg := b.read(t)
+	assert.Equal(t, map[string]any{"subscription": subB, "result": float64(8)}, msg["params"])
+
+	// The upstream subscription is dropped when the last client leaves
+	b.conn.Close()
+	select {
+	case params := <-upstream.unsubscribed:
+		assert.Equal(t, `["0x1"]`, params)
+	case <-time.After(time.Second):
+		t.Fatal("shared subscription wasn't dropped")
+	}
+	assert.Eventually(t, func() bool {
+		subscriptions, subscribers := proxy.hub.stats()
+		return subscriptions == 0 && subscribers == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// A new subscription is created for the next client
+	resp = a.call(t, `{"jsonrpc":"2.0","id":5,"method":"eth_subscribe","params":["newHeads"]}`)
+	assert.Equal(t, `["newHeads"]`, <-upstream.subscribed)
+	assert.NotEqual(t, subA, resp["result"])
+}
+
+func TestSharedSubscriptionSlowClient(t *testing.T) {
+	upstream := startFanoutUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(upstream.socket), WithSharedSubscriptions(true),
+		WithNotificationQueue(NotificationQueue{Size: 256, Policy: QueueBackpressure}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	fast := dialFanoutClient(t, proxySocket)
+	slow := dialFanoutClient(t, proxySocket)
+	fast.call(t, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)
+	<-upstream.subscribed
+	slow.call(t, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)
+
+	// The slow client stops reading, its socket buffers and queue fill up. The notifications are sent
+	// in batches the other client reads before the next one, so only the slow client falls behind.
+	const batches, batch = 100, 100
+	read := make(chan struct{})
+	go func() {
+		for i := range batches * batch {
+			upstream.notify("0x1", i)
+			if i%batch == batch-1 {
+				<-read
+			}
+		}
+	}()
+	fast.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := range batches * batch {
+		params, _ := fast.read(t)["params"].(map[string]any)
+		if !assert.Equal(t, float64(i), params["result"]) {
+			return
+		}
+		if i%batch == batch-1 {
+			read <- struct{}{}
+		}
+	}
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.DroppedClientsCount))
+}
+
+func TestSharedSubscribeAfterDisconnect(t *testing.T) {
+	upstream := startFanoutUpstream(t)
+	proxy, err := New(WithUnixUpstream(upstream.socket), WithSharedSubscriptions(true))
+	assert.NoError(t, err)
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	// The eth_subscribe request is handled after closeSession took the subscriptions of the client
+	conn := &ProxyConn{session: NewSession()}
+	conn.session.takeShared()
+	proxy.hub.subscribe("conn", conn, []byte("1"), []byte(`["newHeads"]`))
+
+	subscriptions, subscribers := proxy.hub.stats()
+	assert.Zero(t, subscriptions)
+	assert.Zero(t, subscribers)
+	assert.Empty(t, conn.session.Subscriptions())
+	select {
+	case params := <-upstream.subscribed:
+		t.Errorf("unexpected upstream subscription %s", params)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// sessionSubscriptions returns the session subscriptions of the proxy connection of the client
+func (c *fanoutClient) sessionSubscriptions(proxy *JsonReverseProxy) []Subscription {
+	var subs []Subscription
+	proxy.activeConnections.Range(func(key, value any) bool {
+		conn := value.(*ProxyConn)
+		if conn.clientConn.RemoteAddr().String() == c.conn.LocalAddr().String() {
+			subs = conn.Session().Subscriptions()
+		}
+		return true
+	})
+	return subs
+}
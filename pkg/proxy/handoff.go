@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables used to pass listening sockets to a new process.
+// LISTEN_FDS, LISTEN_PID and LISTEN_FDNAMES follow the systemd socket activation protocol,
+// ReadyFdEnv is our own addition so an upgrading parent knows when the child accepts connections.
+// ListenOwnerEnv is set by Upgrade if the handed off sockets came from systemd.
+const (
+	ListenFdsEnv     = "LISTEN_FDS"
+	ListenPidEnv     = "LISTEN_PID"
+	ListenFdNamesEnv = "LISTEN_FDNAMES"
+	ReadyFdEnv       = "RPC_RPROXY_READY_FD"
+	ListenOwnerEnv   = "RPC_RPROXY_LISTEN_OWNER"
+
+	// Value of ListenOwnerEnv for sockets owned by systemd
+	listenOwnerSystemd = "systemd"
+
+	// First file descriptor passed by systemd (and by Upgrade)
+	listenFdsStart = 3
+)
+
+// Set by InheritedListeners if systemd owns the inherited sockets, see SystemdSockets
+var systemdSockets bool
+
+// SystemdSockets reports whether the listeners returned by InheritedListeners belong to systemd,
+// passed either by socket activation or by a parent that got them from systemd itself.
+// Their socket files must not be removed then.
+func SystemdSockets() bool {
+	return systemdSockets
+}
+
+// InheritedListeners returns the listeners passed to this process via LISTEN_FDS,
+// either by systemd socket activation or by a parent proxy doing a binary upgrade.
+// It returns no listeners and no error if nothing was inherited.
+// The LISTEN_* variables are removed from the environment so they don't leak into children.
+func InheritedListeners() ([]net.Listener, error) {
+	fdsStr := os.Getenv(ListenFdsEnv)
+	if fdsStr == "" {
+		return nil, nil
+	}
+	pidStr := os.Getenv(ListenPidEnv)
+	names := strings.Split(os.Getenv(ListenFdNamesEnv), ":")
+	owner := os.Getenv(ListenOwnerEnv)
+
+	os.Unsetenv(ListenFdsEnv)
+	os.Unsetenv(ListenPidEnv)
+	os.Unsetenv(ListenFdNamesEnv)
+	os.Unsetenv(ListenOwnerEnv)
+
+	// systemd sets LISTEN_PID to the activated process, a parent doing a handoff
+	// can't know the pid of its child before starting it and leaves it empty.
+	if pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", ListenPidEnv, pidStr, err)
+		}
+		if pid != os.Getpid() {
+			return nil, nil
+		}
+	}
+
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", ListenFdsEnv, fdsStr)
+	}
+
+	files := make([]*os.File, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("listen-fd-%d", listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(listenFdsStart+i), name)
+	}
+
+	listeners, err := fileListeners(files)
+	if err != nil {
+		return nil, err
+	}
+	systemdSockets = pidStr != "" || owner == listenOwnerSystemd
+	return listeners, nil
+}
+
+// fileListeners converts passed file descriptors to listeners and closes the originals
+func fileListeners(files []*os.File) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(files))
+	for _, f := range files {
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %s is not a listening socket: %w", f.Name(), err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// NotifyReady tells a parent process that handed us its listeners that we are accepting connections.
+// It is a no-op if the process wasn't started by Upgrade.
+func NotifyReady() error {
+	fdStr := os.Getenv(ReadyFdEnv)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(ReadyFdEnv)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", ReadyFdEnv, fdStr, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+// Upgrade starts a new instance of the current executable with the same arguments and hands
+// it all listening sockets. It returns once the child called NotifyReady, after that both
+// processes accept connections on the same sockets until the caller stops accepting with
+// StopAccepting and drains its connections.
+func (j *JsonReverseProxy) Upgrade(ctx context.Context) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, len(j.listeners)+1)
+	names := make([]string, 0, len(j.listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, listener := range j.listeners {
+		fl, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %s can't be handed off", listener.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, listener.Addr().String())
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	env := make([]string, 0, len(os.Environ())+4)
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, ListenFdsEnv+"=") ||
+			strings.HasPrefix(e, ListenPidEnv+"=") ||
+			strings.HasPrefix(e, ListenFdNamesEnv+"=") ||
+			strings.HasPrefix(e, ReadyFdEnv+"=") ||
+			strings.HasPrefix(e, ListenOwnerEnv+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	env = append(env,
+		fmt.Sprintf("%s=%d", ListenFdsEnv, len(names)),
+		fmt.Sprintf("%s=%s", ListenFdNamesEnv, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", ReadyFdEnv, listenFdsStart+len(names)),
+	)
+	if systemdSockets {
+		// The child must leave the socket files to systemd as well
+		env = append(env, ListenOwnerEnv+"="+listenOwnerSystemd)
+	}
+
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: procFiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Close our copy of the write end so a dying child results in EOF
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			killProcess(process)
+			return nil, fmt.Errorf("new process exited before it was ready: %w", err)
+		}
+	case <-ctx.Done():
+		killProcess(process)
+		return nil, context.Cause(ctx)
+	}
+
+	j.logger.Info().Int("pid", process.Pid).Int("listeners", len(names)).Msg("Handed listeners to new process")
+	return process, nil
+}
+
+// killProcess stops a child that didn't take over and reaps it, so it doesn't stay a zombie
+func killProcess(process *os.Process) {
+	process.Kill()
+	process.Wait()
+}
+
+// StopAccepting closes all listeners without removing their socket files,
+// so another process sharing them keeps accepting. Active connections stay open.
+func (j *JsonReverseProxy) StopAccepting() {
+	for _, listener := range j.listeners {
+		if ul, ok := listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			j.logger.Error().Err(err).Msg("Error closing listener")
+		}
+	}
+	j.listening = false
+}
+
+// Drain waits until all active connections are closed or the context is done.
+func (j *JsonReverseProxy) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		j.connections.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			j.logger.Info().Int64("active_connections_count", j.ActiveConnectionsCount).Msg("Draining connections")
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Set for the test binary started as the new process of a handoff
+const handoffHelperEnv = "RPC_RPROXY_HANDOFF_HELPER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(handoffHelperEnv) != "" {
+		os.Exit(runHandoffHelper())
+	}
+	os.Exit(m.Run())
+}
+
+// runHandoffHelper accepts one connection on the inherited listener and tells the client
+// who owns the socket
+func runHandoffHelper() int {
+	listeners, err := InheritedListeners()
+	if err != nil || len(listeners) != 1 {
+		fmt.Fprintf(os.Stderr, "got %d inherited listeners: %v\n", len(listeners), err)
+		return 1
+	}
+	if err := NotifyReady(); err != nil {
+		fmt.Fprintf(os.Stderr, "notify ready: %v\n", err)
+		return 1
+	}
+
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "accept: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	owner := "parent"
+	if SystemdSockets() {
+		owner = listenOwnerSystemd
+	}
+	fmt.Fprintln(conn, owner)
+	return 0
+}
+
+// readOwner connects to the socket served by runHandoffHelper
+func readOwner(t *testing.T, socketPath string) string {
+	conn, err := net.Dial("unix", socketPath)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	owner, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	return owner
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Setenv(handoffHelperEnv, "1")
+	defer func() { systemdSockets = false }()
+
+	for _, systemd := range []bool{false, true} {
+		t.Run(fmt.Sprintf("systemd=%t", systemd), func(t *testing.T) {
+			// The child has to keep the socket file if systemd owns it
+			systemdSockets = systemd
+			socketPath := getTempSocketPath()
+			defer os.Remove(socketPath)
+
+			proxy := NewUnixUpstreamJsonRpcProxy(getTempSocketPath(), false, false, 4096, 4096)
+			assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), socketPath))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			process, err := proxy.Upgrade(ctx)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// Only the child accepts now
+			proxy.StopAccepting()
+			owner := "parent\n"
+			if systemd {
+				owner = listenOwnerSystemd + "\n"
+			}
+			assert.Equal(t, owner, readOwner(t, socketPath))
+
+			state, err := process.Wait()
+			assert.NoError(t, err)
+			assert.True(t, state.Success())
+		})
+	}
+}
+
+func TestInheritedListenersSystemd(t *testing.T) {
+	socketPath := getTempSocketPath()
+	defer os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+	defer listener.Close()
+	f, err := listener.(*net.UnixListener).File()
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// Like systemd, the shell sets LISTEN_PID to its own pid before it becomes the test binary
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), handoffHelperEnv+"=1", ListenFdsEnv+"=1", ListenFdNamesEnv+"=rpc")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	assert.NoError(t, cmd.Start())
+
+	assert.Equal(t, listenOwnerSystemd+"\n", readOwner(t, socketPath))
+	assert.NoError(t, cmd.Wait())
+}
+
+func TestInheritedListenersOtherPid(t *testing.T) {
+	t.Setenv(ListenFdsEnv, "1")
+	t.Setenv(ListenPidEnv, strconv.Itoa(os.Getpid()+1))
+
+	listeners, err := InheritedListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, listeners)
+	assert.Empty(t, os.Getenv(ListenFdsEnv))
+}
+
+func TestFileListenersHandoff(t *testing.T) {
+	socketPath := getTempSocketPath()
+	defer os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+
+	f, err := listener.(*net.UnixListener).File()
+	assert.NoError(t, err)
+
+	inherited, err := fileListeners([]*os.File{f})
+	assert.NoError(t, err)
+	assert.Len(t, inherited, 1)
+
+	// The original owner stops accepting, the socket file has to survive it
+	proxy := NewUnixUpstreamJsonRpcProxy(getTempSocketPath(), false, false, 4096, 4096)
+	proxy.AddListener(listener)
+	proxy.StopAccepting()
+	_, err = os.Stat(socketPath)
+	assert.NoError(t, err)
+
+	// The inherited listener still accepts connections
+	go func() {
+		conn, err := inherited[0].Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	client, err := net.Dial("unix", socketPath)
+	assert.NoError(t, err)
+	client.Close()
+	inherited[0].Close()
+}
+
+func TestDrain(t *testing.T) {
+	proxy := NewUnixUpstreamJsonRpcProxy(getTempSocketPath(), false, false, 4096, 4096)
+	assert.NoError(t, proxy.Drain(context.Background()))
+
+	proxy.connections.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, proxy.Drain(ctx), context.DeadlineExceeded)
+
+	proxy.connections.Done()
+	assert.NoError(t, proxy.Drain(context.Background()))
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultIdempotentMethods are read-only methods that can safely be sent to an upstream twice
+var DefaultIdempotentMethods = []string{
+	"eth_blockNumber",
+	"eth_call",
+	"eth_chainId",
+	"eth_estimateGas",
+	"eth_feeHistory",
+	"eth_gasPrice",
+	"eth_getBalance",
+	"eth_getBlockByHash",
+	"eth_getBlockByNumber",
+	"eth_getBlockReceipts",
+	"eth_getCode",
+	"eth_getLogs",
+	"eth_getProof",
+	"eth_getStorageAt",
+	"eth_getTransactionByHash",
+	"eth_getTransactionCount",
+	"eth_getTransactionReceipt",
+	"eth_maxPriorityFeePerGas",
+	"eth_syncing",
+	"net_version",
+	"web3_clientVersion",
+}
+
+// Hedging sends idempotent requests to a second healthy upstream if the first one is slow,
+// the client gets whichever response arrives first. It needs at least two upstreams.
+type Hedging struct {
+	// Time to wait for the primary upstream before the request is hedged
+	Delay Duration `json:"delay,omitempty"`
+	// Derive the delay from the latency of recent idempotent requests instead, e.g. 0.95.
+	// Delay is used until enough latencies were observed.
+	Percentile float64 `json:"percentile,omitempty"`
+}
+
+func (h Hedging) enabled() bool {
+	return h.Delay > 0 || h.Percentile > 0
+}
+
+// latencyTracker keeps the response times of recent requests to derive a hedging delay
+type latencyTracker struct {
+	lock    sync.Mutex
+	samples []time.Duration // Ring buffer
+	next    int
+	full    bool
+	stale   int          // Samples since the percentile was computed
+	value   atomic.Int64 // Cached percentile, 0 until enough samples were seen
+}
+
+const (
+	latencySamples    = 512
+	minLatencySamples = 32
+)
+
+// observe records a latency and recomputes the percentile every minLatencySamples samples
+func (t *latencyTracker) observe(d time.Duration, percentile float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.samples == nil {
+		t.samples = make([]time.Duration, latencySamples)
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % len(t.samples)
+	t.full = t.full || t.next == 0
+
+	t.stale++
+	if t.stale < minLatencySamples {
+		return
+	}
+	t.stale = 0
+
+	n := t.next
+	if t.full {
+		n = len(t.samples)
+	}
+	sorted := slices.Clone(t.samples[:n])
+	slices.Sort(sorted)
+	i := min(int(percentile*float64(n)), n-1)
+	t.value.Store(int64(sorted[i]))
+}
+
+// hedgeDelay returns how long to wait before hedging a request, 0 disables hedging
+func (j *JsonReverseProxy) hedgeDelay() time.Duration {
+	if j.Hedging.Percentile > 0 {
+		if d := time.Duration(j.latency.value.Load()); d > 0 {
+			return d
+		}
+	}
+	return time.Duration(j.Hedging.Delay)
+}
+
+// idempotent reports whether a request with method may be sent more than once
+func (j *JsonReverseProxy) idempotent(method string) bool {
+	_, ok := j.idempotentMethods[method]
+	return ok
+}
+
+// hedge sends the request to the first healthy upstream other than the one of the connection.
+// It returns nil if there is none.
+func (j *JsonReverseProxy) hedge(ctx context.Context, conn *ProxyConn, msg []byte) <-chan callResult {
+	client, probe := j.requestClient(conn.backend())
+	if client == nil {
+		return nil
+	}
+	atomic.AddInt64(&j.HedgedRequestsCount, 1)
+
+	result := make(chan callResult, 1)
+	go func() {
+		resp, err := client.call(ctx, msg, probe)
+		result <- callResult{msg: resp, err: err}
+	}()
+	return result
+}
+
+// requestClient returns the client of the first healthy upstream except exclude, nil if there is none.
+// The circuit breaker probe tag has to be passed to the call.
+func (j *JsonReverseProxy) requestClient(exclude Upstream) (*requestClient, uint64) {
+	j.upstreamLock.Lock()
+	defer j.upstreamLock.Unlock()
+	for _, upstream := range j.upstreams {
+		if upstream == exclude {
+			continue
+		}
+		ok, probe := j.admit(upstream)
+		if !ok {
+			continue
+		}
+		if j.requestClients == nil {
+			j.requestClients = make(map[Upstream]*requestClient)
+		}
+		client, ok := j.requestClients[upstream]
+		if !ok {
+			client = newRequestClient(j, upstream)
+			j.requestClients[upstream] = client
+		}
+		return client, probe
+	}
+	return nil, 0
+}
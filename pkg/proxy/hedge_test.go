@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// startNamedUpstream starts a mock node that answers every request with its name after delay
+func startNamedUpstream(t *testing.T, name string, delay time.Duration) string {
+	return startMockUpstream(t, func(conn net.Conn) {
+		writer := &connWriter{conn: conn}
+		decoder := blzdJson.NewJsonStreamLexer(conn, 4096, 4096, false)
+		for msg, err := range decoder.Messages(context.Background()) {
+			if err != nil {
+				return
+			}
+			id, err := blzdJson.ID(msg)
+			if err != nil {
+				continue
+			}
+			resp := fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":%q}`, id, name)
+			time.AfterFunc(delay, func() { writer.writeMessage(resp, 0) })
+		}
+	})
+}
+
+func TestHedgedRequests(t *testing.T) {
+	slow := startNamedUpstream(t, "slow", 200*time.Millisecond)
+	fast := startNamedUpstream(t, "fast", 0)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(slow), WithUnixUpstream(fast), WithHedging(Hedging{Delay: Duration(20 * time.Millisecond)}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+
+	call := func(method string, id int) string {
+		_, err := fmt.Fprintf(client, `{"jsonrpc":"2.0","method":%q,"params":[],"id":%d}`+"\n", method, id)
+		assert.NoError(t, err)
+		line, err := reader.ReadBytes('\n')
+		assert.NoError(t, err)
+		var resp struct {
+			ID     int    `json:"id"`
+			Result string `json:"result"`
+		}
+		assert.NoError(t, json.Unmarshal(line, &resp))
+		assert.Equal(t, id, resp.ID)
+		return resp.Result
+	}
+
+	// The slow primary is overtaken by the second upstream, with the client's id restored
+	assert.Equal(t, "fast", call("eth_call", 1))
+	assert.Equal(t, "fast", call("eth_getBalance", 2))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&proxy.HedgedRequestsCount))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&proxy.HedgeWinsCount))
+
+	// Methods that aren't idempotent are only sent once
+	assert.Equal(t, "slow", call("eth_sendRawTransaction", 3))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&proxy.HedgedRequestsCount))
+}
+
+func TestLatencyTrackerPercentile(t *testing.T) {
+	var tracker latencyTracker
+	for i := 1; i < minLatencySamples; i++ {
+		tracker.observe(time.Duration(i)*time.Millisecond, 0.9)
+	}
+	assert.Zero(t, tracker.value.Load(), "no delay before enough samples were seen")
+
+	for i := minLatencySamples; i <= 100; i++ {
+		tracker.observe(time.Duration(i)*time.Millisecond, 0.9)
+	}
+	// Computed after 96 samples
+	assert.Equal(t, 87*time.Millisecond, time.Duration(tracker.value.Load()))
+
+	// Old samples leave the ring buffer
+	for range latencySamples {
+		tracker.observe(time.Second, 0.9)
+	}
+	assert.Equal(t, time.Second, time.Duration(tracker.value.Load()))
+}
@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// LimitPolicy decides what happens to new connections when a connection limit is reached
+type LimitPolicy int
+
+const (
+	// LimitQueue stops accepting (global limit) or holds the new connection (peer limit) until a slot is free
+	LimitQueue LimitPolicy = iota
+	// LimitReject closes new connections immediately
+	LimitReject
+	// LimitEvictIdle closes the connection that was idle the longest to make room. Connections waiting
+	// for a response aren't idle, oversized responses aren't streamed so every one of them is counted.
+	LimitEvictIdle
+)
+
+var limitPolicyNames = map[LimitPolicy]string{
+	LimitQueue:     "queue",
+	LimitReject:    "reject",
+	LimitEvictIdle: "evict-idle",
+}
+
+func (p LimitPolicy) String() string {
+	if name, ok := limitPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("LimitPolicy(%d)", int(p))
+}
+
+// ParseLimitPolicy returns the policy for one of "queue", "reject" or "evict-idle"
+func ParseLimitPolicy(s string) (LimitPolicy, error) {
+	for policy, name := range limitPolicyNames {
+		if name == s {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown limit policy %q", s)
+}
+
+func (p LimitPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *LimitPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseLimitPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// ConnectionLimits caps the number of client connections, zero values mean unlimited.
+// Every client connection also holds its own upstream connection.
+type ConnectionLimits struct {
+	Max        int         `json:"max,omitempty"`
+	MaxPerPeer int         `json:"maxPerPeer,omitempty"`
+	Policy     LimitPolicy `json:"policy"`
+}
+
+func (l ConnectionLimits) enabled() bool {
+	return l.Max > 0 || l.MaxPerPeer > 0
+}
+
+// connLimiter counts connections globally and per peer
+type connLimiter struct {
+	limits ConnectionLimits
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	total   int
+	perPeer map[string]int
+	closed  bool
+}
+
+func newConnLimiter(limits ConnectionLimits) *connLimiter {
+	l := &connLimiter{
+		limits:  limits,
+		perPeer: make(map[string]int),
+	}
+	l.cond = sync.NewCond(&l.lock)
+	return l
+}
+
+// full reports which limit a new connection from peer would exceed, "" if none
+func (l *connLimiter) full(peer string) string {
+	if l.limits.Max > 0 && l.total >= l.limits.Max {
+		return "global"
+	}
+	if l.limits.MaxPerPeer > 0 && l.perPeer[peer] >= l.limits.MaxPerPeer {
+		return "peer"
+	}
+	return ""
+}
+
+// tryAcquire takes a slot for peer if one is free and returns the exceeded limit otherwise
+func (l *connLimiter) tryAcquire(peer string) (limit string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limit = l.full(peer); limit == "" {
+		l.add(peer)
+	}
+	return limit
+}
+
+// acquire blocks until a slot for peer is free, it returns false if the limiter was closed
+func (l *connLimiter) acquire(peer string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for !l.closed && l.full(peer) != "" {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return false
+	}
+	l.add(peer)
+	return true
+}
+
+// waitGlobal blocks while the global limit is reached, it returns false if the limiter was closed
+func (l *connLimiter) waitGlobal() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for !l.closed && l.limits.Max > 0 && l.total >= l.limits.Max {
+		l.cond.Wait()
+	}
+	return !l.closed
+}
+
+func (l *connLimiter) add(peer string) {
+	l.total++
+	l.perPeer[peer]++
+}
+
+func (l *connLimiter) release(peer string) {
+	l.lock.Lock()
+	l.total--
+	if l.perPeer[peer] <= 1 {
+		delete(l.perPeer, peer)
+	} else {
+		l.perPeer[peer]--
+	}
+	l.lock.Unlock()
+	l.cond.Broadcast()
+}
+
+// transfer hands the slot of a connection from one peer to another without freeing it
+func (l *connLimiter) transfer(from, to string) {
+	l.lock.Lock()
+	if l.perPeer[from] <= 1 {
+		delete(l.perPeer, from)
+	} else {
+		l.perPeer[from]--
+	}
+	l.perPeer[to]++
+	l.lock.Unlock()
+	l.cond.Broadcast()
+}
+
+// isClosed reports whether the limiter stopped admitting connections
+func (l *connLimiter) isClosed() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.closed
+}
+
+// close wakes up all waiting connections, they will be rejected
+func (l *connLimiter) close() {
+	l.lock.Lock()
+	l.closed = true
+	l.lock.Unlock()
+	l.cond.Broadcast()
+}
+
+// admitConnection applies the connection limits to a newly accepted connection and starts handling it
+func (j *JsonReverseProxy) admitConnection(conn net.Conn, framing blzdJson.Framing) {
+	peer := peerIdentity(conn)
+	if j.limiter == nil {
+		j.connections.Add(1)
+		go j.handleConnection(conn, peer, framing)
+		return
+	}
+
+	limit := j.limiter.tryAcquire(peer)
+	if limit == "" {
+		j.connections.Add(1)
+		go j.handleConnection(conn, peer, framing)
+		return
+	}
+
+	switch j.Limits.Policy {
+	case LimitQueue:
+		j.logger.Debug().Str("peer", peer).Str("limit", limit).Msg("Connection limit reached, queueing connection")
+		j.connections.Add(1)
+		go func() {
+			if !j.limiter.acquire(peer) {
+				j.connections.Done()
+				j.rejectConnection(conn, peer, limit)
+				return
+			}
+			j.handleConnection(conn, peer, framing)
+		}()
+	case LimitEvictIdle:
+		evictPeer := ""
+		if limit == "peer" {
+			evictPeer = peer
+		}
+		handoff := j.evictIdleConnection(evictPeer, peer)
+		if handoff == nil {
+			j.rejectConnection(conn, peer, limit)
+			return
+		}
+		// The evicted connection passes its slot on once it is torn down, the limit is never exceeded
+		j.connections.Add(1)
+		go func() {
+			<-handoff.done
+			if j.limiter.isClosed() {
+				j.limiter.release(peer)
+				j.connections.Done()
+				j.rejectConnection(conn, peer, limit)
+				return
+			}
+			j.handleConnection(conn, peer, framing)
+		}()
+	default:
+		j.rejectConnection(conn, peer, limit)
+	}
+}
+
+func (j *JsonReverseProxy) rejectConnection(conn net.Conn, peer string, limit string) {
+	atomic.AddInt64(&j.RejectedConnectionsCount, 1)
+	j.logger.Warn().
+		Str("peer", peer).
+		Str("limit", limit).
+		Int("max", j.Limits.Max).
+		Int("max_per_peer", j.Limits.MaxPerPeer).
+		Msg("Connection limit reached, rejecting connection")
+	conn.Close()
+}
+
+// slotHandoff passes the limiter slot of an evicted connection to the connection that evicted it
+type slotHandoff struct {
+	peer string        // Peer of the new connection
+	done chan struct{} // Closed once the slot belongs to the new connection
+}
+
+// slotReleased marks a connection that gave its slot back, it can't be evicted anymore
+var slotReleased = &slotHandoff{}
+
+// idle reports whether a connection can be evicted without losing work: it has no requests
+// in flight and no subscriptions
+func (c *ProxyConn) idle() bool {
+	return c.pending.len() == 0 && c.inFlight.Load() == 0 &&
+		!c.session.holdsSubscriptions() && len(c.session.Subscriptions()) == 0
+}
+
+// countRequest counts a client request that expects a response, notifications and batches aren't counted
+func (c *ProxyConn) countRequest(msg []byte) {
+	header := parseHeader(msg)
+	if len(header.ID) > 0 && !bytes.Equal(header.ID, nullID) {
+		c.inFlight.Add(1)
+	}
+}
+
+// countResponse counts an upstream response, unsolicited ones like parse errors can't go below zero
+func (c *ProxyConn) countResponse(msg []byte) {
+	header := parseHeader(msg)
+	if len(header.ID) == 0 || len(header.Method) != 0 || bytes.Equal(header.ID, nullID) {
+		return
+	}
+	for {
+		n := c.inFlight.Load()
+		if n == 0 || c.inFlight.CompareAndSwap(n, n-1) {
+			return
+		}
+	}
+}
+
+// releaseSlot gives the limiter slot of a finished connection back or hands it to the connection that evicted it
+func (j *JsonReverseProxy) releaseSlot(peer string, conn *ProxyConn) {
+	if conn == nil || conn.evictedBy.CompareAndSwap(nil, slotReleased) {
+		j.limiter.release(peer)
+		return
+	}
+	handoff := conn.evictedBy.Load()
+	j.limiter.transfer(peer, handoff.peer)
+	close(handoff.done)
+}
+
+// evictIdleConnection closes the idle connection with the oldest activity, only considering
+// connections of peer if it isn't empty. Connections already being evicted are skipped. It
+// returns the handoff of the evicted connection's slot to newPeer, nil if nothing was evicted.
+func (j *JsonReverseProxy) evictIdleConnection(peer string, newPeer string) *slotHandoff {
+	handoff := &slotHandoff{peer: newPeer, done: make(chan struct{})}
+	var (
+		oldestID   string
+		oldest     *ProxyConn
+		oldestTime int64
+	)
+	for {
+		oldest = nil
+		j.activeConnections.Range(func(key, value interface{}) bool {
+			conn := value.(*ProxyConn)
+			if peer != "" && conn.peer != peer {
+				return true
+			}
+			if conn.evictedBy.Load() != nil || !conn.idle() {
+				return true
+			}
+			if last := conn.lastActivity.Load(); oldest == nil || last < oldestTime {
+				oldestID, oldest, oldestTime = key.(string), conn, last
+			}
+			return true
+		})
+		if oldest == nil {
+			return nil
+		}
+		// Another new connection or the teardown may have claimed it in the meantime
+		if oldest.evictedBy.CompareAndSwap(nil, handoff) {
+			break
+		}
+	}
+
+	atomic.AddInt64(&j.EvictedConnectionsCount, 1)
+	j.logger.Warn().
+		Str("connID", oldestID).
+		Str("peer", oldest.peer).
+		Int64("idle_ms", (time.Now().UnixNano()-oldestTime)/1e6).
+		Msg("Connection limit reached, evicting idle connection")
+	oldest.clientConn.Close()
+	oldest.upstream().Close()
+	return handoff
+}
+
+// remotePeerIdentity identifies a peer by its address, without the port for IP connections
+func remotePeerIdentity(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil || addr.String() == "" {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startLimitedProxy(t *testing.T, limits ConnectionLimits, onConnect func(string, *ProxyConn)) (*JsonReverseProxy, string) {
+	t.Helper()
+	upstreamSocket := startSilentUpstream(t)
+	proxySocket := getTempSocketPath()
+	t.Cleanup(func() { os.Remove(proxySocket) })
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Limits = limits
+	proxy.OnConnect = onConnect
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	t.Cleanup(proxy.Shutdown)
+
+	return proxy, proxySocket
+}
+
+// waitForConnections waits until the proxy handles n connections
+func waitForConnections(t *testing.T, proxy *JsonReverseProxy, n int64) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&proxy.ActiveConnectionsCount) == n
+	}, time.Second, time.Millisecond)
+}
+
+// assertClosedByProxy checks that the proxy closes the client connection
+func assertClosedByProxy(t *testing.T, client net.Conn) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := client.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestConnectionLimitReject(t *testing.T) {
+	proxy, proxySocket := startLimitedProxy(t, ConnectionLimits{Max: 1, Policy: LimitReject}, nil)
+
+	first, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer first.Close()
+	waitForConnections(t, proxy, 1)
+
+	second, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer second.Close()
+	assertClosedByProxy(t, second)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.RejectedConnectionsCount))
+}
+
+func TestConnectionLimitPerPeerEvictIdle(t *testing.T) {
+	proxy, proxySocket := startLimitedProxy(t, ConnectionLimits{MaxPerPeer: 1, Policy: LimitEvictIdle}, nil)
+
+	first, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer first.Close()
+	waitForConnections(t, proxy, 1)
+
+	second, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer second.Close()
+
+	assertClosedByProxy(t, first)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.EvictedConnectionsCount))
+	waitForConnections(t, proxy, 1)
+}
+
+func TestConnectionLimitEvictIdleStorm(t *testing.T) {
+	proxy, proxySocket := startLimitedProxy(t, ConnectionLimits{Max: 2, Policy: LimitEvictIdle}, nil)
+
+	// Every new connection evicts a different one, the limit holds while the victims shut down
+	var peak atomic.Int64
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			proxy.limiter.lock.Lock()
+			if total := int64(proxy.limiter.total); total > peak.Load() {
+				peak.Store(total)
+			}
+			proxy.limiter.lock.Unlock()
+		}
+	}()
+
+	for range 20 {
+		conn, err := net.Dial("unix", proxySocket)
+		assert.NoError(t, err)
+		defer conn.Close()
+	}
+	waitForConnections(t, proxy, 2)
+	assert.LessOrEqual(t, peak.Load(), int64(2))
+	assert.Equal(t, int64(18), atomic.LoadInt64(&proxy.EvictedConnectionsCount)+atomic.LoadInt64(&proxy.RejectedConnectionsCount))
+}
+
+func TestConnectionLimitEvictIdleSkipsBusy(t *testing.T) {
+	// Requests are tracked with a timeout, the silent upstream never answers
+	proxySocket := getTempSocketPath()
+	t.Cleanup(func() { os.Remove(proxySocket) })
+	proxy, err := New(WithUnixUpstream(startSilentUpstream(t)),
+		WithConnectionLimits(ConnectionLimits{Max: 1, Policy: LimitEvictIdle}),
+		WithTimeouts(Timeouts{Request: Duration(time.Minute)}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	t.Cleanup(proxy.Shutdown)
+
+	busy, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer busy.Close()
+	waitForConnections(t, proxy, 1)
+	_, err = busy.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		var pending int
+		proxy.activeConnections.Range(func(key, value any) bool {
+			pending += value.(*ProxyConn).pending.len()
+			return true
+		})
+		return pending == 1
+	}, time.Second, time.Millisecond)
+
+	second, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer second.Close()
+	assertClosedByProxy(t, second)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&proxy.EvictedConnectionsCount))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.RejectedConnectionsCount))
+}
+
+func TestConnectionLimitEvictIdleCountsRequests(t *testing.T) {
+	// Without timeouts or middlewares requests are only counted, eth_slow is never answered
+	upstreamSocket := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		if method == "eth_slow" {
+			return []byte{}
+		}
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":"0x1"}`, id)
+	})
+	proxySocket := getTempSocketPath()
+	t.Cleanup(func() { os.Remove(proxySocket) })
+	proxy, err := New(WithUnixUpstream(upstreamSocket),
+		WithConnectionLimits(ConnectionLimits{Max: 1, Policy: LimitEvictIdle}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	t.Cleanup(proxy.Shutdown)
+
+	busy, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer busy.Close()
+	waitForConnections(t, proxy, 1)
+	var conn *ProxyConn
+	proxy.activeConnections.Range(func(key, value any) bool {
+		conn = value.(*ProxyConn)
+		return false
+	})
+
+	// An answered request leaves the connection idle
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = busy.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	readResponses(t, bufio.NewReader(busy), 1)
+	assert.True(t, conn.idle())
+
+	_, err = busy.Write([]byte(`{"jsonrpc":"2.0","method":"eth_slow","params":[],"id":2}` + "\n"))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return !conn.idle() }, time.Second, time.Millisecond)
+
+	second, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer second.Close()
+	assertClosedByProxy(t, second)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&proxy.EvictedConnectionsCount))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.RejectedConnectionsCount))
+}
+
+func TestConnectionLimitQueue(t *testing.T) {
+	var connects atomic.Int64
+	proxy, proxySocket := startLimitedProxy(t, ConnectionLimits{Max: 1, Policy: LimitQueue}, func(string, *ProxyConn) {
+		connects.Add(1)
+	})
+
+	first, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	waitForConnections(t, proxy, 1)
+
+	// The second connection waits in the listen backlog until the first one is gone
+	second, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer second.Close()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int64(1), connects.Load())
+
+	first.Close()
+	assert.Eventually(t, func() bool {
+		return connects.Load() == 2
+	}, time.Second, time.Millisecond)
+	waitForConnections(t, proxy, 1)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&proxy.RejectedConnectionsCount))
+}
+
+func TestParseLimitPolicy(t *testing.T) {
+	for _, policy := range []LimitPolicy{LimitQueue, LimitReject, LimitEvictIdle} {
+		text, err := policy.MarshalText()
+		assert.NoError(t, err)
+
+		var parsed LimitPolicy
+		assert.NoError(t, parsed.UnmarshalText(text))
+		assert.Equal(t, policy, parsed)
+	}
+
+	_, err := ParseLimitPolicy("drop")
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// LocalFunc answers a request in process. params is the raw JSON params value, nil if the request
+// has none. The result is encoded with encoding/json unless it is already a json.RawMessage.
+// Returning an *RPCError sends it to the client, other errors become internal errors.
+type LocalFunc func(ctx context.Context, req *Request, params json.RawMessage) (any, error)
+
+// RPCError is a JSON-RPC error a LocalFunc can return to answer with a specific code
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// LocalHandlers is a middleware that answers registered methods without an upstream round trip,
+// e.g. eth_chainId or the proxy's own methods. Other methods are passed on to the upstream.
+// Batches are always forwarded.
+type LocalHandlers struct {
+	lock     sync.RWMutex
+	handlers map[string]LocalFunc
+}
+
+func NewLocalHandlers() *LocalHandlers {
+	return &LocalHandlers{handlers: make(map[string]LocalFunc)}
+}
+
+// Register serves method with fn, a later registration for the same method replaces it
+func (h *LocalHandlers) Register(method string, fn LocalFunc) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.handlers[method] = fn
+}
+
+// Unregister sends method to the upstream again
+func (h *LocalHandlers) Unregister(method string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.handlers, method)
+}
+
+func (h *LocalHandlers) lookup(method string) LocalFunc {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.handlers[method]
+}
+
+func (h *LocalHandlers) Handle(ctx context.Context, req *Request, next Handler) (*Response, error) {
+	fn := h.lookup(req.Method)
+	if fn == nil {
+		return next(ctx, req)
+	}
+
+	params, err := blzdJson.Field(req.Message, "params")
+	if err != nil && !errors.Is(err, blzdJson.ErrFieldNotFound) {
+		return NewErrorResponse(req, ErrCodeInvalidRequest, "Invalid request: "+err.Error()), nil
+	}
+
+	result, err := fn(ctx, req, params)
+	if len(req.ID) == 0 {
+		return nil, nil // Notifications don't get a response, not even for errors
+	}
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return NewErrorResponse(req, rpcErr.Code, rpcErr.Message), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, ok := result.(json.RawMessage)
+	if !ok {
+		if raw, err = json.Marshal(result); err != nil {
+			return nil, fmt.Errorf("encoding result of %s: %w", req.Method, err)
+		}
+	}
+	return NewResultResponse(req, raw), nil
+}
+
+// NewResultResponse creates a JSON-RPC response for req with the raw JSON result
+func NewResultResponse(req *Request, result []byte) *Response {
+	return &Response{Message: appendResultResponse(nil, req.ID, result)}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalHandlers(t *testing.T) {
+	upstreamSocket := startEchoUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	local := NewLocalHandlers()
+	local.Register("eth_chainId", func(ctx context.Context, req *Request, params json.RawMessage) (any, error) {
+		return "0x1", nil
+	})
+	local.Register("proxy_echo", func(ctx context.Context, req *Request, params json.RawMessage) (any, error) {
+		return params, nil
+	})
+	local.Register("proxy_denied", func(ctx context.Context, req *Request, params json.RawMessage) (any, error) {
+		return nil, &RPCError{Code: ErrCodeMethodNotFound, Message: "denied"}
+	})
+	local.Register("proxy_fail", func(ctx context.Context, req *Request, params json.RawMessage) (any, error) {
+		return nil, errors.New("broken")
+	})
+
+	proxy, err := New(WithUnixUpstream(upstreamSocket), WithMiddleware(local))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":"a"}` +
+		`{"jsonrpc":"2.0","method":"proxy_echo","params":{"x":[1,2]},"id":2}` +
+		`{"jsonrpc":"2.0","method":"proxy_denied","id":3}` +
+		`{"jsonrpc":"2.0","method":"proxy_fail","id":4}` +
+		`{"jsonrpc":"2.0","method":"proxy_echo","params":[]}` +
+		`{"jsonrpc":"2.0","method":"eth_call","params":["upstream"],"id":5}` + "\n"))
+	assert.NoError(t, err)
+
+	responses := map[string]string{}
+	reader := bufio.NewReader(client)
+	for range 5 {
+		line, err := reader.ReadBytes('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		id, err := blzdJson.ID(line)
+		assert.NoError(t, err)
+		responses[string(id)] = string(bytes.TrimSpace(line))
+	}
+
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":"a","result":"0x1"}`, responses[`"a"`])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":{"x":[1,2]}}`, responses["2"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"denied"}}`, responses["3"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":4,"error":{"code":-32603,"message":"Internal error"}}`, responses["4"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":5,"result":["upstream"]}`, responses["5"])
+
+	// Unregistered methods go to the upstream again
+	local.Unregister("eth_chainId")
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_chainId","params":["node"],"id":6}` + "\n"))
+	assert.NoError(t, err)
+	line, err := reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":6,"result":["node"]}`, string(line))
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// Request is a client message passing the middleware chain. Middlewares may replace Message
+// to rewrite the request, ID and Method are parsed from the message as it was received.
+// The response the client gets always carries ID, even if a middleware changed the id.
+type Request struct {
+	ConnID  string
+	Conn    *ProxyConn
+	ID      []byte // Raw JSON id, empty for notifications and batches
+	Method  string
+	Message []byte
+
+	sent     chan struct{} // Closed once the request was passed to the upstream
+	sentOnce sync.Once
+	answered chan struct{} // Closed once the response was written to the client or dropped
+}
+
+// markSent lets the connection go on with its next request
+func (r *Request) markSent() {
+	if r.sent != nil {
+		r.sentOnce.Do(func() { close(r.sent) })
+	}
+}
+
+// Response is the message the client gets for a request, Message may be replaced by middlewares.
+// Notifications and batches have no response when they reach the end of the chain.
+type Response struct {
+	Message []byte
+}
+
+// Handler processes a request and returns the response for the client
+type Handler func(ctx context.Context, req *Request) (*Response, error)
+
+// Middleware intercepts client requests before they are forwarded to the upstream. Calling next
+// passes the request on and returns the upstream response, a middleware can also answer the request
+// itself without calling next. Returning an error sends an internal error response to the client.
+//
+// Middlewares run synchronously in the order they are configured. The requests of a connection reach
+// the upstream in the order they were received: the next request enters the chain once the previous
+// one was sent or answered, only waiting for the upstream response happens concurrently.
+type Middleware interface {
+	Handle(ctx context.Context, req *Request, next Handler) (*Response, error)
+}
+
+// MiddlewareFunc adapts a function to the Middleware interface
+type MiddlewareFunc func(ctx context.Context, req *Request, next Handler) (*Response, error)
+
+func (f MiddlewareFunc) Handle(ctx context.Context, req *Request, next Handler) (*Response, error) {
+	return f(ctx, req, next)
+}
+
+// NewErrorResponse creates a JSON-RPC error response for req, e.g. to reject it in a middleware
+func NewErrorResponse(req *Request, code int, message string) *Response {
+	return &Response{Message: appendErrorResponse(nil, req.ID, code, message)}
+}
+
+// errDuplicateID is returned for requests reusing the id of a request that is still in flight
+var errDuplicateID = errors.New("request id is already in flight")
+
+// chain builds a handler that passes requests through the middlewares in order and then to final
+func chain(middlewares []Middleware, final Handler) Handler {
+	handler := final
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		middleware, next := middlewares[i], handler
+		handler = func(ctx context.Context, req *Request) (*Response, error) {
+			return middleware.Handle(ctx, req, next)
+		}
+	}
+	return handler
+}
+
+// handleRequest runs a client message through the middleware chain and sends the response to the client.
+// It returns once the message was sent to the upstream or answered, the response is awaited in the background.
+func (j *JsonReverseProxy) handleRequest(ctx context.Context, connID string, conn *ProxyConn, msg []byte) {
+	header := parseHeader(msg)
+
+	// The lexer buffer is reused as soon as the callback returns
+	req := &Request{
+		ConnID:   connID,
+		Conn:     conn,
+		ID:       bytes.Clone(header.ID),
+		Method:   string(header.Method),
+		Message:  bytes.Clone(msg),
+		sent:     make(chan struct{}),
+		answered: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(req.answered)
+		resp, err := j.handler(ctx, req)
+		if ctx.Err() != nil {
+			return // The connection is gone
+		}
+		if err != nil {
+			j.logger.Error().Err(err).Str("connID", connID).Str("method", req.Method).Msg("Error handling request")
+			resp = NewErrorResponse(req, ErrCodeInternalError, "Internal error")
+		}
+		if resp == nil {
+			return
+		}
+		if len(j.Middlewares) > 0 && len(req.ID) > 0 {
+			resp.Message = restoreID(resp.Message, req.ID)
+		}
+
+		if err := j.sendResponse(conn, resp.Message); err != nil {
+			j.logger.Debug().Err(err).Str("connID", connID).Msg("Error writing response")
+			return
+		}
+		if j.OnResponse != nil {
+			go j.OnResponse(connID, conn, resp.Message)
+		}
+	}()
+
+	select {
+	case <-req.sent:
+	case <-req.answered:
+	case <-ctx.Done():
+	}
+}
+
+// restoreID gives the client back the id it sent if a middleware rewrote it, like multiplexing does.
+// Messages without a valid id, e.g. batch responses, are returned as they are.
+func restoreID(msg, clientID []byte) []byte {
+	id, err := blzdJson.ID(msg)
+	if err != nil || bytes.Equal(id, clientID) {
+		return msg
+	}
+	out, _, err := blzdJson.ReplaceID(nil, msg, clientID)
+	if err != nil {
+		return msg
+	}
+	return out
+}
+
+// forwardRequest is the end of the middleware chain, it sends the request to the upstream
+// and waits for the response with the same id. Idempotent requests may be hedged and retried.
+func (j *JsonReverseProxy) forwardRequest(ctx context.Context, req *Request) (*Response, error) {
+	conn := req.Conn
+	defer req.markSent()
+	if j.hub != nil && j.hub.handle(req.ConnID, conn, req.Message) {
+		// The hub answers the client itself, so the response can't overtake notifications
+		return nil, nil
+	}
+
+	// Middlewares may have rewritten the id
+	header := parseHeader(req.Message)
+	if len(header.ID) == 0 || bytes.Equal(header.ID, nullID) {
+		// Notifications don't get a response, batch responses are forwarded as they arrive
+		return nil, j.handleMessage(conn, req.Message, directionClientToUpstream)
+	}
+
+	id := bytes.Clone(header.ID)
+	pending := conn.pending.await(id, req.Method, req.answered)
+	if pending == nil {
+		return nil, errDuplicateID
+	}
+	defer func() {
+		if conn.pending.cancel(id, pending) {
+			// Timed out, or answered by a hedged or retried request
+			conn.forgetRequest(id)
+		}
+	}()
+
+	idempotent := j.idempotent(req.Method)
+	// A broken or reconnecting upstream fails the send, idempotent requests are retried as if
+	// the upstream broke after it got them
+	sendErr := j.handleMessage(conn, req.Message, directionClientToUpstream)
+	req.markSent()
+	if sendErr != nil {
+		if !idempotent || !j.Retry.enabled() {
+			return nil, sendErr
+		}
+		j.logger.Debug().Err(sendErr).Str("connID", req.ConnID).Str("method", req.Method).Msg("Error sending request")
+	}
+
+	sentAt := time.Now()
+	var timeout <-chan time.Time
+	if d := j.Timeouts.requestTimeout(req.Method); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var hedge <-chan time.Time
+	if idempotent && j.Hedging.enabled() && sendErr == nil {
+		if d := j.hedgeDelay(); d > 0 {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			hedge = timer.C
+		}
+	}
+	// Stops hedged and retried requests still in flight
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The primary response is nil if the upstream broke. Requests sent through a requestClient
+	// are tracked as well, at most one hedge and one retry are in flight.
+	primary := pending.response
+	var hedged, retried <-chan callResult
+	var retryAt <-chan time.Time
+	attempts := 0
+	// scheduleRetry reports false if the request can't be retried
+	scheduleRetry := func() bool {
+		if !idempotent || attempts >= j.Retry.Attempts || retryAt != nil || retried != nil {
+			return false
+		}
+		attempts++
+		atomic.AddInt64(&j.RetriedRequestsCount, 1)
+		retryAt = time.After(j.Retry.backoff(attempts))
+		return true
+	}
+	if sendErr != nil {
+		primary = nil
+		scheduleRetry()
+	}
+
+	for {
+		var msg []byte
+		select {
+		case msg = <-primary:
+			primary = nil
+			if msg != nil && !j.Retry.retryable(msg) {
+				if idempotent && j.Hedging.Percentile > 0 {
+					j.latency.observe(time.Since(sentAt), j.Hedging.Percentile)
+				}
+				return &Response{Message: msg}, nil
+			}
+			// The upstream broke (nil) or returned a retryable error
+		case <-hedge:
+			hedge = nil
+			hedged = j.hedge(ctx, conn, req.Message)
+			continue
+		case result := <-hedged:
+			hedged = nil
+			if result.err == nil && !j.Retry.retryable(result.msg) {
+				atomic.AddInt64(&j.HedgeWinsCount, 1)
+				return &Response{Message: result.msg}, nil
+			}
+			if result.err != nil {
+				j.logger.Debug().Err(result.err).Str("connID", req.ConnID).Str("method", req.Method).Msg("Hedged request failed")
+			}
+			msg = result.msg
+		case <-retryAt:
+			retryAt = nil
+			retried = j.retry(ctx, conn, req.Message)
+			continue
+		case result := <-retried:
+			retried = nil
+			if result.err == nil && !j.Retry.retryable(result.msg) {
+				return &Response{Message: result.msg}, nil
+			}
+			if result.err != nil {
+				j.logger.Debug().Err(result.err).Str("connID", req.ConnID).Str("method", req.Method).Msg("Retried request failed")
+			}
+			msg = result.msg
+		case <-timeout:
+			j.logger.Warn().
+				Str("connID", req.ConnID).
+				Str("method", req.Method).
+				RawJSON("id", id).
+				Dur("timeout", j.Timeouts.requestTimeout(req.Method)).
+				Msg("Upstream request timed out")
+			link := conn.link.Load()
+			j.recordFailure(link.backend, link.probe, "request timed out")
+			return &Response{Message: appendErrorResponse(nil, id, ErrCodeTimeout, "upstream request timed out")}, nil
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+
+		// A request failed, retry it or wait for the others
+		if scheduleRetry() || primary != nil || hedged != nil || retried != nil || retryAt != nil {
+			continue
+		}
+		if msg == nil {
+			msg = appendErrorResponse(nil, id, ErrCodeUpstreamClosed, "upstream connection lost")
+		}
+		return &Response{Message: msg}, nil
+	}
+}
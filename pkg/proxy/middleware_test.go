@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// startEchoUpstream starts a mock node that answers every request with its params as result
+func startEchoUpstream(t *testing.T) string {
+	return startMockUpstream(t, func(conn net.Conn) {
+		decoder := blzdJson.NewJsonStreamLexer(conn, 4096, 4096, false)
+		for msg, err := range decoder.Messages(context.Background()) {
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     json.RawMessage `json:"id"`
+				Params json.RawMessage `json:"params"`
+			}
+			if json.Unmarshal(msg, &req) != nil || req.ID == nil {
+				continue
+			}
+			fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":%s}`+"\n", req.ID, req.Params)
+		}
+	})
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	upstreamSocket := startEchoUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	var lock sync.Mutex
+	var calls []string
+	record := func(name string) {
+		lock.Lock()
+		calls = append(calls, name)
+		lock.Unlock()
+	}
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Middlewares = []Middleware{
+		// Auth: answers locally without calling next
+		MiddlewareFunc(func(ctx context.Context, req *Request, next Handler) (*Response, error) {
+			record("auth " + req.Method)
+			if req.Method == "admin_peers" {
+				return NewErrorResponse(req, ErrCodeMethodNotFound, "method not allowed"), nil
+			}
+			return next(ctx, req)
+		}),
+		// Rewrites requests and responses
+		MiddlewareFunc(func(ctx context.Context, req *Request, next Handler) (*Response, error) {
+			record("rewrite " + req.Method)
+			if req.Method == "fail" {
+				return nil, errors.New("broken")
+			}
+			req.Message = bytes.Replace(req.Message, []byte(`"in"`), []byte(`"rewritten"`), 1)
+			resp, err := next(ctx, req)
+			if resp != nil {
+				resp.Message = bytes.Replace(resp.Message, []byte(`"rewritten"`), []byte(`"modified"`), 1)
+			}
+			return resp, err
+		}),
+	}
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_call","params":["in"],"id":1}` +
+		`{"jsonrpc":"2.0","method":"admin_peers","params":[],"id":2}` +
+		`{"jsonrpc":"2.0","method":"eth_notify","params":["in"]}` +
+		`{"jsonrpc":"2.0","method":"fail","params":[],"id":3}` + "\n"))
+	assert.NoError(t, err)
+
+	// Responses are awaited concurrently, so they can arrive in any order
+	responses := map[string]string{}
+	reader := bufio.NewReader(client)
+	for range 3 {
+		line, err := reader.ReadBytes('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		id, err := blzdJson.ID(line)
+		assert.NoError(t, err)
+		responses[string(id)] = string(bytes.TrimSpace(line))
+	}
+
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":["modified"]}`, responses["1"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"method not allowed"}}`, responses["2"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":3,"error":{"code":-32603,"message":"Internal error"}}`, responses["3"])
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.ElementsMatch(t, []string{
+		"auth eth_call", "rewrite eth_call",
+		"auth admin_peers",
+		"auth eth_notify", "rewrite eth_notify",
+		"auth fail", "rewrite fail",
+	}, calls)
+}
+
+func TestMiddlewareKeepsOrder(t *testing.T) {
+	received := make(chan string, 5)
+	upstreamSocket := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		received <- string(id)
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":null}`, id)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Middlewares = []Middleware{
+		// Earlier requests take longer to pass the chain
+		MiddlewareFunc(func(ctx context.Context, req *Request, next Handler) (*Response, error) {
+			id, _ := strconv.Atoi(string(req.ID))
+			time.Sleep(time.Duration(5-id) * 10 * time.Millisecond)
+			return next(ctx, req)
+		}),
+	}
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var batch []byte
+	for id := 1; id <= 5; id++ {
+		batch = fmt.Appendf(batch, `{"jsonrpc":"2.0","method":"eth_call","params":[],"id":%d}`, id)
+	}
+	_, err = client.Write(append(batch, '\n'))
+	assert.NoError(t, err)
+	readResponses(t, bufio.NewReader(client), 5)
+
+	close(received)
+	var order []string
+	for id := range received {
+		order = append(order, id)
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, order)
+}
+
+func TestMiddlewareRewritesID(t *testing.T) {
+	received := make(chan string, 2)
+	upstreamSocket := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		received <- string(id)
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":"ok"}`, id)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Middlewares = []Middleware{
+		// Namespaces ids, the client has to get its own back
+		MiddlewareFunc(func(ctx context.Context, req *Request, next Handler) (*Response, error) {
+			msg, _, err := blzdJson.ReplaceID(nil, req.Message, []byte(strconv.Quote("mw-"+string(req.ID))))
+			if err != nil {
+				return nil, err
+			}
+			req.Message = msg
+			return next(ctx, req)
+		}),
+	}
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_call","params":[],"id":1}` +
+		`{"jsonrpc":"2.0","method":"eth_call","params":[],"id":"a"}` + "\n"))
+	assert.NoError(t, err)
+	responses := readResponses(t, bufio.NewReader(client), 2)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"ok"}`, responses["1"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":"a","result":"ok"}`, responses[`"a"`])
+	assert.ElementsMatch(t, []string{`"mw-1"`, `"mw-\"a\""`}, []string{<-received, <-received})
+}
+
+func TestMiddlewareRequestTimeout(t *testing.T) {
+	upstreamSocket := startSilentUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Timeouts = Timeouts{Request: Duration(20 * time.Millisecond)}
+	proxy.Middlewares = []Middleware{MiddlewareFunc(func(ctx context.Context, req *Request, next Handler) (*Response, error) {
+		return next(ctx, req)
+	})}
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":7}` + "\n"))
+	assert.NoError(t, err)
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":7,"error":{"code":-32000,"message":"upstream request timed out"}}`, string(line))
+}
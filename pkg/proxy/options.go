@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Config is the serializable part of the proxy configuration, see New and WithConfig
+type Config struct {
+	// Upstreams are tried in order when a client connects, before those added with WithCustomUpstream
+	Upstreams []UpstreamConfig `json:"upstreams"`
+
+	SessionMode SessionMode `json:"sessionMode"`
+
+	// Lexer settings for both sides of a connection
+	BufferSize     int                  `json:"bufferSize"`
+	MaxRead        int                  `json:"maxRead"`
+	AsyncCallbacks bool                 `json:"asyncCallbacks,omitempty"`
+	ClientPolicy   blzdJson.LexerPolicy `json:"clientPolicy"`
+	UpstreamPolicy blzdJson.LexerPolicy `json:"upstreamPolicy"`
+	ClientFraming  blzdJson.Framing     `json:"clientFraming"`
+
+	Timeouts             Timeouts          `json:"timeouts"`
+	Limits               ConnectionLimits  `json:"limits"`
+	PassthroughThreshold int               `json:"passthroughThreshold"`
+	SharedSubscriptions  bool              `json:"sharedSubscriptions,omitempty"`
+	NotificationQueue    NotificationQueue `json:"notificationQueue"`
+
+	// Methods that may be sent to an upstream more than once, e.g. for hedging
+	IdempotentMethods []string `json:"idempotentMethods"`
+	Hedging           Hedging  `json:"hedging"`
+	Retry             Retry    `json:"retry"`
+
+	CircuitBreaker CircuitBreaker `json:"circuitBreaker"`
+}
+
+// Duration is a time.Duration that reads and writes as text like "5s" in a Config
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// UpstreamConfig describes how to reach an upstream node
+type UpstreamConfig struct {
+	Network   string           `json:"network"` // "unix" or "tcp"
+	Address   string           `json:"address"`
+	Framing   blzdJson.Framing `json:"framing"`
+	Multiplex bool             `json:"multiplex,omitempty"`
+}
+
+// DefaultConfig returns the configuration New starts from, it has no upstreams
+func DefaultConfig() Config {
+	return Config{
+		BufferSize:           16384,
+		MaxRead:              4096,
+		ClientPolicy:         blzdJson.DefaultLexerPolicy(),
+		UpstreamPolicy:       DefaultUpstreamLexerPolicy,
+		PassthroughThreshold: DefaultPassthroughThreshold,
+		IdempotentMethods:    slices.Clone(DefaultIdempotentMethods),
+	}
+}
+
+// Validate checks the configuration for values New can't work with
+func (c *Config) Validate() error {
+	for i, u := range c.Upstreams {
+		switch u.Network {
+		case "unix", "tcp":
+		default:
+			return fmt.Errorf("upstream %d: unsupported network %q", i, u.Network)
+		}
+		if u.Address == "" {
+			return fmt.Errorf("upstream %d: missing address", i)
+		}
+	}
+	if _, ok := sessionModeNames[c.SessionMode]; !ok {
+		return fmt.Errorf("unsupported session mode %s", c.SessionMode)
+	}
+	if c.NotificationQueue.Size < 0 {
+		return errors.New("notification queue size can't be negative")
+	}
+	if _, ok := queuePolicyNames[c.NotificationQueue.Policy]; !ok {
+		return fmt.Errorf("unsupported queue policy %s", c.NotificationQueue.Policy)
+	}
+	if c.Hedging.Percentile < 0 || c.Hedging.Percentile >= 1 {
+		return fmt.Errorf("hedging percentile %v is not in [0, 1)", c.Hedging.Percentile)
+	}
+	if c.Retry.Attempts < 0 || c.Retry.Backoff < 0 {
+		return errors.New("retry attempts and backoff can't be negative")
+	}
+	if b := c.CircuitBreaker; b.ConsecutiveFailures < 0 || b.Window < 0 || b.OpenDuration < 0 || b.HalfOpenProbes < 0 {
+		return errors.New("circuit breaker settings can't be negative")
+	}
+	if c.CircuitBreaker.ErrorRate < 0 || c.CircuitBreaker.ErrorRate > 1 {
+		return fmt.Errorf("circuit breaker error rate %v is not in [0, 1]", c.CircuitBreaker.ErrorRate)
+	}
+	if c.CircuitBreaker.ErrorRate > 0 && c.CircuitBreaker.Window == 0 {
+		return errors.New("circuit breaker error rate needs a window")
+	}
+	if c.BufferSize <= 0 || c.MaxRead <= 0 {
+		return errors.New("buffer size and max read have to be positive")
+	}
+	return nil
+}
+
+// Hooks are optional callbacks for connection events, see the fields of JsonReverseProxy
+type Hooks struct {
+	OnConnect    func(id string, conn *ProxyConn)
+	OnDisconnect func(id string, conn *ProxyConn)
+	OnRequest    func(id string, conn *ProxyConn, data []byte)
+	OnResponse   func(id string, conn *ProxyConn, data []byte)
+}
+
+// options collects everything set by Option, the parts of it that can't be serialized live outside of Config
+type options struct {
+	config      Config
+	upstreams   []Upstream // Custom upstreams, after the ones in config
+	logger      zerolog.Logger
+	hooks       Hooks
+	middlewares []Middleware
+	bufferPool  *blzdJson.BufferPool
+}
+
+// Option configures a proxy created with New
+type Option func(*options)
+
+// WithConfig replaces the whole configuration, options after it can change single values
+func WithConfig(config Config) Option {
+	return func(o *options) {
+		o.config = config
+	}
+}
+
+// WithUnixUpstream adds an upstream node listening on a Unix socket
+func WithUnixUpstream(path string) Option {
+	return WithUpstream(UpstreamConfig{Network: "unix", Address: path})
+}
+
+// WithUpstream adds an upstream node, upstreams are tried in the order they were added
+func WithUpstream(upstream UpstreamConfig) Option {
+	return func(o *options) {
+		o.config.Upstreams = append(o.config.Upstreams, upstream)
+	}
+}
+
+// WithCustomUpstream adds an upstream implementation like an in-process handler or a mock,
+// it is tried after the upstreams of the Config
+func WithCustomUpstream(upstream Upstream) Option {
+	return func(o *options) {
+		o.upstreams = append(o.upstreams, upstream)
+	}
+}
+
+// WithLogger sets the logger of the proxy, by default the global zerolog logger is used
+func WithLogger(logger zerolog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithLexerPolicy sets the limits for messages from clients and from upstreams
+func WithLexerPolicy(client, upstream blzdJson.LexerPolicy) Option {
+	return func(o *options) {
+		o.config.ClientPolicy = client
+		o.config.UpstreamPolicy = upstream
+	}
+}
+
+// WithBufferSize sets the initial lexer buffer size and the maximum size of a single read
+func WithBufferSize(bufferSize, maxRead int) Option {
+	return func(o *options) {
+		o.config.BufferSize = bufferSize
+		o.config.MaxRead = maxRead
+	}
+}
+
+// WithAsyncCallbacks hands copies of messages to the lexer callbacks on their own goroutines
+func WithAsyncCallbacks(enabled bool) Option {
+	return func(o *options) {
+		o.config.AsyncCallbacks = enabled
+	}
+}
+
+// WithClientFraming sets the framing of client connections, see AddFramedListener for single listeners
+func WithClientFraming(framing blzdJson.Framing) Option {
+	return func(o *options) {
+		o.config.ClientFraming = framing
+	}
+}
+
+// WithSessionMode sets how client connections are mapped to upstream connections
+func WithSessionMode(mode SessionMode) Option {
+	return func(o *options) {
+		o.config.SessionMode = mode
+	}
+}
+
+// WithTimeouts sets the deadlines for connections and requests
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(o *options) {
+		o.config.Timeouts = timeouts
+	}
+}
+
+// WithConnectionLimits limits the number of client connections
+func WithConnectionLimits(limits ConnectionLimits) Option {
+	return func(o *options) {
+		o.config.Limits = limits
+	}
+}
+
+// WithPassthroughThreshold sets the size after which upstream messages are streamed, 0 disables streaming
+func WithPassthroughThreshold(threshold int) Option {
+	return func(o *options) {
+		o.config.PassthroughThreshold = threshold
+	}
+}
+
+// WithSharedSubscriptions serves identical subscriptions of all clients with one upstream subscription
+func WithSharedSubscriptions(enabled bool) Option {
+	return func(o *options) {
+		o.config.SharedSubscriptions = enabled
+	}
+}
+
+// WithNotificationQueue bounds the notifications waiting for slow clients
+func WithNotificationQueue(queue NotificationQueue) Option {
+	return func(o *options) {
+		o.config.NotificationQueue = queue
+	}
+}
+
+// WithIdempotentMethods replaces the methods that may be sent to an upstream more than once
+func WithIdempotentMethods(methods ...string) Option {
+	return func(o *options) {
+		o.config.IdempotentMethods = methods
+	}
+}
+
+// WithHedging sends slow idempotent requests to a second upstream
+func WithHedging(hedging Hedging) Option {
+	return func(o *options) {
+		o.config.Hedging = hedging
+	}
+}
+
+// WithRetry resends idempotent requests the upstream failed and reconnects broken upstreams
+func WithRetry(retry Retry) Option {
+	return func(o *options) {
+		o.config.Retry = retry
+	}
+}
+
+// WithCircuitBreaker routes around upstreams that keep failing until probes succeed again
+func WithCircuitBreaker(breaker CircuitBreaker) Option {
+	return func(o *options) {
+		o.config.CircuitBreaker = breaker
+	}
+}
+
+// WithBufferPool sets the pool shared by the lexers of all connections, nil allocates buffers per connection
+func WithBufferPool(pool *blzdJson.BufferPool) Option {
+	return func(o *options) {
+		o.bufferPool = pool
+	}
+}
+
+// WithHooks sets the callbacks for connection events
+func WithHooks(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+// WithMiddleware appends middlewares to the request chain
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// New creates a proxy from DefaultConfig and the given options. Listeners are added afterwards.
+func New(opts ...Option) (*JsonReverseProxy, error) {
+	o := options{
+		config:     DefaultConfig(),
+		logger:     log.Logger.With().Str("component", "proxy").Logger(),
+		bufferPool: blzdJson.DefaultBufferPool,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid proxy config: %w", err)
+	}
+	if len(o.config.Upstreams)+len(o.upstreams) == 0 {
+		return nil, errors.New("invalid proxy config: no upstream configured")
+	}
+	return newProxy(&o), nil
+}
+
+func newProxy(o *options) *JsonReverseProxy {
+	upstreams := make([]Upstream, 0, len(o.config.Upstreams)+len(o.upstreams))
+	for _, config := range o.config.Upstreams {
+		upstreams = append(upstreams, NewDialUpstream(config))
+	}
+	upstreams = append(upstreams, o.upstreams...)
+
+	return &JsonReverseProxy{
+		upstreams:      upstreams,
+		listeners:      []net.Listener{},
+		logger:         o.logger,
+		asyncCallbacks: o.config.AsyncCallbacks,
+		bufferSize:     o.config.BufferSize,
+		maxRead:        o.config.MaxRead,
+		sessionMode:    o.config.SessionMode,
+
+		ClientPolicy:         o.config.ClientPolicy,
+		UpstreamPolicy:       o.config.UpstreamPolicy,
+		ClientFraming:        o.config.ClientFraming,
+		Timeouts:             o.config.Timeouts,
+		Limits:               o.config.Limits,
+		PassthroughThreshold: o.config.PassthroughThreshold,
+		SharedSubscriptions:  o.config.SharedSubscriptions,
+		NotificationQueue:    o.config.NotificationQueue,
+		IdempotentMethods:    o.config.IdempotentMethods,
+		Hedging:              o.config.Hedging,
+		Retry:                o.config.Retry,
+		CircuitBreaker:       o.config.CircuitBreaker,
+		BufferPool:           o.bufferPool,
+		Middlewares:          o.middlewares,
+
+		OnConnect:    o.hooks.OnConnect,
+		OnDisconnect: o.hooks.OnDisconnect,
+		OnRequest:    o.hooks.OnRequest,
+		OnResponse:   o.hooks.OnResponse,
+	}
+}
+
+// Config returns the serializable configuration the proxy currently uses, custom upstreams are left out
+func (j *JsonReverseProxy) Config() Config {
+	var upstreams []UpstreamConfig
+	for _, upstream := range j.upstreams {
+		if u, ok := upstream.(*DialUpstream); ok {
+			upstreams = append(upstreams, u.config)
+		}
+	}
+
+	return Config{
+		Upstreams:            upstreams,
+		SessionMode:          j.sessionMode,
+		BufferSize:           j.bufferSize,
+		MaxRead:              j.maxRead,
+		AsyncCallbacks:       j.asyncCallbacks,
+		ClientPolicy:         j.ClientPolicy,
+		UpstreamPolicy:       j.UpstreamPolicy,
+		ClientFraming:        j.ClientFraming,
+		Timeouts:             j.Timeouts,
+		Limits:               j.Limits,
+		PassthroughThreshold: j.PassthroughThreshold,
+		SharedSubscriptions:  j.SharedSubscriptions,
+		NotificationQueue:    j.NotificationQueue,
+		IdempotentMethods:    j.IdempotentMethods,
+		Hedging:              j.Hedging,
+		Retry:                j.Retry,
+		CircuitBreaker:       j.CircuitBreaker,
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewValidation(t *testing.T) {
+	_, err := New()
+	assert.ErrorContains(t, err, "no upstream")
+
+	_, err = New(WithUpstream(UpstreamConfig{Network: "udp", Address: "x"}))
+	assert.ErrorContains(t, err, "unsupported network")
+
+	_, err = New(WithUnixUpstream("/tmp/node.sock"), WithBufferSize(0, 0))
+	assert.Error(t, err)
+
+	_, err = New(WithUnixUpstream("/tmp/node.sock"), WithSessionMode(SessionMode(42)))
+	assert.ErrorContains(t, err, "session mode")
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	config := DefaultConfig()
+	config.Upstreams = []UpstreamConfig{
+		{Network: "unix", Address: "/tmp/node.sock", Framing: blzdJson.FramingContentLength},
+		{Network: "tcp", Address: "127.0.0.1:8546", Multiplex: true},
+	}
+	config.ClientPolicy.Strict = true
+	config.Timeouts = Timeouts{Request: Duration(time.Second), Methods: map[string]Duration{"debug_traceTransaction": Duration(time.Minute)}}
+	config.Limits = ConnectionLimits{Max: 10, Policy: LimitEvictIdle}
+	config.SharedSubscriptions = true
+	config.NotificationQueue = NotificationQueue{Size: 64, Policy: QueueDropOldest}
+	config.Hedging = Hedging{Delay: Duration(50 * time.Millisecond), Percentile: 0.95}
+	config.Retry = Retry{Attempts: 2, Backoff: Duration(time.Millisecond), ErrorCodes: []int{-32000}}
+	config.CircuitBreaker = CircuitBreaker{ConsecutiveFailures: 5, ErrorRate: 0.5, Window: 20, OpenDuration: Duration(time.Second), HalfOpenProbes: 2, ErrorCodes: []int{-32603}}
+
+	config.SessionMode = SessionOneToOne
+
+	data, err := json.Marshal(config)
+	assert.NoError(t, err)
+	// Enums and durations read like the command line flags
+	assert.Contains(t, string(data), `"sessionMode":"one-to-one"`)
+	assert.Contains(t, string(data), `"timeouts":{"request":"1s","methods":{"debug_traceTransaction":"1m0s"}}`)
+	var decoded Config
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, config, decoded)
+
+	// The proxy reports the configuration it was created with
+	proxy, err := New(WithConfig(decoded))
+	assert.NoError(t, err)
+	assert.Equal(t, config, proxy.Config())
+
+	assert.ErrorContains(t, json.Unmarshal([]byte(`{"sessionMode":"pooled"}`), &decoded), "session mode")
+}
+
+// lockedBuffer collects log output written by connection goroutines
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestNewWithOptions(t *testing.T) {
+	upstreamSocket := startEchoUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	var logs lockedBuffer
+	connected := make(chan string, 1)
+	proxy, err := New(
+		// Unreachable upstreams are skipped
+		WithUnixUpstream(getTempSocketPath()),
+		WithUnixUpstream(upstreamSocket),
+		WithLogger(zerolog.New(&logs)),
+		WithBufferSize(1024, 512),
+		WithHooks(Hooks{OnConnect: func(id string, conn *ProxyConn) { connected <- id }}),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_call","params":[1],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":[1]}`, string(line))
+
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("OnConnect wasn't called")
+	}
+
+	// The injected logger is used instead of a console logger
+	proxy.Shutdown()
+	assert.Contains(t, logs.String(), `"message":"Proxy shutdown complete"`)
+}
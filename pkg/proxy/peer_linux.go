@@ -0,0 +1,36 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerIdentity identifies the other end of a connection for per peer limits and logs.
+// Unix socket peers have no address, they are identified by the uid of the connecting process.
+func peerIdentity(conn net.Conn) string {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return remotePeerIdentity(conn)
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return remotePeerIdentity(conn)
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return remotePeerIdentity(conn)
+	}
+
+	return fmt.Sprintf("uid:%d", cred.Uid)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// peerIdentity identifies the other end of a connection for per peer limits and logs
+func peerIdentity(conn net.Conn) string {
+	return remotePeerIdentity(conn)
+}
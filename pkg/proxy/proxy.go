@@ -1,10 +1,13 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -16,22 +19,239 @@ import (
 )
 
 type ProxyConn struct {
-	clientConn      net.Conn
-	upstreamConn    net.Conn
-	clientDecoder   *blzdJson.JsonStreamLexer
-	upstreamDecoder *blzdJson.JsonStreamLexer
-	createdAt       int64 // Unix timestamp
+	clientConn    net.Conn
+	clientDecoder *blzdJson.JsonStreamLexer
+	link          atomic.Pointer[upstreamLink] // Replaced when the upstream is reconnected
+	peer          string                       // Identity of the client, see peerIdentity
+	createdAt     int64                        // Unix timestamp
+	lastActivity  atomic.Int64                 // Unix nano timestamp of the last message in either direction
+
+	// Serializes messages from the decoders and locally generated responses to the client
+	clientWriter *connWriter
+
+	// Requests waiting for an upstream response, only used when request timeouts are set
+	pending pendingRequests
+	// Requests without a response yet if nothing else tracks them, see countsInFlight
+	inFlight atomic.Int64
+
+	session *Session
+
+	// Notifications waiting for the client, nil without a NotificationQueue
+	outbound *outboundQueue
+
+	// Set when the connection is evicted for a new one or once it released its limiter slot
+	evictedBy atomic.Pointer[slotHandoff]
+}
+
+// Session returns the subscription state of the connection
+func (c *ProxyConn) Session() *Session {
+	return c.session
 }
 
+// upstreamLink is the upstream stream of a connection and the Upstream it was opened on
+type upstreamLink struct {
+	stream  UpstreamStream
+	backend Upstream
+	probe   uint64 // Circuit breaker probe tag of the stream
+}
+
+func (c *ProxyConn) upstream() UpstreamStream {
+	return c.link.Load().stream
+}
+
+func (c *ProxyConn) backend() Upstream {
+	return c.link.Load().backend
+}
+
+// forgetRequest tells the upstream stream that the response to the request with id isn't awaited anymore
+func (c *ProxyConn) forgetRequest(id []byte) {
+	if s, ok := c.upstream().(interface{ forgetRequest(id []byte) }); ok {
+		s.forgetRequest(id)
+	}
+}
+
+// DroppedNotifications returns the number of notifications discarded because the client didn't keep up
+func (c *ProxyConn) DroppedNotifications() uint64 {
+	if c.outbound == nil {
+		return 0
+	}
+	return c.outbound.dropped.Load()
+}
+
+// touch records activity on the connection and pushes the idle deadline of both sides
+func (c *ProxyConn) touch(idleTimeout time.Duration) {
+	now := time.Now()
+	c.lastActivity.Store(now.UnixNano())
+	if idleTimeout > 0 {
+		deadline := now.Add(idleTimeout)
+		c.clientConn.SetReadDeadline(deadline)
+		if u, ok := c.upstream().(interface{ SetReadDeadline(time.Time) error }); ok {
+			u.SetReadDeadline(deadline)
+		}
+	}
+}
+
+// connWriter writes framed messages to a connection
+type connWriter struct {
+	conn      net.Conn
+	framing   blzdJson.Framing
+	lock      sync.Mutex
+	buf       []byte
+	streaming bool // Locked by a message written in chunks
+}
+
+// Scratch buffers bigger than this are released after the write
+const maxRetainedWriteBuffer = 1 << 20
+
+func (w *connWriter) writeMessage(data []byte, timeout time.Duration) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// Copy into our own buffer, appending to data could overwrite the next message in the lexer buffer
+	w.buf = w.framing.AppendFrame(w.buf[:0], data)
+
+	if timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := w.conn.Write(w.buf)
+
+	if cap(w.buf) > maxRetainedWriteBuffer {
+		w.buf = nil
+	}
+	return err
+}
+
+// writeChunk writes part of a streamed message. The writer stays locked until endMessage,
+// so other messages can't end up in the middle of it. Only used with FramingJSON, other
+// framings need the size of the message upfront.
+func (w *connWriter) writeChunk(data []byte, timeout time.Duration) error {
+	if !w.streaming {
+		w.lock.Lock()
+		w.streaming = true
+	}
+
+	if timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := w.conn.Write(data)
+	return err
+}
+
+// endMessage terminates a streamed message and unlocks the writer
+func (w *connWriter) endMessage(timeout time.Duration) error {
+	if !w.streaming {
+		return nil
+	}
+	defer w.lock.Unlock()
+	w.streaming = false
+
+	if timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := w.conn.Write([]byte{'\n'})
+	return err
+}
+
+// abortMessage unlocks the writer after a streamed message was cut off
+func (w *connWriter) abortMessage() {
+	if w.streaming {
+		w.streaming = false
+		w.lock.Unlock()
+	}
+}
+
+// clientPassthrough streams oversized upstream messages to the client, see JsonReverseProxy.PassthroughThreshold
+type clientPassthrough struct {
+	conn     *ProxyConn
+	timeouts *Timeouts
+}
+
+func (p *clientPassthrough) Write(data []byte) (int, error) {
+	p.conn.touch(time.Duration(p.timeouts.Idle))
+	if err := p.conn.clientWriter.writeChunk(data, time.Duration(p.timeouts.Write)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (p *clientPassthrough) EndMessage(err error) error {
+	if err != nil {
+		// The client already got part of the message, there is no way to continue the stream
+		p.conn.clientWriter.abortMessage()
+		p.conn.clientConn.Close()
+		return nil
+	}
+	return p.conn.clientWriter.endMessage(time.Duration(p.timeouts.Write))
+}
+
+// DefaultPassthroughThreshold is the message size after which upstream responses are streamed to the client
+const DefaultPassthroughThreshold = 1 << 20
+
+// DefaultUpstreamLexerPolicy only guards against runaway nesting,
+// responses like full blocks or traces are legitimately huge.
+var DefaultUpstreamLexerPolicy = blzdJson.LexerPolicy{MaxDepth: 64}
+
 type JsonReverseProxy struct {
-	upstream       *Upstream
+	upstreams      []Upstream // Tried in order when a client connects
+	sessionMode    SessionMode
 	listeners      []net.Listener
+	framings       map[net.Listener]blzdJson.Framing // Client framing of listeners added with AddFramedListener
 	listening      bool
 	logger         zerolog.Logger
 	asyncCallbacks bool
 	bufferSize     int
 	maxRead        int
 
+	// Limits for messages from clients and from the upstream
+	ClientPolicy   blzdJson.LexerPolicy
+	UpstreamPolicy blzdJson.LexerPolicy
+
+	// Framing of client connections unless set per listener with AddFramedListener,
+	// messages are translated to the framing of the upstream
+	ClientFraming blzdJson.Framing
+
+	// Deadlines for connections, zero values disable them
+	Timeouts Timeouts
+
+	// Upstream messages bigger than this are streamed to the client instead of being buffered whole,
+	// as long as responses don't have to be inspected and both sides use FramingJSON. 0 disables streaming.
+	PassthroughThreshold int
+
+	// Shared by the decoders of all connections, nil allocates buffers per connection
+	BufferPool *blzdJson.BufferPool
+
+	// Limits for client connections, applied when Listen is called
+	Limits  ConnectionLimits
+	limiter *connLimiter
+
+	// Client requests pass these in order before they are forwarded, applied when Listen is called
+	Middlewares []Middleware
+	handler     Handler
+
+	// Serve identical subscriptions of all clients with a single upstream subscription,
+	// applied when Listen is called
+	SharedSubscriptions bool
+	hub                 *subscriptionHub
+
+	// Bounds the notifications waiting for slow clients, zero writes them directly
+	NotificationQueue NotificationQueue
+
+	// Methods that can safely be sent more than once, applied when Listen is called
+	IdempotentMethods []string
+	idempotentMethods map[string]struct{}
+
+	// Idempotent requests go to a second upstream as well if the first one is slow
+	Hedging Hedging
+	latency latencyTracker
+
+	// Idempotent requests are resent if the upstream fails them, broken upstreams are reconnected
+	Retry          Retry
+	requestClients map[Upstream]*requestClient // Streams for requests outside of client connections
+
+	// Routes around upstreams that keep failing, applied when Listen is called
+	CircuitBreaker CircuitBreaker
+	breakers       map[Upstream]*circuitBreaker
+
 	// Optional callbacks for connection events
 	OnConnect    func(id string, conn *ProxyConn)
 	OnDisconnect func(id string, conn *ProxyConn)
@@ -44,9 +264,51 @@ type JsonReverseProxy struct {
 	// Tracking active connections and decoders for debugging
 	activeConnections      sync.Map // map[string]*DecoderPair
 	ActiveConnectionsCount int64
+
+	// Connections closed because of connection limits
+	RejectedConnectionsCount int64
+	EvictedConnectionsCount  int64
+	// Connections closed because their notification queue was full
+	DroppedClientsCount int64
+
+	// Requests sent to a second upstream and how often its response was used
+	HedgedRequestsCount int64
+	HedgeWinsCount      int64
+
+	// Requests sent again and upstream streams replaced after they broke
+	RetriedRequestsCount      int64
+	ReconnectedUpstreamsCount int64
+	// Times a circuit breaker opened
+	CircuitOpenedCount int64
+
+	// Used to wait for all connections to finish when draining
+	connections sync.WaitGroup
 }
 
 func (j *JsonReverseProxy) Listen() {
+	if j.Limits.enabled() && j.limiter == nil {
+		j.limiter = newConnLimiter(j.Limits)
+	}
+	j.idempotentMethods = make(map[string]struct{}, len(j.IdempotentMethods))
+	for _, method := range j.IdempotentMethods {
+		if slices.Contains(neverRetried, method) {
+			j.logger.Warn().Str("method", method).Msg("Method has side effects, it is never sent twice")
+			continue
+		}
+		j.idempotentMethods[method] = struct{}{}
+	}
+	if len(j.Middlewares) > 0 || j.Hedging.enabled() || j.Retry.enabled() {
+		j.handler = chain(j.Middlewares, j.forwardRequest)
+	}
+	if j.CircuitBreaker.enabled() && j.breakers == nil {
+		j.breakers = make(map[Upstream]*circuitBreaker, len(j.upstreams))
+		for _, upstream := range j.upstreams {
+			j.breakers[upstream] = newCircuitBreaker(&j.CircuitBreaker, upstream)
+		}
+	}
+	if j.SharedSubscriptions && j.hub == nil {
+		j.hub = newSubscriptionHub(j)
+	}
 	for _, listener := range j.listeners {
 		go j.acceptConnections(listener)
 	}
@@ -56,7 +318,7 @@ func (j *JsonReverseProxy) Listen() {
 func (j *JsonReverseProxy) Shutdown() {
 	// Close all listeners
 	for _, listener := range j.listeners {
-		if err := listener.Close(); err != nil {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			j.logger.Error().Err(err).Msg("Error closing listener")
 		}
 	}
@@ -65,10 +327,10 @@ func (j *JsonReverseProxy) Shutdown() {
 	j.activeConnections.Range(func(key, value interface{}) bool {
 		connID := key.(string)
 		conn := value.(*ProxyConn)
-		if err := conn.clientConn.Close(); err != nil {
+		if err := conn.clientConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			j.logger.Error().Err(err).Str("connID", connID).Msg("Error closing client connection")
 		}
-		if err := conn.upstreamConn.Close(); err != nil {
+		if err := conn.upstream().Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			j.logger.Error().Err(err).Str("connID", connID).Msg("Error closing upstream connection")
 		}
 		// TODO: check if the disconnect will trigger eof and through that the cancel function
@@ -76,6 +338,26 @@ func (j *JsonReverseProxy) Shutdown() {
 		return true
 	})
 
+	// Reject connections waiting for a free slot
+	if j.limiter != nil {
+		j.limiter.close()
+	}
+
+	if j.hub != nil {
+		j.hub.close()
+	}
+	j.upstreamLock.Lock()
+	for _, client := range j.requestClients {
+		client.close()
+	}
+	j.upstreamLock.Unlock()
+
+	for _, upstream := range j.upstreams {
+		if err := upstream.Close(); err != nil {
+			j.logger.Error().Err(err).Msg("Error closing upstream")
+		}
+	}
+
 	j.logger.Info().Msg("Proxy shutdown complete")
 }
 
@@ -85,8 +367,45 @@ func (j *JsonReverseProxy) DumpDebugInfo() {
 
 	j.logger.Info().
 		Int64("active_connections_count", j.ActiveConnectionsCount).
+		Int64("rejected_connections_count", j.RejectedConnectionsCount).
+		Int64("evicted_connections_count", j.EvictedConnectionsCount).
+		Int64("dropped_clients_count", j.DroppedClientsCount).
+		Int64("hedged_requests_count", j.HedgedRequestsCount).
+		Int64("hedge_wins_count", j.HedgeWinsCount).
+		Int64("retried_requests_count", j.RetriedRequestsCount).
+		Int64("reconnected_upstreams_count", j.ReconnectedUpstreamsCount).
+		Int64("circuit_opened_count", j.CircuitOpenedCount).
 		Msg("Debug information")
 
+	if j.breakers != nil {
+		for _, state := range j.UpstreamStates() {
+			j.logger.Info().
+				Str("upstream", state.Upstream).
+				Bool("healthy", state.Healthy).
+				Stringer("circuit", state.Circuit).
+				Int("failures", state.Failures).
+				Msg("Upstream")
+		}
+	}
+
+	if j.hub != nil {
+		subscriptions, subscribers := j.hub.stats()
+		j.logger.Info().
+			Int("subscriptions", subscriptions).
+			Int("subscribers", subscribers).
+			Msg("Shared subscriptions")
+	}
+
+	if j.BufferPool != nil {
+		stats := j.BufferPool.Stats()
+		j.logger.Info().
+			Int64("in_use_bytes", stats.InUse).
+			Int64("high_water_bytes", stats.HighWater).
+			Uint64("gets", stats.Gets).
+			Uint64("allocs", stats.Allocs).
+			Msg("Buffer pool")
+	}
+
 	j.activeConnections.Range(func(key, value interface{}) bool {
 		count++
 		connID := key.(string)
@@ -101,24 +420,28 @@ func (j *JsonReverseProxy) DumpDebugInfo() {
 		// Get client buffer content preview
 		clientBufferContent := conn.clientDecoder.BufferContent()
 
-		// Get upstream decoder state
-		upstreamBufferInfo := fmt.Sprintf("Buffer length: %d, cursor: %d, capacity: %d",
-			conn.upstreamDecoder.BufferLength(),
-			conn.upstreamDecoder.Cursor(),
-			cap(conn.upstreamDecoder.Buffer()))
-
-		// Get upstream buffer content preview
-		upstreamBufferContent := conn.upstreamDecoder.BufferContent()
-
-		j.logger.Info().
+		e := j.logger.Info().
 			Str("connection_id", connID).
+			Str("peer", conn.peer).
 			Str("client_buffer", clientBufferInfo).
 			Str("client_buffer_content", clientBufferContent).
-			Str("upstream_buffer", upstreamBufferInfo).
-			Str("upstream_buffer_content", upstreamBufferContent).
 			Str("client_remote", conn.clientConn.RemoteAddr().String()).
-			Str("upstream_remote", conn.upstreamConn.RemoteAddr().String()).
-			Msg("Connection debug info")
+			Int("subscriptions", len(conn.session.Subscriptions())).
+			Uint64("dropped_notifications", conn.DroppedNotifications())
+		if conn.outbound != nil {
+			e = e.Int("queued_notifications", conn.outbound.queued())
+		}
+
+		// Custom upstreams have no decoder of ours
+		if stream, ok := conn.upstream().(*connStream); ok {
+			e = e.Str("upstream_buffer", fmt.Sprintf("Buffer length: %d, cursor: %d, capacity: %d",
+				stream.decoder.BufferLength(),
+				stream.decoder.Cursor(),
+				cap(stream.decoder.Buffer()))).
+				Str("upstream_buffer_content", stream.decoder.BufferContent()).
+				Str("upstream_remote", stream.conn.RemoteAddr().String())
+		}
+		e.Msg("Connection debug info")
 
 		return true
 	})
@@ -126,6 +449,8 @@ func (j *JsonReverseProxy) DumpDebugInfo() {
 	j.logger.Info().Int("actual_count", count).Msg("Finished dumping debug info")
 }
 
+// NewUnixUpstreamJsonRpcProxy creates a proxy for a single Unix socket upstream that logs to the console.
+// New offers more control over the configuration.
 func NewUnixUpstreamJsonRpcProxy(
 	path string,
 	asyncCallbacks bool,
@@ -133,15 +458,6 @@ func NewUnixUpstreamJsonRpcProxy(
 	bufferSize int,
 	maxRead int,
 ) *JsonReverseProxy {
-	upstream := Upstream{
-		pool:      []net.Conn{},
-		poolSize:  1,
-		multiplex: multiplexing,
-		dial: func() (net.Conn, error) {
-			return net.Dial("unix", path)
-		},
-	}
-
 	// Initialize a new logger
 	logger := zerolog.New(zerolog.NewConsoleWriter()).
 		Level(zerolog.GlobalLevel()).
@@ -150,16 +466,16 @@ func NewUnixUpstreamJsonRpcProxy(
 		Str("component", "proxy").
 		Logger()
 
-	proxy := JsonReverseProxy{
-		upstream:       &upstream,
-		listeners:      []net.Listener{},
-		listening:      false,
-		logger:         logger,
-		asyncCallbacks: asyncCallbacks,
-		bufferSize:     bufferSize,
-		maxRead:        maxRead,
+	o := options{
+		config:     DefaultConfig(),
+		logger:     logger,
+		bufferPool: blzdJson.DefaultBufferPool,
 	}
-	return &proxy
+	o.config.Upstreams = []UpstreamConfig{{Network: "unix", Address: path, Multiplex: multiplexing}}
+	o.config.AsyncCallbacks = asyncCallbacks
+	o.config.BufferSize = bufferSize
+	o.config.MaxRead = maxRead
+	return newProxy(&o)
 }
 
 func (j *JsonReverseProxy) AddUnixSocketListener(context context.Context, path string) error {
@@ -173,8 +489,31 @@ func (j *JsonReverseProxy) AddUnixSocketListener(context context.Context, path s
 	return nil
 }
 
+// AddListener adds an already listening socket, e.g. one inherited from systemd or a parent process.
+func (j *JsonReverseProxy) AddListener(listener net.Listener) {
+	j.listeners = append(j.listeners, listener)
+}
+
+// AddFramedListener adds a listening socket whose clients use framing instead of FramingJSON
+func (j *JsonReverseProxy) AddFramedListener(listener net.Listener, framing blzdJson.Framing) {
+	if j.framings == nil {
+		j.framings = make(map[net.Listener]blzdJson.Framing)
+	}
+	j.framings[listener] = framing
+	j.AddListener(listener)
+}
+
 func (j *JsonReverseProxy) acceptConnections(listener net.Listener) {
+	framing, ok := j.framings[listener]
+	if !ok {
+		framing = j.ClientFraming
+	}
 	for {
+		// Apply backpressure by not accepting while the global limit is reached
+		if j.limiter != nil && j.Limits.Policy == LimitQueue && !j.limiter.waitGlobal() {
+			return
+		}
+
 		conn, err := listener.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
@@ -184,84 +523,186 @@ func (j *JsonReverseProxy) acceptConnections(listener net.Listener) {
 			j.logger.Error().Err(err).Msg("Error accepting connection")
 			continue
 		}
-		go j.handleConnection(conn)
+		j.admitConnection(conn, framing)
 	}
 }
 
-func (j *JsonReverseProxy) handleConnection(conn net.Conn) {
+func (j *JsonReverseProxy) handleConnection(conn net.Conn, peer string, framing blzdJson.Framing) {
+	defer j.connections.Done()
+	defer conn.Close()
+	var decoderPair *ProxyConn
+	if j.limiter != nil {
+		defer func() { j.releaseSlot(peer, decoderPair) }()
+	}
+
 	// Generate a unique connection ID
 	connID := fmt.Sprintf("conn_%d", time.Now().UnixNano())
 
-	clientDecoder := blzdJson.NewJsonStreamLexer(
+	clientDecoder := blzdJson.NewJsonStreamLexerWithPolicy(
 		conn,
 		j.bufferSize,
 		j.maxRead,
 		j.asyncCallbacks,
+		j.ClientPolicy,
 	)
+	clientDecoder.SetFraming(framing)
+	// Answer invalid client input with a parse error instead of dropping the connection
+	clientDecoder.SetRecovery(true)
 
-	upstream, err := j.upstream.NewConn()
+	link, err := j.openUpstream(context.Background())
 	if err != nil {
 		j.logger.Error().Err(err).Msg("Error getting upstream connection")
 		return
 	}
-	upstreamDecoder := blzdJson.NewJsonStreamLexer(
-		upstream,
-		j.bufferSize,
-		j.maxRead,
-		j.asyncCallbacks,
-	)
+	upstream := link.stream
+	if s, ok := upstream.(*connStream); ok {
+		s.configure(j.bufferSize, j.maxRead, j.UpstreamPolicy, j.BufferPool, time.Duration(j.Timeouts.Write))
+	}
 
 	// Store connection info for debugging
-	decoderPair := &ProxyConn{
-		clientConn:      conn,
-		upstreamConn:    upstream,
-		clientDecoder:   clientDecoder,
-		upstreamDecoder: upstreamDecoder,
-		createdAt:       time.Now().Unix(),
+	decoderPair = &ProxyConn{
+		peer:          peer,
+		clientConn:    conn,
+		clientDecoder: clientDecoder,
+		createdAt:     time.Now().Unix(),
+		clientWriter:  &connWriter{conn: conn, framing: framing},
+		session:       NewSession(),
+	}
+	decoderPair.link.Store(link)
+	defer func() { decoderPair.upstream().Close() }()
+	if j.NotificationQueue.Size > 0 {
+		decoderPair.outbound = newOutboundQueue(j.NotificationQueue)
+		defer decoderPair.outbound.close()
+	}
+	decoderPair.touch(time.Duration(j.Timeouts.Idle))
+	if j.BufferPool != nil {
+		clientDecoder.SetBufferPool(j.BufferPool)
+	}
+	if u, ok := upstream.(passthroughStream); ok && j.streamsResponses() && framing == blzdJson.FramingJSON {
+		u.SetPassthrough(&clientPassthrough{conn: decoderPair, timeouts: &j.Timeouts}, j.PassthroughThreshold)
 	}
+	defer decoderPair.pending.clear()
 	j.activeConnections.Store(connID, decoderPair)
 	atomic.AddInt64(&j.ActiveConnectionsCount, 1)
 
-	j.logger.Trace().Str("connID", connID).Msg("Handling connection")
+	j.logger.Trace().Str("connID", connID).Str("peer", peer).Msg("Handling connection")
 
 	// Call the OnConnect callback if set
 	if j.OnConnect != nil {
 		go j.OnConnect(connID, decoderPair)
 	}
 
+	// Both directions are torn down as soon as one of them fails. Closing the connections
+	// is what reliably unblocks the decoders, touch can push read deadlines at any time.
 	ctx, cancelFn := context.WithCancelCause(context.Background())
+	defer cancelFn(nil)
+	stopTeardown := context.AfterFunc(ctx, func() {
+		conn.Close()
+		if decoderPair.outbound != nil {
+			decoderPair.outbound.close()
+		}
+		j.closeSession(connID, decoderPair)
+		decoderPair.upstream().Close()
+	})
+	defer stopTeardown()
 
-	// TODO: close other side if error happens on one side
-	go upstreamDecoder.DecodeAll(ctx, func(b []byte) {
-		err := j.handleMessage(b, conn, 1)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				j.logger.Debug().
-					Err(err).
-					Str("connID", connID).
-					Msg("Client->Upstream connection EOF")
+	if decoderPair.outbound != nil {
+		go j.drainNotifications(decoderPair, cancelFn)
+	}
+
+	go func() {
+		onMessage := func(b []byte) {
+			decoderPair.session.observeUpstream(b)
+			link := decoderPair.link.Load()
+			j.recordResponse(link.backend, link.probe, b)
+			if j.tracksRequests() && !j.completeRequest(connID, decoderPair, b) {
+				return
+			}
+			if j.countsInFlight() {
+				decoderPair.countResponse(b)
+			}
+
+			var err error
+			if decoderPair.outbound != nil && isNotification(b) {
+				err = j.sendNotification(connID, decoderPair, b, false)
 			} else {
-				j.logger.Error().
-					Err(err).
-					Str("connID", connID).
-					Msg("Error forwarding upstream message to client.")
+				err = j.sendResponse(decoderPair, b)
+			}
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					j.logger.Debug().
+						Err(err).
+						Str("connID", connID).
+						Msg("Client->Upstream connection EOF")
+				} else {
+					j.logger.Error().
+						Err(err).
+						Str("connID", connID).
+						Msg("Error forwarding upstream message to client.")
+				}
+
+				cancelFn(err)
+				return
 			}
 
-			cancelFn(err)
-			return
+			// Call the OnResponse callback if set
+			if j.OnResponse != nil {
+				go j.OnResponse(connID, decoderPair, bytes.Clone(b))
+			}
 		}
 
-		// Call the OnResponse callback if set
-		if j.OnResponse != nil {
-			go j.OnResponse(connID, decoderPair, b)
+		for {
+			link := decoderPair.link.Load()
+			stream := link.stream
+			b, err := stream.Receive(ctx)
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					j.logReadError(err, connID, "upstream")
+				}
+				// An idle timeout ends the connection, it doesn't mean the upstream failed
+				if ctx.Err() == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+					j.recordFailure(link.backend, link.probe, "upstream connection lost")
+					if j.reconnectUpstream(ctx, connID, decoderPair, stream) {
+						continue
+					}
+				}
+				cancelFn(err)
+				break
+			}
+
+			if j.asyncCallbacks {
+				go onMessage(bytes.Clone(b))
+			} else {
+				onMessage(b)
+			}
 		}
-	}, func(err error) {
-		j.logger.Error().Err(err).Str("connID", connID).Msg("Error reading from upstream")
-		cancelFn(err)
-	})
+		// The client can't get any more responses once the upstream is gone
+		cancelFn(errUpstreamClosed)
+	}()
 
 	clientDecoder.DecodeAll(ctx, func(b []byte) {
-		err := j.handleMessage(b, upstream, 0)
+		if j.handler != nil {
+			j.handleRequest(ctx, connID, decoderPair, b)
+			if j.OnRequest != nil {
+				go j.OnRequest(connID, decoderPair, bytes.Clone(b))
+			}
+			return
+		}
+
+		if j.hub != nil && j.hub.handle(connID, decoderPair, b) {
+			if j.OnRequest != nil {
+				go j.OnRequest(connID, decoderPair, bytes.Clone(b))
+			}
+			return
+		}
+
+		if j.Timeouts.tracksRequests() {
+			j.trackRequest(connID, decoderPair, b)
+		} else if j.countsInFlight() {
+			decoderPair.countRequest(b)
+		}
+
+		err := j.handleMessage(decoderPair, b, directionClientToUpstream)
 		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				j.logger.Debug().
@@ -281,12 +722,23 @@ func (j *JsonReverseProxy) handleConnection(conn net.Conn) {
 		}
 
 		if j.OnRequest != nil {
-			go j.OnRequest(connID, decoderPair, b)
+			go j.OnRequest(connID, decoderPair, bytes.Clone(b))
 		}
 	}, func(err error) {
-		j.logger.Error().Err(err).Str("connID", connID).Msgf("Error reading from client")
+		var skipped *blzdJson.SkippedError
+		if errors.As(err, &skipped) {
+			j.handleInvalidRequest(connID, decoderPair, skipped)
+			return
+		}
+
+		if ctx.Err() == nil {
+			j.logReadError(err, connID, "client")
+		}
 		cancelFn(err)
 	})
+	clientDecoder.Release()
+	// A client EOF ends DecodeAll without cancelling, the upstream is still open
+	j.closeSession(connID, decoderPair)
 
 	if j.OnDisconnect != nil {
 		go j.OnDisconnect(connID, decoderPair)
@@ -297,21 +749,202 @@ func (j *JsonReverseProxy) handleConnection(conn net.Conn) {
 	j.logger.Trace().Str("connID", connID).Msg("Connection closed")
 }
 
-func (j *JsonReverseProxy) handleMessage(data []byte, output net.Conn, logType byte) error {
-	data = append(data, '\n')
-	if _, err := output.Write(data); err != nil {
-		return err
+// passthroughStream is implemented by upstream streams that can stream oversized messages to the client
+type passthroughStream interface {
+	SetPassthrough(w blzdJson.PassthroughWriter, threshold int)
+}
+
+// errNoHealthyUpstream is returned when all upstreams are unhealthy or their circuit breakers are open
+var errNoHealthyUpstream = errors.New("no healthy upstream")
+
+// openUpstream opens a stream to the first healthy upstream that accepts it, skipping open circuit breakers
+func (j *JsonReverseProxy) openUpstream(ctx context.Context) (*upstreamLink, error) {
+	var errs []error
+	for _, upstream := range j.upstreams {
+		ok, probe := j.admit(upstream)
+		if !ok {
+			continue
+		}
+		stream, err := upstream.Open(ctx)
+		if err == nil {
+			return &upstreamLink{stream: stream, backend: upstream, probe: probe}, nil
+		}
+		j.recordFailure(upstream, probe, "dial failed")
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, errNoHealthyUpstream
+	}
+	return nil, errors.Join(errs...)
+}
+
+// How long closeSession waits for the upstream to accept the eth_unsubscribe requests
+const unsubscribeTimeout = time.Second
+
+// closeSession detaches the client from shared subscriptions and cancels the subscriptions a disconnected client left on its upstream stream
+func (j *JsonReverseProxy) closeSession(connID string, conn *ProxyConn) {
+	if j.hub != nil {
+		for _, sub := range conn.session.takeShared() {
+			j.hub.detach(sub)
+		}
+	}
+	if len(conn.session.Subscriptions()) == 0 {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.session.unsubscribeAll(conn.upstream())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			j.logger.Debug().Err(err).Str("connID", connID).Msg("Error unsubscribing from upstream")
+		}
+	case <-time.After(unsubscribeTimeout):
+		// Closing the stream unblocks the pending Send
+		j.logger.Debug().Str("connID", connID).Msg("Timed out unsubscribing from upstream")
+	}
+}
+
+// errUpstreamClosed is the cancel cause of a connection whose upstream stopped sending
+var errUpstreamClosed = errors.New("upstream connection closed")
+
+// tracksRequests reports if upstream responses have to be matched with client requests
+func (j *JsonReverseProxy) tracksRequests() bool {
+	return j.handler != nil || j.Timeouts.tracksRequests()
+}
+
+// countsInFlight reports if requests have to be counted so LimitEvictIdle doesn't evict
+// connections waiting for a response, tracked requests are counted by pending already
+func (j *JsonReverseProxy) countsInFlight() bool {
+	return j.Limits.enabled() && j.Limits.Policy == LimitEvictIdle && !j.tracksRequests()
+}
+
+// streamsResponses reports whether oversized upstream messages can bypass per-message handling
+func (j *JsonReverseProxy) streamsResponses() bool {
+	return j.PassthroughThreshold > 0 && j.OnResponse == nil && !j.tracksRequests() && !j.countsInFlight()
+}
+
+// logReadError logs why reading from one side of a connection stopped
+func (j *JsonReverseProxy) logReadError(err error, connID string, side string) {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		j.logger.Debug().Str("connID", connID).Dur("timeout", time.Duration(j.Timeouts.Idle)).Msg("Connection idle timeout")
+	case errors.Is(err, net.ErrClosed):
+		j.logger.Debug().Str("connID", connID).Msgf("Connection to %s closed", side)
+	default:
+		j.logger.Error().Err(err).Str("connID", connID).Msgf("Error reading from %s", side)
+	}
+}
+
+// handleInvalidRequest answers input the client decoder had to skip with a JSON-RPC parse error
+func (j *JsonReverseProxy) handleInvalidRequest(connID string, conn *ProxyConn, skipped *blzdJson.SkippedError) {
+	j.logger.Warn().
+		Err(skipped.Err).
+		Str("connID", connID).
+		Str("peer", conn.peer).
+		Int64("offset", skipped.Offset).
+		Int64("length", skipped.Length).
+		Msg("Skipped invalid client input")
+
+	resp := appendErrorResponse(nil, nil, ErrCodeParseError, "Parse error")
+	var limitErr *blzdJson.LimitError
+	if errors.As(skipped.Err, &limitErr) {
+		resp = appendErrorResponse(nil, nil, ErrCodeInvalidRequest, "Invalid request: "+limitErr.Error())
+	}
+	if err := j.handleMessage(conn, resp, directionUpstreamToClient); err != nil {
+		j.logger.Debug().Err(err).Str("connID", connID).Msg("Error writing parse error response")
+	}
+}
+
+// trackRequest registers a client request so a timeout error can be sent if upstream doesn't answer
+func (j *JsonReverseProxy) trackRequest(connID string, conn *ProxyConn, msg []byte) {
+	header := parseHeader(msg)
+	if len(header.ID) == 0 || bytes.Equal(header.ID, nullID) {
+		return // Notifications and batches don't get a timeout
+	}
+
+	// The header points into the lexer buffer, the timeout needs its own copy
+	id := bytes.Clone(header.ID)
+	method := string(header.Method)
+	timeout := j.Timeouts.requestTimeout(method)
+	conn.pending.add(id, method, timeout, func() {
+		j.logger.Warn().
+			Str("connID", connID).
+			Str("method", method).
+			RawJSON("id", id).
+			Dur("timeout", timeout).
+			Msg("Upstream request timed out")
+		link := conn.link.Load()
+		j.recordFailure(link.backend, link.probe, "request timed out")
+		conn.forgetRequest(id)
+
+		resp := appendErrorResponse(nil, id, ErrCodeTimeout, "upstream request timed out")
+		if err := j.handleMessage(conn, resp, directionUpstreamToClient); err != nil {
+			j.logger.Debug().Err(err).Str("connID", connID).Msg("Error writing timeout response")
+		}
+	})
+}
+
+// completeRequest matches an upstream response with its request. It returns false for responses
+// that are handed to the middleware chain or arrived after the client already got a timeout error.
+func (j *JsonReverseProxy) completeRequest(connID string, conn *ProxyConn, msg []byte) bool {
+	header := parseHeader(msg)
+	if len(header.ID) == 0 || len(header.Method) != 0 {
+		return true // Notifications and batches aren't tracked
 	}
 
-	direction := "Client -> Upstream"
-	if logType == 1 {
-		direction = "Upstream -> Client"
+	req := conn.pending.complete(header.ID)
+	if req == nil {
+		j.logger.Debug().
+			Str("connID", connID).
+			RawJSON("id", header.ID).
+			Msg("Dropping late upstream response")
+		return false
+	}
+	if req.response != nil {
+		// The middleware chain waiting for it sends it to the client
+		req.response <- bytes.Clone(msg)
+		if req.answered != nil && req.method == string(subscribeMethod) {
+			// The first notification may follow right after, it must not overtake the response.
+			// The chain gives up once the connection is closed, so this doesn't block forever.
+			<-req.answered
+		}
+		return false
+	}
+	return true
+}
+
+const (
+	directionClientToUpstream byte = iota
+	directionUpstreamToClient
+)
+
+func (j *JsonReverseProxy) handleMessage(conn *ProxyConn, data []byte, direction byte) error {
+	conn.touch(time.Duration(j.Timeouts.Idle))
+
+	var err error
+	if direction == directionUpstreamToClient {
+		err = conn.clientWriter.writeMessage(data, time.Duration(j.Timeouts.Write))
+	} else {
+		conn.session.observeRequest(data)
+		err = conn.upstream().Send(data)
+	}
+	if err != nil {
+		return err
 	}
 
-	j.logger.Trace().
-		Int("size", len(data)).
-		Str("body", string(data)).
-		Msgf("<%s>", direction)
+	if e := j.logger.Trace(); e.Enabled() {
+		dir := "Client -> Upstream"
+		if direction == directionUpstreamToClient {
+			dir = "Upstream -> Client"
+		}
+
+		e.Int("size", len(data)+1).
+			Str("body", string(data)).
+			Msgf("<%s>", dir)
+	}
 
 	//go s.processMessage(data, logType, time.Now())
 
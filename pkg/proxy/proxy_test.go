@@ -1,23 +1,27 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
-func init(){
+func init() {
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 }
 
@@ -35,8 +39,8 @@ func TestNewUnixUpstreamJsonRpcProxy(t *testing.T) {
 	proxy := NewUnixUpstreamJsonRpcProxy(socketPath, false, false, 4096, 4096)
 
 	assert.NotNil(t, proxy)
-	assert.NotNil(t, proxy.upstream)
-	assert.Equal(t, 1, proxy.upstream.poolSize)
+	assert.Len(t, proxy.upstreams, 1)
+	assert.Equal(t, 1, proxy.upstreams[0].(*DialUpstream).poolSize)
 	assert.False(t, proxy.listening)
 }
 
@@ -426,3 +430,370 @@ func BenchmarkProxyConcurrent(b *testing.B) {
 		})
 	}
 }
+
+// startMockUpstream starts a mock node on a unix socket that serves every connection with handler,
+// the connection is closed when handler returns
+func startMockUpstream(t *testing.T, handler func(conn net.Conn)) string {
+	t.Helper()
+	upstreamSocket := getTempSocketPath()
+	listener, err := net.Listen("unix", upstreamSocket)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+		os.Remove(upstreamSocket)
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return upstreamSocket
+}
+
+// startSilentUpstream starts a mock node that reads requests but never answers
+func startSilentUpstream(t *testing.T) string {
+	return startMockUpstream(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	upstreamSocket := startSilentUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Timeouts = Timeouts{
+		Request: Duration(20 * time.Millisecond),
+		Methods: map[string]Duration{"debug_traceTransaction": Duration(time.Hour)},
+	}
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"debug_traceTransaction","params":[],"id":"trace"}` + "\n"))
+	assert.NoError(t, err)
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":7}` + "\n"))
+	assert.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	response := make([]byte, 1024)
+	n, err := client.Read(response)
+	assert.NoError(t, err)
+
+	var responseObj struct {
+		ID    int `json:"id"`
+		Error struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal(response[:n], &responseObj))
+	assert.Equal(t, 7, responseObj.ID)
+	assert.Equal(t, ErrCodeTimeout, responseObj.Error.Code)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	upstreamSocket := startSilentUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.Timeouts.Idle = Duration(20 * time.Millisecond)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// The proxy closes the idle connection, the read returns EOF before our deadline
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestParseErrorRecovery(t *testing.T) {
+	upstreamSocket := startMockUpstream(t, func(conn net.Conn) {
+		handleBenchmarkNode(conn, getMockResponse("eth_blockNumber", 1))
+	})
+
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.ClientPolicy = blzdJson.LexerPolicy{MaxDepth: 3, Strict: true}
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	// Messages violating the lexer policy are invalid requests
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_call","params":[{"a":{"b":{"c":1}}}],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	line, err := reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid request: object exceeds maximum depth of 3"}}`, string(line))
+
+	// Garbage gets a parse error, the connection stays usable
+	_, err = client.Write([]byte("not json\n"))
+	assert.NoError(t, err)
+	line, err = reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error"}}`, string(line))
+
+	// Balanced but malformed messages only fail in strict mode
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_call","params":[tru],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	line, err = reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Parse error"}}`, string(line))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	line, err = reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x1234"}`, string(line))
+}
+
+func TestUpstreamMultiplexIds(t *testing.T) {
+	s := &connStream{multiplex: &DialUpstream{multiplex: true}}
+
+	requests := []string{
+		`{"jsonrpc":"2.0","id":7,"method":"eth_call","params":[{"id":"nested"}]}`,
+		`{"jsonrpc":"2.0", "id" : "a\"b", "method":"eth_call"}`,
+		`{"params":{"id":1},"id":null,"method":"eth_call"}`,
+	}
+	for i, req := range requests {
+		muxed, err := s.multiplexMsg([]byte(req))
+		assert.NoError(t, err)
+
+		id, err := blzdJson.ID(muxed)
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(i+1), string(id))
+
+		restored, err := s.demultiplexMsg(muxed)
+		assert.NoError(t, err)
+		assert.Equal(t, req, string(restored))
+	}
+	assert.Empty(t, s.multiplexedIds)
+
+	// Requests that aren't awaited anymore are forgotten, the oldest one first if a client reuses its id
+	for range 2 {
+		_, err := s.multiplexMsg([]byte(requests[0]))
+		assert.NoError(t, err)
+	}
+	s.forgetRequest([]byte("7"))
+	assert.Equal(t, map[uint64][]byte{5: []byte("7")}, s.multiplexedIds)
+
+	// Closing the stream drops all of them
+	s.conn, _ = net.Pipe()
+	assert.NoError(t, s.Close())
+	assert.Empty(t, s.multiplexedIds)
+
+	// Notifications pass through unchanged
+	notification := `{"jsonrpc":"2.0","method":"eth_subscription","params":{"id":3}}`
+	out, err := s.multiplexMsg([]byte(notification))
+	assert.NoError(t, err)
+	assert.Equal(t, notification, string(out))
+}
+
+func TestUpstreamMultiplexEndToEnd(t *testing.T) {
+	// The upstream answers with the id it saw
+	upstream := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":%q}`, id, id)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUpstream(UpstreamConfig{Network: "unix", Address: upstream, Multiplex: true}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	seen := map[string]bool{}
+	for range 2 {
+		client, err := net.Dial("unix", proxySocket)
+		assert.NoError(t, err)
+		defer client.Close()
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` +
+			`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":"a"}` + "\n"))
+		assert.NoError(t, err)
+		responses := readResponses(t, bufio.NewReader(client), 2)
+
+		// Clients get their own ids back, the upstream saw ids unique across both connections
+		for _, id := range []string{`1`, `"a"`} {
+			result, err := blzdJson.Field([]byte(responses[id]), "result")
+			assert.NoError(t, err)
+			assert.False(t, seen[string(result)])
+			seen[string(result)] = true
+		}
+	}
+	assert.Len(t, seen, 4)
+}
+
+func TestUpstreamMultiplexTimeout(t *testing.T) {
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUpstream(UpstreamConfig{Network: "unix", Address: startSilentUpstream(t), Multiplex: true}),
+		WithTimeouts(Timeouts{Request: Duration(20 * time.Millisecond)}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"))
+	assert.NoError(t, err)
+	responses := readResponses(t, bufio.NewReader(client), 1)
+	assert.Contains(t, responses["1"], "timed out")
+
+	// The upstream never answers, the timeout released the multiplexed id
+	streams := 0
+	proxy.activeConnections.Range(func(key, value any) bool {
+		s := value.(*ProxyConn).upstream().(*connStream)
+		s.multiplexLock.Lock()
+		assert.Empty(t, s.multiplexedIds)
+		s.multiplexLock.Unlock()
+		streams++
+		return true
+	})
+	assert.Equal(t, 1, streams)
+}
+
+func TestPassthroughResponse(t *testing.T) {
+	// Upstream answers every request with a response much bigger than the lexer buffer
+	big := `{"jsonrpc":"2.0","id":1,"result":"` + strings.Repeat("x", 1<<20) + `"}`
+	upstreamSocket := startMockUpstream(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		for {
+			if _, err := reader.ReadBytes('\n'); err != nil {
+				return
+			}
+			conn.Write([]byte(big + "\n"))
+		}
+	})
+
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	proxy.PassthroughThreshold = 64 << 10
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+
+	for i := 0; i < 2; i++ {
+		_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"debug_traceBlock","params":[],"id":1}` + "\n"))
+		assert.NoError(t, err)
+
+		line, err := reader.ReadBytes('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, big+"\n", string(line))
+	}
+}
+
+func TestUpstreamCloseTearsDownClient(t *testing.T) {
+	// Upstream hangs up on the first request
+	upstreamSocket := startMockUpstream(t, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadBytes('\n')
+	})
+
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+	proxy := NewUnixUpstreamJsonRpcProxy(upstreamSocket, false, false, 4096, 4096)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"))
+	assert.NoError(t, err)
+
+	// The proxy closes the client connection instead of waiting for its next request
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&proxy.ActiveConnectionsCount) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestFramingTranslation(t *testing.T) {
+	// Upstream speaks length-prefixed frames and echoes the request id with a big result
+	big := strings.Repeat("x", 100<<10)
+	upstreamSocket := startMockUpstream(t, func(conn net.Conn) {
+		decoder := blzdJson.NewJsonStreamLexer(conn, 4096, 4096, false)
+		decoder.SetFraming(blzdJson.FramingLengthPrefix)
+		for msg, err := range decoder.Messages(context.Background()) {
+			if err != nil {
+				return
+			}
+			id, _ := blzdJson.ID(msg)
+			resp := fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":"%s"}`, id, big)
+			conn.Write(blzdJson.FramingLengthPrefix.AppendFrame(nil, []byte(resp)))
+		}
+	})
+
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+	listener, err := net.Listen("unix", proxySocket)
+	assert.NoError(t, err)
+	proxy, err := New(
+		WithUpstream(UpstreamConfig{Network: "unix", Address: upstreamSocket, Framing: blzdJson.FramingLengthPrefix}),
+		WithPassthroughThreshold(16<<10),
+	)
+	assert.NoError(t, err)
+	proxy.AddFramedListener(listener, blzdJson.FramingContentLength)
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	responses := blzdJson.NewJsonStreamLexer(client, 4096, 4096, false)
+	responses.SetFraming(blzdJson.FramingContentLength)
+
+	for i := 1; i <= 2; i++ {
+		req := fmt.Sprintf(`{"jsonrpc":"2.0","method":"eth_call","params":[],"id":%d}`, i)
+		_, err = client.Write(blzdJson.FramingContentLength.AppendFrame(nil, []byte(req)))
+		assert.NoError(t, err)
+
+		// Oversized responses aren't streamed, they need a Content-Length header
+		resp, err := responses.Next(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"%s"}`, i, big), string(resp))
+	}
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy decides what happens to a notification for a client whose queue is full
+type QueuePolicy int
+
+const (
+	// QueueBackpressure waits for room in the queue, stalling the client's upstream connection.
+	// Notifications of shared subscriptions can't wait without holding up all subscribers, a client
+	// whose queue is full is closed instead.
+	QueueBackpressure QueuePolicy = iota
+	// QueueDropOldest discards the oldest queued notification to make room
+	QueueDropOldest
+	// QueueDropClient closes the connection of the client
+	QueueDropClient
+)
+
+var queuePolicyNames = map[QueuePolicy]string{
+	QueueBackpressure: "backpressure",
+	QueueDropOldest:   "drop-oldest",
+	QueueDropClient:   "drop-client",
+}
+
+func (p QueuePolicy) String() string {
+	if name, ok := queuePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("QueuePolicy(%d)", int(p))
+}
+
+// ParseQueuePolicy returns the policy for one of "backpressure", "drop-oldest" or "drop-client"
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	for policy, name := range queuePolicyNames {
+		if name == s {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown queue policy %q", s)
+}
+
+func (p QueuePolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *QueuePolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseQueuePolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// NotificationQueue bounds the subscription notifications waiting to be written to a client.
+// Without a queue notifications are written by the goroutine reading them from the upstream,
+// so a slow client blocks its upstream connection or, with shared subscriptions, everyone.
+// Responses still reach the client in upstream order: they wait for the notifications queued
+// before them, and a notification never overtakes the eth_subscribe response it belongs to.
+type NotificationQueue struct {
+	Size   int         `json:"size,omitempty"` // Notifications per client, 0 disables the queue
+	Policy QueuePolicy `json:"policy"`
+}
+
+// outboundQueue is the ring buffer of notifications for one client, drained by its own goroutine.
+// Responses are written directly, see flush for how they keep their order.
+type outboundQueue struct {
+	policy QueuePolicy
+
+	lock  sync.Mutex
+	items [][]byte
+	head  int
+	len   int
+
+	// Notifications ever pushed and ever written or dropped, flush waits for them to match
+	pushed   uint64
+	finished uint64
+	flushed  *sync.Cond // Signalled when finished grows or the queue closes
+	closed   bool
+
+	ready   chan struct{} // Signalled after push
+	space   chan struct{} // Signalled after pop, wakes up pushers waiting for room
+	done    chan struct{} // Closed with the connection
+	closing sync.Once
+
+	dropped atomic.Uint64
+}
+
+func newOutboundQueue(config NotificationQueue) *outboundQueue {
+	q := &outboundQueue{
+		policy: config.Policy,
+		items:  make([][]byte, config.Size),
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	q.flushed = sync.NewCond(&q.lock)
+	return q
+}
+
+// push queues a copy of msg. It reports false if the queue is full and the client has to be dropped.
+// Without wait QueueBackpressure drops the client as well.
+func (q *outboundQueue) push(msg []byte, wait bool) bool {
+	select {
+	case <-q.done:
+		return true // The connection is gone, there is nobody to deliver to
+	default:
+	}
+
+	q.lock.Lock()
+	for q.len == len(q.items) {
+		switch q.policy {
+		case QueueDropOldest:
+			q.items[q.head] = nil
+			q.head = (q.head + 1) % len(q.items)
+			q.len--
+			q.finish()
+			q.dropped.Add(1)
+		case QueueDropClient:
+			q.lock.Unlock()
+			q.dropped.Add(1)
+			return false
+		default:
+			q.lock.Unlock()
+			if !wait {
+				q.dropped.Add(1)
+				return false
+			}
+			select {
+			case <-q.space:
+			case <-q.done:
+				return true
+			}
+			q.lock.Lock()
+		}
+	}
+	q.items[(q.head+q.len)%len(q.items)] = bytes.Clone(msg)
+	q.len++
+	q.pushed++
+	q.lock.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// pop waits for the next notification, it reports false once the queue is closed
+func (q *outboundQueue) pop() ([]byte, bool) {
+	for {
+		q.lock.Lock()
+		if q.len > 0 {
+			msg := q.items[q.head]
+			q.items[q.head] = nil
+			q.head = (q.head + 1) % len(q.items)
+			q.len--
+			q.lock.Unlock()
+
+			select {
+			case q.space <- struct{}{}:
+			default:
+			}
+			return msg, true
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-q.done:
+			return nil, false
+		}
+	}
+}
+
+// written marks a popped notification as written to the client
+func (q *outboundQueue) written() {
+	q.lock.Lock()
+	q.finish()
+	q.lock.Unlock()
+}
+
+// finish counts a notification that left the queue, the lock has to be held
+func (q *outboundQueue) finish() {
+	q.finished++
+	q.flushed.Broadcast()
+}
+
+// flush waits until the notifications pushed so far were written or dropped. A response written
+// afterwards can't overtake notifications the upstream sent before it, e.g. the last ones of a
+// subscription before the eth_unsubscribe response.
+func (q *outboundQueue) flush() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for target := q.pushed; q.finished < target && !q.closed; {
+		q.flushed.Wait()
+	}
+}
+
+// queued returns the number of notifications waiting to be written
+func (q *outboundQueue) queued() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.len
+}
+
+// close stops pop and unblocks waiting pushers and flushes
+func (q *outboundQueue) close() {
+	q.closing.Do(func() {
+		close(q.done)
+		q.lock.Lock()
+		q.closed = true
+		q.flushed.Broadcast()
+		q.lock.Unlock()
+	})
+}
+
+// isNotification reports whether an upstream message is a notification like eth_subscription
+func isNotification(msg []byte) bool {
+	header := parseHeader(msg)
+	return len(header.ID) == 0 && len(header.Method) > 0
+}
+
+// sendNotification writes a notification to the client, through its queue if it has one.
+// Notifications of shared subscriptions never wait for room in the queue.
+func (j *JsonReverseProxy) sendNotification(connID string, conn *ProxyConn, msg []byte, shared bool) error {
+	if conn.outbound == nil {
+		return j.handleMessage(conn, msg, directionUpstreamToClient)
+	}
+	if conn.outbound.push(msg, !shared) {
+		return nil
+	}
+
+	atomic.AddInt64(&j.DroppedClientsCount, 1)
+	j.logger.Warn().
+		Str("connID", connID).
+		Str("peer", conn.peer).
+		Uint64("dropped_notifications", conn.DroppedNotifications()).
+		Msg("Closing slow client, notification queue is full")
+	// Closing the connection tears down both directions
+	conn.outbound.close()
+	conn.clientConn.Close()
+	return nil
+}
+
+// drainNotifications writes queued notifications to the client until the connection closes
+func (j *JsonReverseProxy) drainNotifications(conn *ProxyConn, cancelFn context.CancelCauseFunc) {
+	for {
+		msg, ok := conn.outbound.pop()
+		if !ok {
+			return
+		}
+		if err := j.handleMessage(conn, msg, directionUpstreamToClient); err != nil {
+			cancelFn(err)
+			return
+		}
+		conn.outbound.written()
+	}
+}
+
+// sendResponse writes a response to the client after the notifications queued before it
+func (j *JsonReverseProxy) sendResponse(conn *ProxyConn, msg []byte) error {
+	if conn.outbound != nil {
+		conn.outbound.flush()
+	}
+	return j.handleMessage(conn, msg, directionUpstreamToClient)
+}
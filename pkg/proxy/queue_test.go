@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func popAll(q *outboundQueue) []string {
+	var msgs []string
+	for q.queued() > 0 {
+		msg, _ := q.pop()
+		msgs = append(msgs, string(msg))
+	}
+	return msgs
+}
+
+func TestOutboundQueuePolicies(t *testing.T) {
+	q := newOutboundQueue(NotificationQueue{Size: 2, Policy: QueueDropOldest})
+	for _, msg := range []string{"a", "b", "c"} {
+		assert.True(t, q.push([]byte(msg), true))
+	}
+	assert.Equal(t, []string{"b", "c"}, popAll(q))
+	assert.Equal(t, uint64(1), q.dropped.Load())
+
+	q = newOutboundQueue(NotificationQueue{Size: 1, Policy: QueueDropClient})
+	assert.True(t, q.push([]byte("a"), true))
+	assert.False(t, q.push([]byte("b"), true))
+	assert.Equal(t, []string{"a"}, popAll(q))
+	assert.Equal(t, uint64(1), q.dropped.Load())
+
+	q = newOutboundQueue(NotificationQueue{Size: 1, Policy: QueueBackpressure})
+	assert.True(t, q.push([]byte("a"), true))
+	var pushed atomic.Bool
+	go func() {
+		q.push([]byte("b"), true)
+		pushed.Store(true)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, pushed.Load(), "push waits for room")
+	msg, ok := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "a", string(msg))
+	msg, _ = q.pop()
+	assert.Equal(t, "b", string(msg))
+	assert.Equal(t, uint64(0), q.dropped.Load())
+
+	// Closing unblocks everyone
+	assert.True(t, q.push([]byte("c"), true))
+	done := make(chan struct{})
+	go func() {
+		q.push([]byte("d"), true)
+		close(done)
+	}()
+	q.close()
+	<-done
+	assert.Equal(t, []string{"c"}, popAll(q))
+	_, ok = q.pop()
+	assert.False(t, ok)
+
+	// Shared notifications don't wait, the client is dropped
+	q = newOutboundQueue(NotificationQueue{Size: 1, Policy: QueueBackpressure})
+	assert.True(t, q.push([]byte("a"), false))
+	assert.False(t, q.push([]byte("b"), false))
+	assert.Equal(t, uint64(1), q.dropped.Load())
+}
+
+func TestOutboundQueueFlush(t *testing.T) {
+	q := newOutboundQueue(NotificationQueue{Size: 4, Policy: QueueDropOldest})
+	q.flush() // Nothing queued
+
+	assert.True(t, q.push([]byte("a"), true))
+	var flushed atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		q.flush()
+		flushed.Store(true)
+		close(done)
+	}()
+	q.pop()
+	time.Sleep(20 * time.Millisecond)
+	assert.False(t, flushed.Load(), "flush waits until the notification was written")
+	q.written()
+	<-done
+
+	// Closing unblocks flushes
+	assert.True(t, q.push([]byte("b"), true))
+	done = make(chan struct{})
+	go func() {
+		q.flush()
+		close(done)
+	}()
+	q.close()
+	<-done
+}
+
+func TestQueuedNotificationOrder(t *testing.T) {
+	notification := `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0x1","result":"%d"}}`
+	upstreamSocket := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		var lines []string
+		switch method {
+		case "eth_subscribe":
+			// The first notification follows the response right away
+			lines = append(lines, fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":"0x1"}`, id), fmt.Sprintf(notification, 0))
+		case "eth_unsubscribe":
+			for i := 1; i <= 100; i++ {
+				lines = append(lines, fmt.Sprintf(notification, i))
+			}
+			lines = append(lines, fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":true}`, id))
+		}
+		return []byte(strings.Join(lines, "\n"))
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	// The middleware is slow to hand back the eth_subscribe response
+	slow := MiddlewareFunc(func(ctx context.Context, req *Request, next Handler) (*Response, error) {
+		resp, err := next(ctx, req)
+		if req.Method == "eth_subscribe" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return resp, err
+	})
+	proxy, err := New(WithUnixUpstream(upstreamSocket), WithMiddleware(slow),
+		WithNotificationQueue(NotificationQueue{Size: 256, Policy: QueueBackpressure}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		return strings.TrimSpace(line)
+	}
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}` + "\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, readLine())
+	assert.Equal(t, fmt.Sprintf(notification, 0), readLine())
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","id":2,"method":"eth_unsubscribe","params":["0x1"]}` + "\n"))
+	assert.NoError(t, err)
+	for i := 1; i <= 100; i++ {
+		assert.Equal(t, fmt.Sprintf(notification, i), readLine())
+	}
+	assert.Equal(t, `{"jsonrpc":"2.0","id":2,"result":true}`, readLine())
+}
+
+// startFloodUpstream starts a mock node that answers every message with count notifications
+func startFloodUpstream(t *testing.T, count int) string {
+	return startMockUpstream(t, func(conn net.Conn) {
+		buf := make([]byte, 4096)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		payload := make([]byte, 1024)
+		for i := range payload {
+			payload[i] = 'x'
+		}
+		for i := range count {
+			_, err := fmt.Fprintf(conn, `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0x1","result":"%d%s"}}`+"\n", i, payload)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	upstreamSocket := startFloodUpstream(t, 10000)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(upstreamSocket), WithNotificationQueue(NotificationQueue{Size: 16, Policy: QueueDropClient}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	// The client never reads, so the socket buffers and then the queue fill up
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}` + "\n"))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&proxy.DroppedClientsCount) == 1 && atomic.LoadInt64(&proxy.ActiveConnectionsCount) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// Retry resends idempotent requests that failed because of the upstream, on another upstream if
+// there is a healthy one or on a new connection to the same one. A connection whose upstream breaks
+// is reconnected instead of closed, unless the client holds subscriptions on it.
+// Other requests in flight get an ErrCodeUpstreamClosed error, they are never sent twice.
+type Retry struct {
+	// Retries per request, 0 disables retries
+	Attempts int `json:"attempts,omitempty"`
+	// Wait before the first retry, doubled for every further one
+	Backoff Duration `json:"backoff,omitempty"`
+	// Error codes of upstream responses that are worth retrying, e.g. -32000 for "header not found"
+	ErrorCodes []int `json:"errorCodes,omitempty"`
+}
+
+func (r *Retry) enabled() bool {
+	return r.Attempts > 0
+}
+
+// backoff returns the wait before the given retry, starting at 1
+func (r *Retry) backoff(attempt int) time.Duration {
+	return time.Duration(r.Backoff) << min(attempt-1, 16)
+}
+
+// retryable reports whether an upstream response is an error with one of the configured codes
+func (r *Retry) retryable(msg []byte) bool {
+	if len(r.ErrorCodes) == 0 {
+		return false
+	}
+	errObj, err := blzdJson.Field(msg, "error")
+	if err != nil {
+		return false
+	}
+	code, err := blzdJson.Field(errObj, "code")
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(string(code))
+	return err == nil && slices.Contains(r.ErrorCodes, n)
+}
+
+// neverRetried are methods with side effects that are never sent twice, even if configured as idempotent
+var neverRetried = []string{
+	"eth_sendRawTransaction",
+	"eth_sendTransaction",
+	"eth_sendBundle",
+	"eth_sendPrivateTransaction",
+	"personal_sendTransaction",
+}
+
+// callResult is the outcome of a request sent through a requestClient
+type callResult struct {
+	msg []byte
+	err error
+}
+
+// retry resends a request, preferring a healthy upstream other than the one of the connection
+func (j *JsonReverseProxy) retry(ctx context.Context, conn *ProxyConn, msg []byte) <-chan callResult {
+	result := make(chan callResult, 1)
+	client, probe := j.requestClient(conn.backend())
+	if client == nil {
+		client, probe = j.requestClient(nil)
+	}
+	if client == nil {
+		result <- callResult{err: errNoHealthyUpstream}
+		return result
+	}
+
+	go func() {
+		resp, err := client.call(ctx, msg, probe)
+		result <- callResult{msg: resp, err: err}
+	}()
+	return result
+}
+
+// reconnectUpstream replaces the broken upstream stream of a connection so the client can continue.
+// The requests in flight are failed, forwardRequest retries the idempotent ones.
+func (j *JsonReverseProxy) reconnectUpstream(ctx context.Context, connID string, conn *ProxyConn, failed UpstreamStream) bool {
+	if !j.Retry.enabled() || j.handler == nil || conn.session.holdsSubscriptions() {
+		return false
+	}
+	failed.Close()
+	conn.pending.fail()
+
+	for attempt := 1; attempt <= j.Retry.Attempts; attempt++ {
+		select {
+		case <-time.After(j.Retry.backoff(attempt)):
+		case <-ctx.Done():
+			return false
+		}
+
+		link, err := j.openUpstream(ctx)
+		if err != nil {
+			j.logger.Debug().Err(err).Str("connID", connID).Int("attempt", attempt).Msg("Error reconnecting upstream")
+			continue
+		}
+		if s, ok := link.stream.(*connStream); ok {
+			s.configure(j.bufferSize, j.maxRead, j.UpstreamPolicy, j.BufferPool, time.Duration(j.Timeouts.Write))
+		}
+		conn.link.Store(link)
+		if ctx.Err() != nil {
+			// The teardown may have missed the new stream
+			link.stream.Close()
+			return false
+		}
+
+		atomic.AddInt64(&j.ReconnectedUpstreamsCount, 1)
+		j.logger.Warn().Str("connID", connID).Int("attempt", attempt).Msg("Reconnected upstream")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// startScriptedUpstream starts a mock node that passes the requests of every connection to answer.
+// The connection is closed when answer returns nil.
+func startScriptedUpstream(t *testing.T, answer func(conn int, method string, id []byte) []byte) string {
+	var conns atomic.Int32
+	return startMockUpstream(t, func(conn net.Conn) {
+		i := int(conns.Add(1) - 1)
+		decoder := blzdJson.NewJsonStreamLexer(conn, 4096, 4096, false)
+		for msg, err := range decoder.Messages(context.Background()) {
+			if err != nil {
+				return
+			}
+			header := parseHeader(msg)
+			resp := answer(i, string(header.Method), header.ID)
+			if resp == nil {
+				return
+			}
+			if len(resp) > 0 {
+				conn.Write(append(resp, '\n'))
+			}
+		}
+	})
+}
+
+func readResponses(t *testing.T, reader *bufio.Reader, n int) map[string]string {
+	responses := map[string]string{}
+	for range n {
+		line, err := reader.ReadBytes('\n')
+		if !assert.NoError(t, err) {
+			break
+		}
+		id, err := blzdJson.ID(line)
+		assert.NoError(t, err)
+		responses[string(id)] = string(bytes.TrimSpace(line))
+	}
+	return responses
+}
+
+func TestRetryErrorCodes(t *testing.T) {
+	lagging := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"error":{"code":-32000,"message":"header not found"}}`, id)
+	})
+	synced := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":"0x1"}`, id)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(lagging), WithUnixUpstream(synced),
+		WithRetry(Retry{Attempts: 2, Backoff: Duration(time.Millisecond), ErrorCodes: []int{-32000}}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_getBlockByNumber","params":["latest",false],"id":1}` +
+		`{"jsonrpc":"2.0","method":"eth_sendRawTransaction","params":["0x00"],"id":2}` + "\n"))
+	assert.NoError(t, err)
+	responses := readResponses(t, bufio.NewReader(client), 2)
+
+	// The idempotent request is answered by the other upstream, the transaction is never resent
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"0x1"}`, responses["1"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"error":{"code":-32000,"message":"header not found"}}`, responses["2"])
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.RetriedRequestsCount))
+}
+
+func TestRetryAfterUpstreamBreaks(t *testing.T) {
+	var received atomic.Int32
+	upstream := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		// The first connection breaks after it got both requests
+		if conn == 0 {
+			if received.Add(1) == 2 {
+				return nil
+			}
+			return []byte{}
+		}
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":%q}`, id, method)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(upstream), WithRetry(Retry{Attempts: 3, Backoff: Duration(time.Millisecond)}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` +
+		`{"jsonrpc":"2.0","method":"eth_sendRawTransaction","params":["0x00"],"id":2}` + "\n"))
+	assert.NoError(t, err)
+	responses := readResponses(t, reader, 2)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"eth_blockNumber"}`, responses["1"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"error":{"code":-32001,"message":"upstream connection lost"}}`, responses["2"])
+
+	// The client connection survived on a new upstream connection
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":3}` + "\n"))
+	assert.NoError(t, err)
+	responses = readResponses(t, reader, 1)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":3,"result":"eth_chainId"}`, responses["3"])
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.ReconnectedUpstreamsCount))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&proxy.RetriedRequestsCount))
+}
+
+func TestRetrySendDuringReconnect(t *testing.T) {
+	upstream := startScriptedUpstream(t, func(conn int, method string, id []byte) []byte {
+		if conn == 0 {
+			return nil // The first connection breaks right away
+		}
+		return fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":%q}`, id, method)
+	})
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	proxy, err := New(WithUnixUpstream(upstream), WithRetry(Retry{Attempts: 2, Backoff: Duration(300 * time.Millisecond)}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_blockNumber","params":[],"id":1}` + "\n"))
+	assert.NoError(t, err)
+
+	// The proxy waits for the backoff before it reconnects, sends to the closed stream fail meanwhile
+	time.Sleep(100 * time.Millisecond)
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":2}` +
+		`{"jsonrpc":"2.0","method":"eth_sendRawTransaction","params":["0x00"],"id":3}` + "\n"))
+	assert.NoError(t, err)
+	responses := readResponses(t, reader, 3)
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":1,"result":"eth_blockNumber"}`, responses["1"])
+	assert.JSONEq(t, `{"jsonrpc":"2.0","id":2,"result":"eth_chainId"}`, responses["2"])
+	assert.Contains(t, responses["3"], `"error"`)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&proxy.RetriedRequestsCount))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	retry := Retry{Backoff: Duration(10 * time.Millisecond)}
+	assert.Equal(t, 10*time.Millisecond, retry.backoff(1))
+	assert.Equal(t, 40*time.Millisecond, retry.backoff(3))
+
+	retry.ErrorCodes = []int{-32000}
+	assert.True(t, retry.retryable([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`)))
+	assert.False(t, retry.retryable([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`)))
+	assert.False(t, retry.retryable([]byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`)))
+
+	// Transactions are never resent, even if configured as idempotent
+	proxy, err := New(WithUnixUpstream(getTempSocketPath()), WithIdempotentMethods("eth_call", "eth_sendRawTransaction"))
+	assert.NoError(t, err)
+	proxy.Listen()
+	defer proxy.Shutdown()
+	assert.True(t, proxy.idempotent("eth_call"))
+	assert.False(t, proxy.idempotent("eth_sendRawTransaction"))
+}
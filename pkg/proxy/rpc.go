@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"strconv"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// JSON-RPC 2.0 error codes used for responses generated by the proxy itself
+const (
+	ErrCodeParseError     = -32700
+	ErrCodeInvalidRequest = -32600
+	ErrCodeMethodNotFound = -32601
+	ErrCodeInternalError  = -32603
+
+	// Implementation defined server errors (-32000 to -32099)
+	ErrCodeTimeout        = -32000
+	ErrCodeUpstreamClosed = -32001
+)
+
+var nullID = []byte("null")
+
+// rpcHeader holds the fields of a JSON-RPC message the proxy needs for bookkeeping.
+// They point into the message and have to be copied to outlive it.
+type rpcHeader struct {
+	ID     []byte // Raw JSON id
+	Method []byte // Unquoted method name
+}
+
+var headerKeys = []string{"id", "method"}
+
+// parseHeader extracts id and method from a single JSON-RPC message without copying.
+// Batches and invalid messages return an empty header.
+func parseHeader(msg []byte) rpcHeader {
+	var header rpcHeader
+	if len(msg) == 0 || msg[0] != '{' {
+		return header
+	}
+
+	var values [2][]byte
+	if err := blzdJson.Fields(msg, headerKeys, values[:]); err != nil {
+		return header
+	}
+	header.ID = values[0]
+	if values[1] != nil {
+		header.Method, _ = blzdJson.Unquote(values[1])
+	}
+	return header
+}
+
+// appendErrorResponse appends a JSON-RPC error response for the given raw id to dst
+func appendErrorResponse(dst []byte, id []byte, code int, message string) []byte {
+	if len(id) == 0 {
+		id = nullID
+	}
+
+	dst = append(dst, `{"jsonrpc":"2.0","id":`...)
+	dst = append(dst, id...)
+	dst = append(dst, `,"error":{"code":`...)
+	dst = strconv.AppendInt(dst, int64(code), 10)
+	dst = append(dst, `,"message":`...)
+	dst = appendJSONString(dst, message)
+	dst = append(dst, "}}"...)
+	return dst
+}
+
+// appendResultResponse appends a JSON-RPC response with a raw JSON result for the given raw id to dst
+func appendResultResponse(dst []byte, id []byte, result []byte) []byte {
+	if len(id) == 0 {
+		id = nullID
+	}
+	if len(result) == 0 {
+		result = nullID
+	}
+
+	dst = append(dst, `{"jsonrpc":"2.0","id":`...)
+	dst = append(dst, id...)
+	dst = append(dst, `,"result":`...)
+	dst = append(dst, result...)
+	dst = append(dst, '}')
+	return dst
+}
+
+// appendJSONString appends s as a quoted JSON string to dst
+func appendJSONString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return append(dst, '"')
+}
@@ -1,9 +1,320 @@
 package proxy
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+)
+
+// SessionMode decides how client connections are mapped to upstream connections
+type SessionMode uint8
+
+const (
+	// SessionOneToOne opens a dedicated upstream connection for every client connection
+	SessionOneToOne SessionMode = iota
+)
+
+var sessionModeNames = map[SessionMode]string{
+	SessionOneToOne: "one-to-one",
+}
+
+func (m SessionMode) String() string {
+	if name, ok := sessionModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("SessionMode(%d)", int(m))
+}
+
+func (m SessionMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *SessionMode) UnmarshalText(text []byte) error {
+	for mode, name := range sessionModeNames {
+		if name == string(text) {
+			*m = mode
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown session mode %q", text)
+}
+
+// Session tracks the subscriptions a client holds on its upstream. Messages are observed on their
+// way through the proxy: eth_subscribe requests are matched with the subscription ids in their
+// responses, eth_subscription notifications are counted and eth_unsubscribe removes subscriptions.
+// Subscriptions created in batches aren't tracked.
+//
+// With JsonReverseProxy.SharedSubscriptions the client's subscriptions are served by the proxy
+// wide subscriptionHub instead, the session only keeps a reference to them.
 type Session struct {
-	upstream *Upstream
+	lock          sync.Mutex
+	requests      map[string]sessionRequest // eth_subscribe and eth_unsubscribe requests by raw JSON id
+	subscriptions map[string]*subscription  // by subscription id
+	shared        map[string]*subscriber    // Shared subscriptions by the client's subscription id
+	closed        bool                      // Set once the client disconnected, no shared subscriptions are added after
+	tracked       atomic.Int32              // Number of requests and subscriptions, upstream messages are ignored while 0
+}
+
+// sessionRequest is a subscription request waiting for its response
+type sessionRequest struct {
+	params         []byte // Raw params of eth_subscribe
+	subscriptionID string // Subscription removed by eth_unsubscribe
+}
+
+type subscription struct {
+	params        []byte
+	createdAt     time.Time
+	notifications atomic.Uint64
+}
+
+// Subscription is a snapshot of a subscription held by a client
+type Subscription struct {
+	ID            string
+	Params        json.RawMessage // Params of the eth_subscribe request, e.g. ["newHeads"]
+	CreatedAt     time.Time
+	Notifications uint64 // Notifications received so far
+	Shared        bool   // Served by an upstream subscription shared with other clients
 }
 
 func NewSession() *Session {
 	return &Session{}
 }
+
+var (
+	subscribeKeyword    = []byte("subscribe")
+	subscriptionMethod  = []byte("eth_subscription")
+	subscribeMethod     = []byte("eth_subscribe")
+	unsubscribeMethod   = []byte("eth_unsubscribe")
+	sessionResponseKeys = []string{"id", "method", "result", "params"}
+)
+
+// observeRequest records subscription requests a client sends to the upstream
+func (s *Session) observeRequest(msg []byte) {
+	// Most requests have nothing to do with subscriptions, skip them before parsing
+	if !bytes.Contains(msg, subscribeKeyword) {
+		return
+	}
+	header := parseHeader(msg)
+	if len(header.ID) == 0 || bytes.Equal(header.ID, nullID) {
+		return
+	}
+
+	var req sessionRequest
+	switch {
+	case bytes.Equal(header.Method, subscribeMethod):
+		params, err := blzdJson.Field(msg, "params")
+		if err != nil {
+			return
+		}
+		req.params = bytes.Clone(params)
+	case bytes.Equal(header.Method, unsubscribeMethod):
+		id := firstParam(msg)
+		if id == "" {
+			return
+		}
+		req.subscriptionID = id
+	default:
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.requests == nil {
+		s.requests = make(map[string]sessionRequest)
+	}
+	if _, ok := s.requests[string(header.ID)]; !ok {
+		s.tracked.Add(1)
+	}
+	s.requests[string(header.ID)] = req
+}
+
+// observeUpstream matches upstream responses with subscription requests and counts notifications
+func (s *Session) observeUpstream(msg []byte) {
+	if s.tracked.Load() == 0 || len(msg) == 0 || msg[0] != '{' {
+		return
+	}
+
+	var values [4][]byte
+	if err := blzdJson.Fields(msg, sessionResponseKeys, values[:]); err != nil {
+		return
+	}
+	id, method, result, params := values[0], values[1], values[2], values[3]
+
+	if method != nil {
+		if name, _ := blzdJson.Unquote(method); bytes.Equal(name, subscriptionMethod) {
+			s.countNotification(params)
+		}
+		return
+	}
+	if id == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	req, ok := s.requests[string(id)]
+	if !ok {
+		return
+	}
+	delete(s.requests, string(id))
+	s.tracked.Add(-1)
+
+	switch {
+	case req.subscriptionID != "":
+		if bytes.Equal(result, []byte("true")) && s.subscriptions[req.subscriptionID] != nil {
+			delete(s.subscriptions, req.subscriptionID)
+			s.tracked.Add(-1)
+		}
+	case result != nil:
+		// Errors have no result, the subscription was never created
+		subID, err := blzdJson.Unquote(result)
+		if err != nil || len(subID) == 0 {
+			return
+		}
+		if s.subscriptions == nil {
+			s.subscriptions = make(map[string]*subscription)
+		}
+		if _, ok := s.subscriptions[string(subID)]; !ok {
+			s.tracked.Add(1)
+		}
+		s.subscriptions[string(subID)] = &subscription{params: req.params, createdAt: time.Now()}
+	}
+}
+
+func (s *Session) countNotification(params []byte) {
+	subID, err := blzdJson.Field(params, "subscription")
+	if err != nil {
+		return
+	}
+	if subID, err = blzdJson.Unquote(subID); err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	sub := s.subscriptions[string(subID)]
+	s.lock.Unlock()
+	if sub != nil {
+		sub.notifications.Add(1)
+	}
+}
+
+// holdsSubscriptions reports whether the client has or is creating subscriptions on its upstream stream
+func (s *Session) holdsSubscriptions() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.subscriptions) > 0 {
+		return true
+	}
+	for _, req := range s.requests {
+		if req.subscriptionID == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriptions returns the subscriptions the client currently holds
+func (s *Session) Subscriptions() []Subscription {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subs := make([]Subscription, 0, len(s.subscriptions)+len(s.shared))
+	for id, sub := range s.subscriptions {
+		subs = append(subs, Subscription{
+			ID:            id,
+			Params:        sub.params,
+			CreatedAt:     sub.createdAt,
+			Notifications: sub.notifications.Load(),
+		})
+	}
+	for id, sub := range s.shared {
+		subs = append(subs, Subscription{
+			ID:            id,
+			Params:        sub.shared.params,
+			CreatedAt:     sub.createdAt,
+			Notifications: sub.notifications.Load(),
+			Shared:        true,
+		})
+	}
+	return subs
+}
+
+// addShared reports false if the client already disconnected
+func (s *Session) addShared(sub *subscriber) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.shared == nil {
+		s.shared = make(map[string]*subscriber)
+	}
+	s.shared[sub.id] = sub
+	return true
+}
+
+func (s *Session) removeShared(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.shared, id)
+}
+
+// takeShared removes and returns all shared subscriptions, used when the client disconnects
+func (s *Session) takeShared() []*subscriber {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subs := make([]*subscriber, 0, len(s.shared))
+	for _, sub := range s.shared {
+		subs = append(subs, sub)
+	}
+	s.shared = nil
+	s.closed = true
+	return subs
+}
+
+// unsubscribeAll sends eth_unsubscribe for every subscription the client left behind and forgets them
+func (s *Session) unsubscribeAll(upstream UpstreamStream) error {
+	s.lock.Lock()
+	ids := make([]string, 0, len(s.subscriptions))
+	for id := range s.subscriptions {
+		ids = append(ids, id)
+	}
+	s.tracked.Add(-int32(len(s.subscriptions)))
+	s.subscriptions = nil
+	s.lock.Unlock()
+
+	var msg []byte
+	for i, id := range ids {
+		msg = append(msg[:0], `{"jsonrpc":"2.0","id":"proxy_unsubscribe_`...)
+		msg = strconv.AppendInt(msg, int64(i), 10)
+		msg = append(msg, `","method":"eth_unsubscribe","params":[`...)
+		msg = appendJSONString(msg, id)
+		msg = append(msg, "]}"...)
+		if err := upstream.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstParam returns the first element of the params array if it is a string
+func firstParam(msg []byte) string {
+	params, err := blzdJson.Field(msg, "params")
+	if err != nil {
+		return ""
+	}
+	var ids []json.RawMessage
+	if json.Unmarshal(params, &ids) != nil || len(ids) == 0 {
+		return ""
+	}
+	id, err := blzdJson.Unquote(ids[0])
+	if err != nil {
+		return ""
+	}
+	return string(id)
+}
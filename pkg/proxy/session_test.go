@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionSubscriptions(t *testing.T) {
+	session := NewSession()
+
+	// Nothing is parsed while no subscription is tracked
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","id":1,"result":"0xa"}`))
+	assert.Empty(t, session.Subscriptions())
+
+	session.observeRequest([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`))
+	session.observeRequest([]byte(`{"jsonrpc":"2.0","id":2,"method":"eth_subscribe","params":["logs",{"address":"0x1"}]}`))
+	session.observeRequest([]byte(`{"jsonrpc":"2.0","id":3,"method":"eth_subscribe","params":["bogus"]}`))
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","id":1,"result":"0xa"}`))
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","id":2,"result":"0xb"}`))
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","id":3,"error":{"code":-32602,"message":"invalid"}}`))
+
+	for range 2 {
+		session.observeUpstream([]byte(`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0xa","result":{}}}`))
+	}
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0xb","result":{}}}`))
+
+	subs := map[string]Subscription{}
+	for _, sub := range session.Subscriptions() {
+		subs[sub.ID] = sub
+	}
+	assert.Len(t, subs, 2)
+	assert.Equal(t, `["newHeads"]`, string(subs["0xa"].Params))
+	assert.Equal(t, uint64(2), subs["0xa"].Notifications)
+	assert.Equal(t, `["logs",{"address":"0x1"}]`, string(subs["0xb"].Params))
+	assert.Equal(t, uint64(1), subs["0xb"].Notifications)
+
+	// Failed unsubscribes keep the subscription
+	session.observeRequest([]byte(`{"jsonrpc":"2.0","id":4,"method":"eth_unsubscribe","params":["0xa"]}`))
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","id":4,"result":false}`))
+	assert.Len(t, session.Subscriptions(), 2)
+	session.observeRequest([]byte(`{"jsonrpc":"2.0","id":5,"method":"eth_unsubscribe","params":["0xa"]}`))
+	session.observeUpstream([]byte(`{"jsonrpc":"2.0","id":5,"result":true}`))
+	assert.Len(t, session.Subscriptions(), 1)
+	assert.Equal(t, int32(1), session.tracked.Load())
+}
+
+// startSubscriptionUpstream starts a mock node that creates a subscription for every eth_subscribe
+// request, sends one notification for it and reports the params of eth_unsubscribe requests
+func startSubscriptionUpstream(t *testing.T) (string, <-chan string) {
+	unsubscribed := make(chan string, 16)
+	upstreamSocket := startMockUpstream(t, func(conn net.Conn) {
+		count := 0
+		decoder := blzdJson.NewJsonStreamLexer(conn, 4096, 4096, false)
+		for msg, err := range decoder.Messages(context.Background()) {
+			if err != nil {
+				return
+			}
+			var req struct {
+				ID     json.RawMessage `json:"id"`
+				Method string          `json:"method"`
+				Params json.RawMessage `json:"params"`
+			}
+			if json.Unmarshal(msg, &req) != nil {
+				continue
+			}
+			switch req.Method {
+			case "eth_subscribe":
+				count++
+				fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":"0x%d"}`+"\n", req.ID, count)
+				fmt.Fprintf(conn, `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0x%d","result":%d}}`+"\n", count, count)
+			case "eth_unsubscribe":
+				unsubscribed <- string(req.Params)
+				fmt.Fprintf(conn, `{"jsonrpc":"2.0","id":%s,"result":true}`+"\n", req.ID)
+			}
+		}
+	})
+	return upstreamSocket, unsubscribed
+}
+
+func TestSessionUnsubscribeOnDisconnect(t *testing.T) {
+	upstreamSocket, unsubscribed := startSubscriptionUpstream(t)
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+
+	connected := make(chan *ProxyConn, 1)
+	proxy, err := New(WithUnixUpstream(upstreamSocket), WithHooks(Hooks{
+		OnConnect: func(id string, conn *ProxyConn) { connected <- conn },
+	}))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+	defer proxy.Shutdown()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	_, err = client.Write([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}` +
+		`{"jsonrpc":"2.0","id":2,"method":"eth_subscribe","params":["newPendingTransactions"]}` +
+		`{"jsonrpc":"2.0","id":3,"method":"eth_unsubscribe","params":["0x2"]}` + "\n"))
+	assert.NoError(t, err)
+	// Two responses with a notification each and the unsubscribe response
+	for range 5 {
+		_, err := reader.ReadBytes('\n')
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, `["0x2"]`, <-unsubscribed)
+
+	conn := <-connected
+	subs := conn.Session().Subscriptions()
+	if assert.Len(t, subs, 1) {
+		assert.Equal(t, "0x1", subs[0].ID)
+		assert.Equal(t, `["newHeads"]`, string(subs[0].Params))
+		assert.Equal(t, uint64(1), subs[0].Notifications)
+	}
+
+	// The subscription left behind is cancelled on the upstream
+	client.Close()
+	select {
+	case params := <-unsubscribed:
+		assert.Equal(t, `["0x1"]`, params)
+	case <-time.After(time.Second):
+		t.Fatal("eth_unsubscribe wasn't sent")
+	}
+}
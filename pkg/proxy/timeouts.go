@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// Timeouts configures deadlines for proxied connections. A zero duration disables the timeout.
+type Timeouts struct {
+	// Close the connection if no message was seen in either direction for this long
+	Idle Duration `json:"idle,omitempty"`
+	// Deadline for a single write to the client or upstream
+	Write Duration `json:"write,omitempty"`
+	// Time the upstream has to answer a request before the client gets a timeout error
+	Request Duration `json:"request,omitempty"`
+	// Per method overrides of Request, e.g. for debug_traceTransaction
+	Methods map[string]Duration `json:"methods,omitempty"`
+}
+
+// requestTimeout returns the response timeout for a method
+func (t *Timeouts) requestTimeout(method string) time.Duration {
+	if d, ok := t.Methods[method]; ok {
+		return time.Duration(d)
+	}
+	return time.Duration(t.Request)
+}
+
+// tracksRequests reports if requests have to be matched with their responses
+func (t *Timeouts) tracksRequests() bool {
+	return t.Request > 0 || len(t.Methods) > 0
+}
+
+type pendingRequest struct {
+	method   string
+	sentAt   time.Time
+	timer    *time.Timer
+	response chan []byte     // Set for requests awaited by the middleware chain
+	answered <-chan struct{} // Closed once the middleware chain wrote the response, may be nil
+}
+
+// pendingRequests tracks requests of one connection that wait for an upstream response
+type pendingRequests struct {
+	lock     sync.Mutex
+	requests map[string]*pendingRequest // by raw JSON id
+}
+
+// add starts tracking a request, onTimeout is called if no response arrives in time
+func (p *pendingRequests) add(id []byte, method string, timeout time.Duration, onTimeout func()) {
+	key := string(id)
+	req := &pendingRequest{method: method, sentAt: time.Now()}
+
+	p.lock.Lock()
+	if p.requests == nil {
+		p.requests = make(map[string]*pendingRequest)
+	}
+	if old, ok := p.requests[key]; ok && old.timer != nil {
+		// The client reused an id of a request still in flight, the newer one wins
+		old.timer.Stop()
+	}
+	p.requests[key] = req
+	if timeout > 0 {
+		req.timer = time.AfterFunc(timeout, func() {
+			p.lock.Lock()
+			timedOut := p.requests[key] == req
+			if timedOut {
+				delete(p.requests, key)
+			}
+			p.lock.Unlock()
+
+			if timedOut {
+				onTimeout()
+			}
+		})
+	}
+	p.lock.Unlock()
+}
+
+// await starts tracking a request whose response is delivered through its response channel,
+// answered is closed once the middleware chain wrote it to the client.
+// It returns nil if a request with the same id is already in flight.
+func (p *pendingRequests) await(id []byte, method string, answered <-chan struct{}) *pendingRequest {
+	key := string(id)
+	req := &pendingRequest{method: method, sentAt: time.Now(), response: make(chan []byte, 1), answered: answered}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.requests == nil {
+		p.requests = make(map[string]*pendingRequest)
+	}
+	if _, ok := p.requests[key]; ok {
+		return nil
+	}
+	p.requests[key] = req
+	return req
+}
+
+// cancel stops tracking req if it is still waiting for its response and reports whether it was
+func (p *pendingRequests) cancel(id []byte, req *pendingRequest) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.requests[string(id)] != req {
+		return false
+	}
+	delete(p.requests, string(id))
+	return true
+}
+
+// complete stops tracking the request with the given id and returns it, nil if unknown
+func (p *pendingRequests) complete(id []byte) *pendingRequest {
+	req := p.remove(string(id))
+	if req != nil && req.timer != nil {
+		req.timer.Stop()
+	}
+	return req
+}
+
+func (p *pendingRequests) remove(key string) *pendingRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	req, ok := p.requests[key]
+	if !ok {
+		return nil
+	}
+	delete(p.requests, key)
+	return req
+}
+
+// fail hands nil to all requests awaited by the middleware chain, used when the upstream stream broke
+func (p *pendingRequests) fail() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, req := range p.requests {
+		if req.timer != nil {
+			req.timer.Stop()
+		}
+		if req.response != nil {
+			select {
+			case req.response <- nil:
+			default:
+			}
+		}
+		delete(p.requests, key)
+	}
+}
+
+// clear stops all timers, used when the connection closes
+func (p *pendingRequests) clear() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, req := range p.requests {
+		if req.timer != nil {
+			req.timer.Stop()
+		}
+		delete(p.requests, key)
+	}
+}
+
+// len returns the number of requests in flight
+func (p *pendingRequests) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.requests)
+}
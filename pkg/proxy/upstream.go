@@ -2,24 +2,312 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
 )
 
-type Upstream struct {
+// Upstream is a backend the proxy forwards client connections to, e.g. a node behind a socket,
+// an in-process handler or a mock. Every client connection gets a stream of its own.
+type Upstream interface {
+	// Open starts a new stream to the backend
+	Open(ctx context.Context) (UpstreamStream, error)
+	// Healthy reports whether the upstream should get new streams, unhealthy ones are skipped
+	Healthy() bool
+	// Close releases the upstream, no streams are opened afterwards
+	Close() error
+}
+
+// UpstreamStream is a message stream to an upstream. Send may be called concurrently with itself
+// and with Receive, Close unblocks pending calls.
+//
+// Streams can implement SetReadDeadline(time.Time) error to support idle timeouts and
+// SetPassthrough like JsonStreamLexer to stream oversized responses to the client.
+type UpstreamStream interface {
+	// Send writes one complete message to the upstream
+	Send(msg []byte) error
+	// Receive blocks until the next message from the upstream. The message is only valid until
+	// the next call, io.EOF means the upstream closed the stream.
+	Receive(ctx context.Context) ([]byte, error)
+	Close() error
+}
+
+// DialUpstream is the Upstream for nodes reachable over a socket, it dials a connection per stream
+type DialUpstream struct {
 	pool     []net.Conn
 	poolSize int
 	dial     func() (net.Conn, error)
+	config   UpstreamConfig
+
+	// Dial failures mark the upstream unhealthy for a while
+	failedAt atomic.Int64
+	closed   atomic.Bool
 
+	// Request ids are replaced with ids unique across all streams of the upstream
 	multiplex       bool
 	multiplexLastId atomic.Uint64
-	multiplexedIds  []uint32
 }
 
-func (u *Upstream) Intialize() error {
+// How long a DialUpstream is unhealthy after a failed dial
+const dialRetryDelay = time.Second
+
+// NewDialUpstream creates an upstream for the node described by config
+func NewDialUpstream(config UpstreamConfig) *DialUpstream {
+	return &DialUpstream{
+		pool:      []net.Conn{},
+		poolSize:  1,
+		config:    config,
+		multiplex: config.Multiplex,
+		dial: func() (net.Conn, error) {
+			return net.Dial(config.Network, config.Address)
+		},
+	}
+}
+
+func (u *DialUpstream) Open(ctx context.Context) (UpstreamStream, error) {
+	if u.closed.Load() {
+		return nil, net.ErrClosed
+	}
+
+	conn, err := u.NewConn()
+	if err != nil {
+		u.failedAt.Store(time.Now().UnixNano())
+		return nil, err
+	}
+	u.failedAt.Store(0)
+	s := newConnStream(conn, u.config.Framing)
+	if u.multiplex {
+		s.multiplex = u
+	}
+	return s, nil
+}
+
+func (u *DialUpstream) Healthy() bool {
+	failedAt := u.failedAt.Load()
+	return !u.closed.Load() && (failedAt == 0 || time.Since(time.Unix(0, failedAt)) > dialRetryDelay)
+}
+
+func (u *DialUpstream) Close() error {
+	u.closed.Store(true)
+	for _, conn := range u.pool {
+		conn.Close()
+	}
+	u.pool = nil
+	return nil
+}
+
+func (u *DialUpstream) String() string {
+	return u.config.Network + ":" + u.config.Address
+}
+
+// connStream is the UpstreamStream of a DialUpstream
+type connStream struct {
+	conn         net.Conn
+	decoder      *blzdJson.JsonStreamLexer
+	writer       *connWriter
+	writeTimeout time.Duration
+
+	// Set if request ids are multiplexed, the original ids are restored in the responses
+	multiplex      *DialUpstream
+	multiplexLock  sync.Mutex
+	multiplexedIds map[uint64][]byte // Original client id by multiplexed id
+}
+
+func newConnStream(conn net.Conn, framing blzdJson.Framing) *connStream {
+	s := &connStream{
+		conn:   conn,
+		writer: &connWriter{conn: conn, framing: framing},
+	}
+	s.configure(16384, 4096, DefaultUpstreamLexerPolicy, blzdJson.DefaultBufferPool, 0)
+	return s
+}
+
+// configure replaces the default lexer settings, it has to be called before the first Receive
+func (s *connStream) configure(bufferSize, maxRead int, policy blzdJson.LexerPolicy, pool *blzdJson.BufferPool, writeTimeout time.Duration) {
+	s.decoder = blzdJson.NewJsonStreamLexerWithPolicy(s.conn, bufferSize, maxRead, false, policy)
+	s.decoder.SetFraming(s.writer.framing)
+	if pool != nil {
+		s.decoder.SetBufferPool(pool)
+	}
+	s.writeTimeout = writeTimeout
+}
+
+func (s *connStream) Send(msg []byte) error {
+	if s.multiplex != nil {
+		var err error
+		if msg, err = s.multiplexMsg(msg); err != nil {
+			return err
+		}
+	}
+	return s.writer.writeMessage(msg, s.writeTimeout)
+}
+
+func (s *connStream) Receive(ctx context.Context) ([]byte, error) {
+	msg, err := s.decoder.Next(ctx)
+	if err != nil {
+		var skipped *blzdJson.SkippedError
+		if !errors.As(err, &skipped) {
+			// The error is final, Next won't touch the buffer again
+			s.decoder.Release()
+		}
+		return msg, err
+	}
+	if s.multiplex != nil {
+		return s.demultiplexMsg(msg)
+	}
+	return msg, nil
+}
+
+func (s *connStream) Close() error {
+	// Responses can't arrive anymore
+	s.multiplexLock.Lock()
+	s.multiplexedIds = nil
+	s.multiplexLock.Unlock()
+	return s.conn.Close()
+}
+
+func (s *connStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *connStream) SetPassthrough(w blzdJson.PassthroughWriter, threshold int) {
+	if s.multiplex != nil {
+		return // Streamed responses would bypass demultiplexMsg
+	}
+	s.decoder.SetPassthrough(w, threshold)
+}
+
+// requestClient sends single requests to an upstream over one stream shared by all client
+// connections, e.g. hedged requests that leave the connection's own upstream. Request ids are
+// replaced with ids of the client and restored in the response.
+type requestClient struct {
+	proxy    *JsonReverseProxy
+	upstream Upstream
+	lastID   atomic.Uint64
+
+	lock    sync.Mutex
+	stream  UpstreamStream           // Opened with the first request
+	pending map[string]chan<- []byte // by raw JSON id, closed if the stream fails
+}
+
+func newRequestClient(proxy *JsonReverseProxy, upstream Upstream) *requestClient {
+	return &requestClient{proxy: proxy, upstream: upstream, pending: make(map[string]chan<- []byte)}
+}
+
+// call sends a request and waits for its response, probe is the circuit breaker tag of the request
+func (c *requestClient) call(ctx context.Context, msg []byte, probe uint64) ([]byte, error) {
+	id := strconv.AppendUint([]byte(`"proxy_request_`), c.lastID.Add(1), 10)
+	id = append(id, '"')
+	out, clientID, err := blzdJson.ReplaceID(nil, msg, id)
+	if err != nil {
+		return nil, err
+	}
+	clientID = bytes.Clone(clientID)
+
+	response := make(chan []byte, 1)
+	c.lock.Lock()
+	stream, err := c.openStream(ctx)
+	if err != nil {
+		c.lock.Unlock()
+		c.proxy.recordFailure(c.upstream, probe, "dial failed")
+		return nil, err
+	}
+	c.pending[string(id)] = response
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, string(id))
+		c.lock.Unlock()
+	}()
+
+	if err := stream.Send(out); err != nil {
+		c.proxy.recordFailure(c.upstream, probe, "send failed")
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-response:
+		if !ok {
+			c.proxy.recordFailure(c.upstream, probe, "upstream connection lost")
+			return nil, errUpstreamClosed
+		}
+		c.proxy.recordResponse(c.upstream, probe, resp)
+		resp, _, err = blzdJson.ReplaceID(nil, resp, clientID)
+		return resp, err
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// openStream returns the stream of the client and opens it if necessary, the lock has to be held
+func (c *requestClient) openStream(ctx context.Context) (UpstreamStream, error) {
+	if c.stream != nil {
+		return c.stream, nil
+	}
+
+	stream, err := c.upstream.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := stream.(*connStream); ok {
+		j := c.proxy
+		s.configure(j.bufferSize, j.maxRead, j.UpstreamPolicy, j.BufferPool, time.Duration(j.Timeouts.Write))
+	}
+	c.stream = stream
+	go c.receive(stream)
+	return stream, nil
+}
+
+// receive hands responses to the waiting calls until the stream closes
+func (c *requestClient) receive(stream UpstreamStream) {
+	for {
+		msg, err := stream.Receive(context.Background())
+		if err != nil {
+			break
+		}
+		id, err := blzdJson.ID(msg)
+		if err != nil {
+			continue
+		}
+
+		c.lock.Lock()
+		if response, ok := c.pending[string(id)]; ok {
+			delete(c.pending, string(id))
+			response <- bytes.Clone(msg)
+		}
+		c.lock.Unlock()
+	}
+
+	// Fail the calls in flight, the next call opens a new stream
+	stream.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stream == stream {
+		c.stream = nil
+	}
+	for id, response := range c.pending {
+		close(response)
+		delete(c.pending, id)
+	}
+}
+
+func (c *requestClient) close() {
+	c.lock.Lock()
+	stream := c.stream
+	c.lock.Unlock()
+	if stream != nil {
+		stream.Close()
+	}
+}
+
+func (u *DialUpstream) Intialize() error {
 	err := u.RefillPool()
 	if err != nil {
 		return err
@@ -28,7 +316,7 @@ func (u *Upstream) Intialize() error {
 	return nil
 }
 
-func (u *Upstream) RefillPool() error {
+func (u *DialUpstream) RefillPool() error {
 	diff := u.poolSize - len(u.pool)
 	if diff == 0 {
 		return nil
@@ -47,7 +335,7 @@ func (u *Upstream) RefillPool() error {
 }
 
 // Return a random upstream from pool
-func (u *Upstream) PooledConn() (net.Conn, error) {
+func (u *DialUpstream) PooledConn() (net.Conn, error) {
 	if u.poolSize == 1 {
 		return u.pool[0], nil
 	}
@@ -56,58 +344,69 @@ func (u *Upstream) PooledConn() (net.Conn, error) {
 	return u.pool[i], nil
 }
 
-func (u *Upstream) NewConn() (net.Conn, error) {
+func (u *DialUpstream) NewConn() (net.Conn, error) {
 	return u.dial()
 }
 
-func (u *Upstream) WriteMsg(msg []byte, conn net.Conn) (int, error) {
-	if u.multiplex {
-		var err error
-		msg, err = u.multiplexMsg(msg)
-		if err != nil {
-			return -1, err
-		}
+// multiplexMsg replaces the id of a client request with an id unique for the upstream and
+// remembers the original for demultiplexMsg. Notifications and batches are passed through unchanged.
+func (s *connStream) multiplexMsg(msg []byte) ([]byte, error) {
+	nextId := s.multiplex.multiplexLastId.Add(1)
+
+	var idBuf [20]byte
+	out, oldID, err := blzdJson.ReplaceID(nil, msg, strconv.AppendUint(idBuf[:0], nextId, 10))
+	if errors.Is(err, blzdJson.ErrFieldNotFound) || errors.Is(err, blzdJson.ErrNotObject) {
+		return msg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	s.multiplexLock.Lock()
+	if s.multiplexedIds == nil {
+		s.multiplexedIds = make(map[uint64][]byte)
 	}
+	s.multiplexedIds[nextId] = bytes.Clone(oldID)
+	s.multiplexLock.Unlock()
 
-	return conn.Write(msg)
+	return out, nil
 }
 
-func (u *Upstream) multiplexMsg(msg []byte) ([]byte, error) {
-	// Patch the message with a multiplexed id
-	nextId := u.multiplexLastId.Add(1)
-
-	idPos := bytes.Index(msg, []byte(`"id":`))
-	if idPos == -1 {
-		return nil, errors.New("No id found in original message")
+// demultiplexMsg restores the original client id in an upstream response.
+// Messages without a multiplexed id, like subscription notifications, are passed through unchanged.
+func (s *connStream) demultiplexMsg(msg []byte) ([]byte, error) {
+	id, err := blzdJson.ID(msg)
+	if err != nil {
+		return msg, nil
 	}
-	startPos := -1
-	endPos := -1
-	for i := idPos + 5; i < len(msg); i++ {
-		// Find id string start
-		if msg[i] == '\\' {
-			return nil, errors.New("Escape character found in id - this is not supported")
-		}
-		if msg[i] == '"' {
-			if startPos == -1 {
-				startPos = i
-				continue
-			}
-			endPos = i
-			break
-		}
+	multiplexedId, err := strconv.ParseUint(string(id), 10, 64)
+	if err != nil {
+		return msg, nil
 	}
 
-	if startPos == -1 || endPos == -1 {
-		return nil, errors.New("Id string key found but no (completed) value")
+	s.multiplexLock.Lock()
+	originalID, ok := s.multiplexedIds[multiplexedId]
+	delete(s.multiplexedIds, multiplexedId)
+	s.multiplexLock.Unlock()
+	if !ok {
+		return msg, nil
 	}
 
-	// Insert the multiplexed id
-	idS := strconv.FormatUint(nextId, 10)
-	msg = append(msg[:startPos+1], append([]byte(idS), msg[endPos:]...)...)
-
-	// TODO: make this thread safe
-	u.multiplexedIds = append(u.multiplexedIds, uint32(nextId))
+	out, _, err := blzdJson.ReplaceID(nil, msg, originalID)
+	return out, err
+}
 
-	return msg, nil
+// forgetRequest drops the multiplexed id of a request whose response isn't awaited anymore,
+// e.g. after it timed out. A late response is passed through with the multiplexed id.
+func (s *connStream) forgetRequest(id []byte) {
+	s.multiplexLock.Lock()
+	defer s.multiplexLock.Unlock()
+	// Clients may reuse ids, the oldest request with the id is the one given up on
+	var oldest uint64
+	for multiplexedId, originalID := range s.multiplexedIds {
+		if bytes.Equal(originalID, id) && (oldest == 0 || multiplexedId < oldest) {
+			oldest = multiplexedId
+		}
+	}
+	delete(s.multiplexedIds, oldest)
 }
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blzdJson "github.com/BLAZED-sh/rpc-rproxy/pkg/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockUpstream answers every request in process with the name of the upstream as result
+type mockUpstream struct {
+	name    string
+	healthy atomic.Bool
+	opened  atomic.Int64
+	closed  atomic.Bool
+}
+
+func newMockUpstream(name string) *mockUpstream {
+	u := &mockUpstream{name: name}
+	u.healthy.Store(true)
+	return u
+}
+
+func (u *mockUpstream) Open(ctx context.Context) (UpstreamStream, error) {
+	u.opened.Add(1)
+	return &mockStream{name: u.name, responses: make(chan []byte, 16), done: make(chan struct{})}, nil
+}
+
+func (u *mockUpstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+func (u *mockUpstream) Close() error {
+	u.closed.Store(true)
+	return nil
+}
+
+type mockStream struct {
+	name      string
+	responses chan []byte
+	done      chan struct{}
+	closed    atomic.Bool
+}
+
+func (s *mockStream) Send(msg []byte) error {
+	id, err := blzdJson.ID(msg)
+	if err != nil {
+		return nil // Notification
+	}
+	select {
+	case s.responses <- fmt.Appendf(nil, `{"jsonrpc":"2.0","id":%s,"result":%q}`, id, s.name):
+		return nil
+	case <-s.done:
+		return net.ErrClosed
+	}
+}
+
+func (s *mockStream) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case msg := <-s.responses:
+		return msg, nil
+	case <-s.done:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func (s *mockStream) Close() error {
+	if s.closed.CompareAndSwap(false, true) {
+		close(s.done)
+	}
+	return nil
+}
+
+func TestCustomUpstream(t *testing.T) {
+	down := newMockUpstream("down")
+	down.healthy.Store(false)
+	backend := newMockUpstream("backend")
+
+	proxySocket := getTempSocketPath()
+	defer os.Remove(proxySocket)
+	proxy, err := New(WithCustomUpstream(down), WithCustomUpstream(backend))
+	assert.NoError(t, err)
+	assert.NoError(t, proxy.AddUnixSocketListener(context.Background(), proxySocket))
+	proxy.Listen()
+
+	client, err := net.Dial("unix", proxySocket)
+	assert.NoError(t, err)
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	for i := 1; i <= 2; i++ {
+		_, err = fmt.Fprintf(client, `{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":%d}`+"\n", i)
+		assert.NoError(t, err)
+		line, err := reader.ReadBytes('\n')
+		assert.NoError(t, err)
+		assert.JSONEq(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":"backend"}`, i), string(line))
+	}
+
+	// Unhealthy upstreams are skipped, the proxy owns its upstreams
+	assert.Equal(t, int64(0), down.opened.Load())
+	assert.Equal(t, int64(1), backend.opened.Load())
+	proxy.Shutdown()
+	assert.True(t, backend.closed.Load())
+}
+
+func TestDialUpstreamHealth(t *testing.T) {
+	upstream := NewDialUpstream(UpstreamConfig{Network: "unix", Address: getTempSocketPath()})
+	assert.True(t, upstream.Healthy())
+
+	_, err := upstream.Open(context.Background())
+	assert.Error(t, err)
+	assert.False(t, upstream.Healthy(), "a failed dial marks the upstream unhealthy")
+
+	upstream.failedAt.Store(time.Now().Add(-2 * dialRetryDelay).UnixNano())
+	assert.True(t, upstream.Healthy(), "the upstream is retried after a while")
+
+	upstream.Close()
+	assert.False(t, upstream.Healthy())
+	_, err = upstream.Open(context.Background())
+	assert.ErrorIs(t, err, net.ErrClosed)
+}